@@ -2,20 +2,32 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gouthamve/hardcover-book-embed/internal/api"
 	"github.com/gouthamve/hardcover-book-embed/internal/cache"
 	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/images"
+	"github.com/gouthamve/hardcover-book-embed/internal/links"
 	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+	"github.com/gouthamve/hardcover-book-embed/web"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(runToken(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	apiToken := os.Getenv("HARDCOVER_API_TOKEN")
 	if apiToken == "" {
 		log.Fatal("HARDCOVER_API_TOKEN environment variable is required")
@@ -39,44 +51,190 @@ func main() {
 		}
 	}
 
-	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
-	if allowedOrigins == "" {
+	allowedOriginsList := os.Getenv("ALLOWED_ORIGINS")
+	if allowedOriginsList == "" {
 		// Default to restrictive - must be explicitly configured for production
 		fmt.Println("WARNING: ALLOWED_ORIGINS not set. CORS is disabled by default for security.")
-		fmt.Println("To enable CORS, set ALLOWED_ORIGINS environment variable (e.g., 'https://example.com,https://app.example.com' or '*' for all origins)")
-		allowedOrigins = ""
+		fmt.Println("To enable CORS, set ALLOWED_ORIGINS environment variable (e.g., 'https://example.com,https://*.example.com' or '*' for all origins)")
+	}
+	allowedOrigins, err := api.ParseAllowedOrigins(allowedOriginsList)
+	if err != nil {
+		log.Fatalf("Failed to parse ALLOWED_ORIGINS: %v", err)
+	}
+
+	imageCacheDir := os.Getenv("IMAGE_CACHE_DIR")
+	if imageCacheDir == "" {
+		imageCacheDir = filepath.Join(os.TempDir(), "hardcover-embed-images")
+	}
+	// Resized covers are cheap to keep and slow to recreate, so keep them for a week
+	diskCache, err := cache.NewDiskCache(imageCacheDir, 7*24*time.Hour)
+	if err != nil {
+		log.Fatalf("Failed to create image cache: %v", err)
+	}
+
+	// Only allowed and the most requested usernames get their own metric label
+	var metricsUsernames []string
+	if usernames := os.Getenv("METRICS_USERNAMES"); usernames != "" {
+		metricsUsernames = strings.Split(usernames, ",")
+	}
+	usernameTopN := 0
+	if topN := os.Getenv("METRICS_USERNAME_TOP_N"); topN != "" {
+		if n, err := strconv.Atoi(topN); err == nil && n > 0 {
+			usernameTopN = n
+		}
 	}
+	metrics.Usernames = metrics.NewUsernameTracker(metricsUsernames, usernameTopN)
 
 	client := hardcover.NewClient(apiToken)
 	memCache := cache.NewMemoryCache(cacheTTL)
-	server := api.NewServer(client, memCache, allowedOrigins)
+	// Cover thumbnails change far less often than shelves, so keep them
+	// longer, in up to 64MB of memory
+	blobCache := cache.NewBlobCache(24*time.Hour, 64<<20)
+	var linkTemplates *links.Config
+	if path := os.Getenv("LINK_TEMPLATES_FILE"); path != "" {
+		if linkTemplates, err = links.Load(path); err != nil {
+			log.Fatalf("Failed to load link templates: %v", err)
+		}
+	}
+
+	// Usernames can be bound to the only sites that may embed them. SIGHUP
+	// rereads the bindings.
+	var usernameOrigins *api.UsernameOrigins
+	if path := os.Getenv("USERNAME_ORIGINS_FILE"); path != "" {
+		if usernameOrigins, err = api.LoadUsernameOrigins(path); err != nil {
+			log.Fatalf("Failed to load username origins: %v", err)
+		}
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := usernameOrigins.Reload(); err != nil {
+					log.Printf("Failed to reload username origins, keeping the current ones: %v", err)
+					continue
+				}
+				log.Printf("Reloaded username origins for %d usernames", usernameOrigins.Len())
+			}
+		}()
+	}
+
+	// Signed embed tokens are optional. With a secret, API requests and
+	// embed pages need one.
+	var embedTokens *api.EmbedTokens
+	if secret := os.Getenv("EMBED_TOKEN_SECRET"); secret != "" {
+		if embedTokens, err = api.NewEmbedTokens([]byte(secret)); err != nil {
+			log.Fatalf("Invalid EMBED_TOKEN_SECRET: %v", err)
+		}
+	}
+
+	// Inbound requests that can reach Hardcover are rate limited per client
+	// IP and per embedding origin, each off unless given a rate
+	var limitOptions []api.RateLimitOption
+	if perMinute := envFloat("RATE_LIMIT_IP_PER_MINUTE", 0); perMinute > 0 {
+		limitOptions = append(limitOptions, api.WithIPLimit(perMinute, int(envFloat("RATE_LIMIT_IP_BURST", 20))))
+	}
+	if perMinute := envFloat("RATE_LIMIT_ORIGIN_PER_MINUTE", 0); perMinute > 0 {
+		limitOptions = append(limitOptions, api.WithOriginLimit(perMinute, int(envFloat("RATE_LIMIT_ORIGIN_BURST", 100)), allowedOrigins))
+		if allowedOrigins.AllowsAny() {
+			fmt.Println("WARNING: ALLOWED_ORIGINS allows any origin, so clients can pick their own origin rate limit by sending any Origin header.")
+		}
+	}
+	trustedProxies, err := api.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Failed to parse TRUSTED_PROXIES: %v", err)
+	}
+	limiter := api.NewRateLimiter(append(limitOptions, api.WithCORSOrigins(allowedOrigins), api.WithTrustedProxies(trustedProxies))...)
+
+	impressions := api.NewImpressions()
+	fetcher := images.NewFetcher(blobCache)
+	server := api.NewServer(client, memCache, allowedOrigins,
+		api.WithImpressions(impressions),
+		api.WithUsernameOrigins(usernameOrigins),
+		api.WithLinkTemplates(linkTemplates),
+		api.WithBlobCache(blobCache),
+		api.WithDiskCache(diskCache),
+		api.WithImageFetcher(fetcher),
+		// Cover analysis runs beside request handling, so keep it to a
+		// couple of workers and a short queue
+		api.WithImageAnalyzer(images.NewAnalyzer(fetcher, 2, 100)))
 
 	// Create a new ServeMux
 	mux := http.NewServeMux()
 
 	// Register routes with patterns and metrics middleware
 	mux.HandleFunc("GET /api/books/currently-reading/{username}",
-		api.MetricsMiddleware("currently-reading")(server.HandleUserCurrentlyReading))
+		api.MetricsMiddleware("currently-reading")(limiter.Middleware("currently-reading")(embedTokens.Middleware("currently-reading")(api.CompressMiddleware(server.HandleUserCurrentlyReading)))))
 	mux.HandleFunc("GET /api/books/last-read/{username}",
-		api.MetricsMiddleware("last-read")(server.HandleUserLastRead))
+		api.MetricsMiddleware("last-read")(limiter.Middleware("last-read")(embedTokens.Middleware("last-read")(api.CompressMiddleware(server.HandleUserLastRead)))))
 	mux.HandleFunc("GET /api/books/reviews/{username}",
-		api.MetricsMiddleware("reviews")(server.HandleUserReviews))
+		api.MetricsMiddleware("reviews")(limiter.Middleware("reviews")(embedTokens.Middleware("reviews")(api.CompressMiddleware(server.HandleUserReviews)))))
+
+	mux.HandleFunc("GET /og/{shelf}/{username}",
+		api.MetricsMiddleware("og-image")(limiter.Middleware("og-image")(embedTokens.Middleware("")(server.HandleOGImage))))
+	mux.HandleFunc("GET /img/{bookID}",
+		api.MetricsMiddleware("cover-image")(limiter.Middleware("cover-image")(server.HandleCoverImage)))
+	mux.HandleFunc("GET /img/placeholder/{file}",
+		api.MetricsMiddleware("placeholder-cover")(limiter.Middleware("placeholder-cover")(server.HandlePlaceholderCover)))
+	mux.HandleFunc("GET /r/{shelf}/{username}/{bookID}",
+		api.MetricsMiddleware("click")(limiter.Middleware("click")(embedTokens.Middleware("")(server.HandleClick))))
 
 	// Handle OPTIONS for CORS
 	mux.HandleFunc("OPTIONS /api/books/currently-reading/{username}", server.HandleUserCurrentlyReading)
 	mux.HandleFunc("OPTIONS /api/books/last-read/{username}", server.HandleUserLastRead)
 	mux.HandleFunc("OPTIONS /api/books/reviews/{username}", server.HandleUserReviews)
 
+	// Pages and scripts are built into the binary. WEB_DIR serves them from
+	// disk instead, to try changes without rebuilding.
+	var webFiles fs.FS = web.Files
+	if webDir := os.Getenv("WEB_DIR"); webDir != "" {
+		webFiles = os.DirFS(webDir)
+	}
+
 	mux.HandleFunc("GET /test-widget.html", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "./web/test-widget.html")
+		http.ServeFileFS(w, r, webFiles, "test-widget.html")
 	})
 	mux.HandleFunc("GET /test-reviews.html", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "./web/test-reviews.html")
+		http.ServeFileFS(w, r, webFiles, "test-reviews.html")
 	})
 
 	// Static file handler with caching
-	staticHandler := api.NewStaticHandler("./web/static")
+	staticOptions := []api.StaticOption{api.WithEmbedImpressions(impressions)}
+	// Grafana Faro monitoring on embed pages is third-party, so it is opt-in
+	if faroCollector := os.Getenv("FARO_COLLECTOR_URL"); faroCollector != "" {
+		staticOptions = append(staticOptions, api.WithFaroCollector(faroCollector))
+	}
+	// Embed pages may be framed by the sites in FRAME_ANCESTORS, or else
+	// by the sites allowed to call the API
+	frameAncestorSources, err := api.ParseFrameAncestors(os.Getenv("FRAME_ANCESTORS"))
+	if err != nil {
+		log.Fatalf("Failed to parse frame ancestors: %v", err)
+	}
+	if len(frameAncestorSources) == 0 {
+		var skipped []string
+		frameAncestorSources, skipped = allowedOrigins.FrameAncestors()
+		if len(skipped) > 0 {
+			fmt.Printf("WARNING: Regular expression origins can't restrict framing, set FRAME_ANCESTORS to cover them: %s\n", strings.Join(skipped, ", "))
+		}
+	}
+	if len(frameAncestorSources) == 0 {
+		fmt.Println("WARNING: FRAME_ANCESTORS and ALLOWED_ORIGINS not set. Any site may frame embed pages.")
+	}
+	staticOptions = append(staticOptions, api.WithFrameAncestors(frameAncestorSources))
+	staticOptions = append(staticOptions, api.WithEmbedUsernameOrigins(usernameOrigins))
+	if embedTokens != nil {
+		staticOptions = append(staticOptions, api.WithEmbedTokens(embedTokens))
+	}
+	staticFiles, err := fs.Sub(webFiles, "static")
+	if err != nil {
+		log.Fatalf("Failed to open static files: %v", err)
+	}
+	staticHandler, err := api.NewStaticHandler(staticFiles, staticOptions...)
+	if err != nil {
+		log.Fatalf("Failed to load static files: %v", err)
+	}
 	mux.Handle("/static/", http.StripPrefix("/static/", staticHandler))
+	// Any browser can send violation reports, and each is logged
+	mux.HandleFunc("POST "+api.CSPReportPath,
+		api.MetricsMiddleware("csp-report")(limiter.Middleware("csp-report")(api.NewCSPReports().Handle)))
 
 	// Initialize metrics
 	metrics.Init()
@@ -85,6 +243,9 @@ func main() {
 	go func() {
 		metricsMux := http.NewServeMux()
 		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsMux.HandleFunc("GET /clicks", server.HandleClickStats)
+		metricsMux.HandleFunc("GET /impressions", impressions.HandleSummary)
+		metricsMux.HandleFunc("GET /debug/usernames", metrics.Usernames.HandleDebug)
 		log.Printf("Metrics server starting on port %s", metricsPort)
 		if err := http.ListenAndServe(":"+metricsPort, metricsMux); err != nil {
 			log.Fatal("Metrics server failed to start:", err)
@@ -95,8 +256,23 @@ func main() {
 	log.Printf("Metrics available on port %s/metrics", metricsPort)
 	log.Printf("Cache TTL: %v", cacheTTL)
 	log.Printf("Allowed origins: %s", allowedOrigins)
+	log.Printf("Image cache directory: %s", imageCacheDir)
 
 	if err := http.ListenAndServe(":"+port, mux); err != nil {
 		log.Fatal("Server failed to start:", err)
 	}
 }
+
+// envFloat returns the number in environment variable name, or fallback when
+// it is unset
+func envFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s: must be a non-negative number", name)
+	}
+	return n
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/api"
+)
+
+// runToken mints an embed token signed with EMBED_TOKEN_SECRET and prints
+// it, for the token subcommand
+func runToken(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("token", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: hardcover-embed token -username NAME -origin ORIGIN [-shelf SHELF] [-ttl DURATION]")
+		fmt.Fprintln(stderr, "\nMints an embed token signed with EMBED_TOKEN_SECRET.")
+		flags.PrintDefaults()
+	}
+	username := flags.String("username", "", "Hardcover username the token grants (required)")
+	origin := flags.String("origin", "", "origin rule of the sites that may embed, such as https://example.com, or * for any (required)")
+	shelf := flags.String("shelf", "", "the one shelf the token grants: currently-reading, last-read or reviews (default: all)")
+	ttl := flags.Duration("ttl", 365*24*time.Hour, "how long the token is valid")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *username == "" || *origin == "" {
+		flags.Usage()
+		return 2
+	}
+
+	tokens, err := api.NewEmbedTokens([]byte(os.Getenv("EMBED_TOKEN_SECRET")))
+	if err != nil {
+		fmt.Fprintf(stderr, "EMBED_TOKEN_SECRET: %v\n", err)
+		return 1
+	}
+	token, err := tokens.Mint(api.EmbedToken{
+		Username: *username,
+		Shelf:    *shelf,
+		Origin:   *origin,
+		Expires:  time.Now().Add(*ttl).Unix(),
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to mint token: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, token)
+	return 0
+}
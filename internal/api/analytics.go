@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+const (
+	// maxOriginLabels caps the distinct referring origins we label metrics
+	// with; later ones are counted as "other"
+	maxOriginLabels = 100
+	// maxImpressionEntries caps the in-process impression aggregate
+	maxImpressionEntries = 10000
+)
+
+// labelSet bounds the distinct values of a metric label. The first max
+// values seen are kept; later ones are reported as "other".
+type labelSet struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	max  int
+}
+
+func newLabelSet(max int) *labelSet {
+	return &labelSet{seen: make(map[string]bool), max: max}
+}
+
+func (l *labelSet) label(value string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[value] {
+		return value
+	}
+	if len(l.seen) >= l.max {
+		return "other"
+	}
+	l.seen[value] = true
+	return value
+}
+
+// refererOrigin reduces a Referer to the scheme and host of the embedding
+// page
+func refererOrigin(referer string) string {
+	if referer == "" {
+		return "none"
+	}
+	u, err := url.Parse(referer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "invalid"
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host)
+}
+
+// requestOrigin returns the origin of the page that made r, preferring the
+// Origin header sent with cross-origin fetches over the Referer
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return refererOrigin(origin)
+	}
+	return refererOrigin(r.Referer())
+}
+
+// hasOpaqueOrigin reports whether r was made by a page with an opaque
+// origin, such as a sandboxed frame, which sends Origin: null. Any site can
+// make one, so such requests can't be allowed by origin.
+func hasOpaqueOrigin(r *http.Request) bool {
+	return r.Header.Get("Origin") == "null"
+}
+
+// impressionKey identifies one row of the impression aggregate
+type impressionKey struct {
+	Origin   string `json:"origin"`
+	Shelf    string `json:"shelf"`
+	Username string `json:"username"`
+}
+
+type impressionCount struct {
+	impressionKey
+	Impressions int64 `json:"impressions"`
+}
+
+// ImpressionSummary is the JSON summary of embed impressions
+type ImpressionSummary struct {
+	Since    time.Time         `json:"since"`
+	Total    int64             `json:"total"`
+	ByOrigin map[string]int64  `json:"by_origin"`
+	ByShelf  map[string]int64  `json:"by_shelf"`
+	Embeds   []impressionCount `json:"embeds"`
+}
+
+// Impressions counts embed loads by embedding origin, shelf and username.
+// Only the scheme and host of the embedding page are kept: no paths, IP
+// addresses or other visitor details.
+type Impressions struct {
+	mu      sync.Mutex
+	since   time.Time
+	counts  map[impressionKey]int64
+	origins *labelSet
+}
+
+// NewImpressions creates an empty impression tracker
+func NewImpressions() *Impressions {
+	return &Impressions{
+		since:   time.Now(),
+		counts:  make(map[impressionKey]int64),
+		origins: newLabelSet(maxOriginLabels),
+	}
+}
+
+// Record counts an embed of a shelf loaded by r. Requests from our own
+// pages, such as the widget inside an embed page, are not counted, since the
+// embed page was counted when it was served. A nil Impressions counts
+// nothing.
+func (i *Impressions) Record(r *http.Request, shelf, username string) {
+	if i == nil {
+		return
+	}
+
+	origin := requestOrigin(r)
+	if strings.HasSuffix(origin, "://"+strings.ToLower(r.Host)) {
+		return
+	}
+	origin = i.origins.label(origin)
+	metrics.EmbedImpressionsTotal.WithLabelValues(shelf, origin).Inc()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := impressionKey{Origin: origin, Shelf: shelf, Username: strings.ToLower(username)}
+	if _, ok := i.counts[key]; ok || len(i.counts) < maxImpressionEntries {
+		i.counts[key]++
+	}
+}
+
+// Summary returns the impressions since startup, most viewed embeds first
+func (i *Impressions) Summary() ImpressionSummary {
+	i.mu.Lock()
+	summary := ImpressionSummary{
+		Since:    i.since,
+		ByOrigin: make(map[string]int64),
+		ByShelf:  make(map[string]int64),
+		Embeds:   make([]impressionCount, 0, len(i.counts)),
+	}
+	for key, count := range i.counts {
+		summary.Total += count
+		summary.ByOrigin[key.Origin] += count
+		summary.ByShelf[key.Shelf] += count
+		summary.Embeds = append(summary.Embeds, impressionCount{impressionKey: key, Impressions: count})
+	}
+	i.mu.Unlock()
+
+	sort.Slice(summary.Embeds, func(a, b int) bool {
+		x, y := summary.Embeds[a], summary.Embeds[b]
+		if x.Impressions != y.Impressions {
+			return x.Impressions > y.Impressions
+		}
+		if x.Origin != y.Origin {
+			return x.Origin < y.Origin
+		}
+		if x.Shelf != y.Shelf {
+			return x.Shelf < y.Shelf
+		}
+		return x.Username < y.Username
+	})
+	return summary
+}
+
+// HandleSummary serves the impression summary as JSON. It is meant for the
+// metrics port, away from the public API.
+func (i *Impressions) HandleSummary(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(i.Summary()); err != nil {
+		log.Printf("Error encoding impression summary: %v", err)
+	}
+}
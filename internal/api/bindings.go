@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+// UsernameOrigins binds usernames to the only origins that may embed their
+// shelves, so other sites can't hotlink them. Usernames without a binding
+// may be embedded wherever ALLOWED_ORIGINS and FRAME_ANCESTORS allow.
+//
+// The bindings are read from a JSON file mapping usernames to origin rules,
+// in the syntax of ALLOWED_ORIGINS:
+//
+//	{"alice": ["https://example.com", "https://*.example.com"]}
+//
+// Reload rereads the file while the server runs.
+type UsernameOrigins struct {
+	path     string
+	bindings atomic.Pointer[map[string]*AllowedOrigins]
+	origins  *labelSet
+}
+
+// LoadUsernameOrigins reads the username bindings in path
+func LoadUsernameOrigins(path string) (*UsernameOrigins, error) {
+	u := &UsernameOrigins{path: path, origins: newLabelSet(maxOriginLabels)}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload rereads the bindings file. On error the current bindings are kept.
+func (u *UsernameOrigins) Reload() error {
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return fmt.Errorf("failed to read username origins: %w", err)
+	}
+	bindings, err := parseUsernameOrigins(data)
+	if err != nil {
+		return err
+	}
+	u.bindings.Store(&bindings)
+	return nil
+}
+
+// parseUsernameOrigins parses bindings in the JSON layout of the bindings
+// file
+func parseUsernameOrigins(data []byte) (map[string]*AllowedOrigins, error) {
+	var file map[string][]string
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse username origins: %w", err)
+	}
+
+	bindings := make(map[string]*AllowedOrigins, len(file))
+	for username, rules := range file {
+		if !isValidUsername(username) {
+			return nil, fmt.Errorf("invalid username %q in username origins", username)
+		}
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("username origins for %s: no origins", username)
+		}
+		origins, err := ParseAllowedOrigins(strings.Join(rules, ","))
+		if err != nil {
+			return nil, fmt.Errorf("username origins for %s: %w", username, err)
+		}
+		if _, skipped := origins.FrameAncestors(); len(skipped) > 0 {
+			log.Printf("Username origins for %s: regular expressions can't restrict framing of embed pages: %s", username, strings.Join(skipped, ", "))
+		}
+		bindings[strings.ToLower(username)] = origins
+	}
+	return bindings, nil
+}
+
+// lookup returns the origins bound to username, or nil if it is unbound. A
+// nil UsernameOrigins binds no one.
+func (u *UsernameOrigins) lookup(username string) *AllowedOrigins {
+	if u == nil {
+		return nil
+	}
+	bindings := u.bindings.Load()
+	if bindings == nil {
+		return nil
+	}
+	return (*bindings)[strings.ToLower(username)]
+}
+
+// Len returns the number of bound usernames
+func (u *UsernameOrigins) Len() int {
+	if u == nil || u.bindings.Load() == nil {
+		return 0
+	}
+	return len(*u.bindings.Load())
+}
+
+// Bound reports whether username has a binding
+func (u *UsernameOrigins) Bound(username string) bool {
+	return u.lookup(username) != nil
+}
+
+// Allows reports whether the page that made r may embed username. Requests
+// without an Origin or Referer, such as image proxies fetching SVG cards,
+// and requests from this server's own embed pages are allowed; framing of
+// those pages is restricted by their frame-ancestors instead. Requests from
+// opaque origins are refused, rather than treated as having none.
+func (u *UsernameOrigins) Allows(r *http.Request, username string) bool {
+	origins := u.lookup(username)
+	if origins == nil {
+		return true
+	}
+	if hasOpaqueOrigin(r) {
+		return false
+	}
+	origin := requestOrigin(r)
+	switch {
+	case origin == "none":
+		return true
+	case origin == "invalid":
+		return false
+	case strings.HasSuffix(origin, "://"+strings.ToLower(r.Host)):
+		return true
+	}
+	return origins.Allows(origin)
+}
+
+// FrameAncestors returns the frame-ancestors sources of username's embed
+// pages, and false if username is unbound. A binding made only of regular
+// expressions allows no framing, since CSP can't express them.
+func (u *UsernameOrigins) FrameAncestors(username string) ([]string, bool) {
+	origins := u.lookup(username)
+	if origins == nil {
+		return nil, false
+	}
+	sources, _ := origins.FrameAncestors()
+	if len(sources) == 0 {
+		return []string{"'none'"}, true
+	}
+	return sources, true
+}
+
+// deny answers a request for username's shelf from an origin the username
+// isn't bound to
+func (u *UsernameOrigins) deny(w http.ResponseWriter, r *http.Request, shelf, username string) {
+	origin := requestOrigin(r)
+	if hasOpaqueOrigin(r) {
+		origin = "null"
+	}
+	metrics.OriginDenialsTotal.WithLabelValues(shelf, metrics.Usernames.Label(username), u.origins.label(origin)).Inc()
+	log.Printf("Denied %s of %s to %s: origin not bound to the username", shelf, username, origin)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"error":   "origin_not_allowed",
+		"message": fmt.Sprintf("%s may not embed %s's shelves", origin, username),
+	}); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
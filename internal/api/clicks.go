@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/links"
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+// maxClickEntries caps the in-process click aggregate
+const maxClickEntries = 10000
+
+// clickKey identifies one row of the click aggregate
+type clickKey struct {
+	Shelf    string `json:"shelf"`
+	Username string `json:"username"`
+	BookID   int    `json:"book_id"`
+	Origin   string `json:"origin"`
+}
+
+// clickCount is a row of the click aggregate
+type clickCount struct {
+	clickKey
+	Clicks int64 `json:"clicks"`
+}
+
+// clickTracker keeps click counts since the process started
+type clickTracker struct {
+	mu      sync.Mutex
+	counts  map[clickKey]int64
+	origins *labelSet
+}
+
+func newClickTracker() *clickTracker {
+	return &clickTracker{
+		counts:  make(map[clickKey]int64),
+		origins: newLabelSet(maxOriginLabels),
+	}
+}
+
+// record counts a click and returns the origin label it was counted under
+func (c *clickTracker) record(shelf, username string, bookID int, referer string) string {
+	origin := c.origins.label(refererOrigin(referer))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := clickKey{Shelf: shelf, Username: strings.ToLower(username), BookID: bookID, Origin: origin}
+	if _, ok := c.counts[key]; ok || len(c.counts) < maxClickEntries {
+		c.counts[key]++
+	}
+	return origin
+}
+
+// snapshot returns the aggregate, most clicked first
+func (c *clickTracker) snapshot() []clickCount {
+	c.mu.Lock()
+	counts := make([]clickCount, 0, len(c.counts))
+	for key, clicks := range c.counts {
+		counts = append(counts, clickCount{clickKey: key, Clicks: clicks})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Clicks != counts[j].Clicks {
+			return counts[i].Clicks > counts[j].Clicks
+		}
+		a, b := counts[i].clickKey, counts[j].clickKey
+		if a.Username != b.Username {
+			return a.Username < b.Username
+		}
+		if a.Shelf != b.Shelf {
+			return a.Shelf < b.Shelf
+		}
+		if a.BookID != b.BookID {
+			return a.BookID < b.BookID
+		}
+		return a.Origin < b.Origin
+	})
+	return counts
+}
+
+// HandleClick records a click on a book in an embed and redirects to the
+// book. Only links of books on the user's shelf are redirected to, so this
+// is not an open redirect. The link parameter picks one of the book's links.
+func (s *Server) HandleClick(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.PathValue("shelf")
+	if _, ok := shelves[endpoint]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	username := r.PathValue("username")
+	if username == "" || !isValidUsername(username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+
+	bookID, err := strconv.Atoi(r.PathValue("bookID"))
+	if err != nil || bookID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Clicks from a bound username's embeds carry its site as the Referer
+	if !s.usernameOrigins.Allows(r, username) {
+		s.usernameOrigins.deny(w, r, endpoint, username)
+		return
+	}
+
+	books, err := s.userBooks(endpoint, username)
+	if err != nil {
+		log.Printf("Error fetching %s for user %s: %v", shelves[endpoint].description, username, err)
+		http.Error(w, shelves[endpoint].errorMessage, http.StatusInternalServerError)
+		return
+	}
+
+	var book *hardcover.UserBook
+	for i := range books.Books {
+		if books.Books[i].Book.ID == bookID {
+			book = &books.Books[i]
+			break
+		}
+	}
+	if book == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("link")
+	if name == "" {
+		name = links.HardcoverLink
+	}
+	target, ok := s.bookLinks(*book, username)[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	origin := s.clicks.record(endpoint, username, bookID, r.Referer())
+	metrics.ClicksTotal.WithLabelValues(endpoint, origin).Inc()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// HandleClickStats serves the click aggregate as JSON. It is meant for the
+// metrics port, away from the public API.
+func (s *Server) HandleClickStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.clicks.snapshot()); err != nil {
+		log.Printf("Error encoding click stats: %v", err)
+	}
+}
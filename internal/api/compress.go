@@ -0,0 +1,255 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+const (
+	// minCompressSize is the smallest response worth compressing
+	minCompressSize = 1024
+	// brotliLevel balances speed and size for responses compressed per request
+	brotliLevel = 5
+)
+
+// encodings are the supported content codings, most preferred first
+var encodings = []string{"br", "gzip"}
+
+// encoder is a compressor that can be reused through Reset
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// encoderPools keeps encoders for reuse, since they allocate large buffers
+var encoderPools = map[string]*sync.Pool{
+	"br":   {New: func() any { return brotli.NewWriterLevel(io.Discard, brotliLevel) }},
+	"gzip": {New: func() any { return gzip.NewWriter(io.Discard) }},
+}
+
+// negotiateEncoding picks the content coding for an Accept-Encoding header,
+// or "" to send the response uncompressed. Brotli wins over gzip when both
+// are equally acceptable.
+func negotiateEncoding(header string) string {
+	weights := make(map[string]float64)
+	wildcard := 0.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if name, value, ok := strings.Cut(params, "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else if coding != "" {
+			weights[coding] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range encodings {
+		q, ok := weights[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether responses of contentType shrink when
+// compressed. Images other than SVG are compressed already.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressBytes compresses data with encoding at the best compression
+// level, for content compressed once and served many times
+func compressBytes(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var enc io.WriteCloser
+	switch encoding {
+	case "br":
+		enc = brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	case "gzip":
+		gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		enc = gz
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	if _, err := enc.Write(data); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compressWriter compresses a response once it is known to be worth it: a
+// 200 with a compressible content type and at least minCompressSize bytes.
+// Until then the response is buffered.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	started  bool
+	enc      encoder
+	out      *countingWriter
+	in       int64
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	if code != http.StatusOK {
+		if err := cw.start(false); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.started {
+		return cw.write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= minCompressSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start sends the headers, compressed if compress allows it, followed by
+// anything buffered so far
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+
+	h := cw.Header()
+	if compress && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		// The compressed bytes differ, so the ETag only holds semantically
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.out = &countingWriter{w: cw.ResponseWriter}
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.out)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.write(buf)
+	return err
+}
+
+func (cw *compressWriter) write(p []byte) (int, error) {
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.in += int64(len(p))
+	return cw.enc.Write(p)
+}
+
+// Close sends a response too small to compress, or flushes the compressed
+// one
+func (cw *compressWriter) Close() error {
+	if !cw.started {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if err := cw.start(false); err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+
+	err := cw.enc.Close()
+	encoderPools[cw.encoding].Put(cw.enc)
+	cw.enc = nil
+	metrics.CompressionInputBytesTotal.WithLabelValues("api", cw.encoding).Add(float64(cw.in))
+	metrics.CompressionOutputBytesTotal.WithLabelValues("api", cw.encoding).Add(float64(cw.out.n))
+	return err
+}
+
+// CompressMiddleware compresses responses with brotli or gzip, as negotiated
+// by the Accept-Encoding header
+func CompressMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		next(cw, r)
+		if err := cw.Close(); err != nil {
+			log.Printf("Error writing compressed response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package api
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/images"
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+	"github.com/gouthamve/hardcover-book-embed/internal/placeholder"
+)
+
+// coverWidths are the widths the cover proxy resizes to. Requested widths
+// are rounded up to the next one, so only a few variants of each cover are
+// ever cached.
+var coverWidths = []int{64, 120, 180, 240, 360, 480, 720}
+
+const (
+	defaultCoverWidth = 240
+	// coverMaxAge is how long browsers may reuse a proxied cover
+	coverMaxAge = 24 * 60 * 60
+)
+
+var coverContentTypes = map[string]string{
+	images.FormatJPEG: "image/jpeg",
+	images.FormatPNG:  "image/png",
+}
+
+// maxCoverIndexBooks caps the books the cover index remembers. Usernames,
+// and so the shelves recorded, are chosen by visitors.
+const maxCoverIndexBooks = 50000
+
+// coverEntry is what the cover index knows about one book
+type coverEntry struct {
+	// url is the cover URL, or "" for a book that needs a placeholder
+	url         string
+	placeholder placeholder.Cover
+	recorded    time.Time
+}
+
+// coverIndex maps book IDs to the cover URLs Hardcover returned for them, so
+// the proxy only fetches covers of books we have served. Books without a
+// cover are kept for drawing their placeholders. Beyond maxBooks, the books
+// recorded longest ago are forgotten.
+type coverIndex struct {
+	mu       sync.RWMutex
+	books    map[int]coverEntry
+	maxBooks int
+}
+
+func newCoverIndex() *coverIndex {
+	return &coverIndex{
+		books:    make(map[int]coverEntry),
+		maxBooks: maxCoverIndexBooks,
+	}
+}
+
+// record remembers the cover URLs of books from Hardcover's asset hosts and
+// the details of books that need a placeholder
+func (c *coverIndex) record(books *hardcover.UserBooksResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, book := range books.Books {
+		switch {
+		case book.Book.Image == nil:
+		case book.Book.Image.IsPlaceholder:
+			c.books[book.Book.ID] = coverEntry{placeholder: placeholderCover(book), recorded: now}
+		case images.IsAllowedURL(book.Book.Image.URL):
+			c.books[book.Book.ID] = coverEntry{url: book.Book.Image.URL, recorded: now}
+		}
+	}
+	if len(c.books) > c.maxBooks {
+		c.pruneLocked()
+	}
+}
+
+// pruneLocked forgets the books recorded longest ago, down to 90% of
+// maxBooks so that pruning doesn't run on every record. Callers must hold
+// c.mu.
+func (c *coverIndex) pruneLocked() {
+	ids := make([]int, 0, len(c.books))
+	for id := range c.books {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return c.books[ids[i]].recorded.Before(c.books[ids[j]].recorded)
+	})
+	for _, id := range ids[:len(ids)-c.maxBooks*9/10] {
+		delete(c.books, id)
+	}
+}
+
+func (c *coverIndex) placeholder(bookID int) (placeholder.Cover, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.books[bookID]
+	if !ok || entry.url != "" {
+		return placeholder.Cover{}, false
+	}
+	return entry.placeholder, true
+}
+
+// placeholderCover describes the placeholder drawn for a book without a cover
+func placeholderCover(book hardcover.UserBook) placeholder.Cover {
+	return placeholder.Cover{
+		BookID: book.Book.ID,
+		Title:  book.Book.Title,
+		Author: bookAuthors(book.Book),
+	}
+}
+
+func (c *coverIndex) get(bookID int) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.books[bookID]
+	if !ok || entry.url == "" {
+		return "", false
+	}
+	return entry.url, true
+}
+
+// coverWidth parses the w parameter, rounding up to one of coverWidths
+func coverWidth(value string) (int, bool) {
+	if value == "" {
+		return defaultCoverWidth, true
+	}
+
+	width, err := strconv.Atoi(value)
+	if err != nil || width <= 0 {
+		return 0, false
+	}
+	for _, w := range coverWidths {
+		if width <= w {
+			return w, true
+		}
+	}
+	return coverWidths[len(coverWidths)-1], true
+}
+
+// HandleCoverImage serves a book's cover resized on our side, so visitors
+// never request images from Hardcover directly
+func (s *Server) HandleCoverImage(w http.ResponseWriter, r *http.Request) {
+	bookID, err := strconv.Atoi(r.PathValue("bookID"))
+	if err != nil || bookID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	width, ok := coverWidth(r.URL.Query().Get("w"))
+	if !ok {
+		http.Error(w, "Invalid width", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = images.FormatJPEG
+	}
+	contentType, ok := coverContentTypes[format]
+	if !ok {
+		http.Error(w, "Invalid format", http.StatusBadRequest)
+		return
+	}
+
+	cacheKey := fmt.Sprintf("cover_%d_%d.%s", bookID, width, format)
+	data, found := s.cachedCover(cacheKey)
+	if found {
+		metrics.ImageProxyRequestsTotal.WithLabelValues("hit").Inc()
+	} else {
+		imageURL, ok := s.covers.get(bookID)
+		if !ok {
+			metrics.ImageProxyRequestsTotal.WithLabelValues("unknown").Inc()
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err = s.renderCover(r, imageURL, width, format)
+		if err != nil {
+			metrics.ImageProxyRequestsTotal.WithLabelValues("error").Inc()
+			log.Printf("Error proxying cover for book %d: %v", bookID, err)
+			if errors.Is(err, images.ErrHostNotAllowed) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, "Failed to fetch cover", http.StatusBadGateway)
+			return
+		}
+
+		metrics.ImageProxyRequestsTotal.WithLabelValues("miss").Inc()
+		s.storeCover(cacheKey, data)
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", coverMaxAge))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Covers are embedded on other sites, including ones that require CORP
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing cover image: %v", err)
+	}
+}
+
+func (s *Server) renderCover(r *http.Request, imageURL string, width int, format string) ([]byte, error) {
+	src, err := s.images.Decode(r.Context(), imageURL)
+	if err != nil {
+		return nil, err
+	}
+	s.analyzer.Observe(imageURL, src)
+	data, _, err := images.Encode(images.Resize(src, width), format)
+	return data, err
+}
+
+// cachedCover looks up a resized cover on disk, or in memory when no disk
+// cache is configured
+func (s *Server) cachedCover(key string) ([]byte, bool) {
+	if s.disk != nil {
+		return s.disk.Get(key)
+	}
+	if item, found := s.blobs.Get(key); found {
+		return item.Data, true
+	}
+	return nil, false
+}
+
+func (s *Server) storeCover(key string, data []byte) {
+	if s.disk == nil {
+		s.blobs.Set(key, data, "")
+		return
+	}
+	if err := s.disk.Set(key, data); err != nil {
+		log.Printf("Error caching cover on disk: %v", err)
+	}
+}
+
+// annotateImages returns a copy of books with the BlurHash and dominant color
+// of every cover analyzed so far, and when the latest of those analyses was
+// made. Placeholders get their background color. Covers without an analysis
+// are queued, and annotated on later requests.
+func (s *Server) annotateImages(books *hardcover.UserBooksResponse) (*hardcover.UserBooksResponse, time.Time) {
+	var analyzedAt time.Time
+	annotated := *books
+	annotated.Books = make([]hardcover.UserBook, len(books.Books))
+	for i, book := range books.Books {
+		if image := book.Book.Image; image != nil {
+			annotatedImage := *image
+			if image.IsPlaceholder {
+				annotatedImage.DominantColor = images.HexColor(placeholder.Color(book.Book.ID))
+			} else if analysis, ok := s.analyzer.Lookup(image.URL); ok {
+				annotatedImage.BlurHash = analysis.BlurHash
+				annotatedImage.DominantColor = analysis.DominantColor
+				if analysis.AnalyzedAt.After(analyzedAt) {
+					analyzedAt = analysis.AnalyzedAt
+				}
+			}
+			book.Book.Image = &annotatedImage
+		}
+		annotated.Books[i] = book
+	}
+	return &annotated, analyzedAt
+}
+
+// HandlePlaceholderCover serves the generated cover for a book without one,
+// as SVG or, with a .png extension, as a PNG of width w
+func (s *Server) HandlePlaceholderCover(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	format := images.FormatPNG
+	id, ok := strings.CutSuffix(file, ".png")
+	if !ok {
+		format = "svg"
+		id, ok = strings.CutSuffix(file, ".svg")
+	}
+	bookID, err := strconv.Atoi(id)
+	if !ok || err != nil || bookID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	width, ok := coverWidth(r.URL.Query().Get("w"))
+	if !ok {
+		http.Error(w, "Invalid width", http.StatusBadRequest)
+		return
+	}
+
+	// Until the book has been served we only know its ID, so the color is
+	// right but the title is missing; keep that version briefly
+	cover, known := s.covers.placeholder(bookID)
+	if !known {
+		cover = placeholder.Cover{BookID: bookID}
+	}
+	maxAge := coverMaxAge
+	if !known {
+		maxAge = 60
+	}
+
+	var data []byte
+	contentType := "image/svg+xml"
+	if format == "svg" {
+		data = placeholder.SVG(cover)
+	} else {
+		contentType = "image/png"
+		// Only books we have served are cached, so made-up IDs can't fill
+		// the blob cache
+		cacheKey := fmt.Sprintf("placeholder_%d_%d_%s_%s", bookID, width, cover.Title, cover.Author)
+		if cached, found := s.blobs.Get(cacheKey); found {
+			data = cached.Data
+		} else {
+			img, err := placeholder.Image(cover, width)
+			if err == nil {
+				data, _, err = images.Encode(img, images.FormatPNG)
+			}
+			if err != nil {
+				log.Printf("Error drawing placeholder cover for book %d: %v", bookID, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if known {
+				s.blobs.Set(cacheKey, data, contentType)
+			}
+		}
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+	if format == "svg" {
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing placeholder cover: %v", err)
+	}
+}
+
+// rewriteImageURLs returns a copy of books with absolute cover URLs under
+// baseURL: placeholder paths are made absolute, and with proxy set Hardcover
+// covers point at our cover proxy
+func rewriteImageURLs(books *hardcover.UserBooksResponse, baseURL string, proxy bool) *hardcover.UserBooksResponse {
+	rewritten := *books
+	rewritten.Books = make([]hardcover.UserBook, len(books.Books))
+	for i, book := range books.Books {
+		switch image := book.Book.Image; {
+		case image == nil:
+		case strings.HasPrefix(image.URL, "/"):
+			rewrittenImage := *image
+			rewrittenImage.URL = baseURL + image.URL
+			book.Book.Image = &rewrittenImage
+		case proxy && images.IsAllowedURL(image.URL):
+			rewrittenImage := *image
+			rewrittenImage.URL = fmt.Sprintf("%s/img/%d", baseURL, book.Book.ID)
+			book.Book.Image = &rewrittenImage
+		}
+		rewritten.Books[i] = book
+	}
+	return &rewritten
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+const (
+	// CSPReportPath is where browsers send Content-Security-Policy violation
+	// reports
+	CSPReportPath = "/csp-report"
+	// maxCSPReportSize caps the body of a violation report
+	maxCSPReportSize = 64 << 10
+)
+
+// cspDirectives are the directives violations are labelled with; others
+// are counted as "other"
+var cspDirectives = map[string]bool{
+	"default-src":     true,
+	"img-src":         true,
+	"style-src":       true,
+	"style-src-elem":  true,
+	"style-src-attr":  true,
+	"script-src":      true,
+	"script-src-elem": true,
+	"script-src-attr": true,
+	"connect-src":     true,
+	"base-uri":        true,
+	"form-action":     true,
+	"frame-ancestors": true,
+}
+
+// ParseFrameAncestors parses a comma or space separated list of the sites
+// allowed to frame embed pages into frame-ancestors sources. Entries are
+// origins such as https://example.com, host wildcards such as
+// https://*.example.com, schemes such as https:, '*', 'self' or 'none'.
+func ParseFrameAncestors(list string) ([]string, error) {
+	var sources []string
+	for _, entry := range strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		source, err := frameAncestorSource(entry)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// frameAncestorSource validates a single frame-ancestors source
+func frameAncestorSource(entry string) (string, error) {
+	switch strings.ToLower(entry) {
+	case "*":
+		return "*", nil
+	case "'self'", "self":
+		return "'self'", nil
+	case "'none'", "none":
+		return "'none'", nil
+	}
+
+	if strings.ContainsAny(entry, "';\"") {
+		return "", fmt.Errorf("invalid frame ancestor %q", entry)
+	}
+	// A bare scheme such as https: allows any site using it
+	if scheme, rest, ok := strings.Cut(entry, ":"); ok && rest == "" {
+		if scheme == "" {
+			return "", fmt.Errorf("invalid frame ancestor %q", entry)
+		}
+		return strings.ToLower(entry), nil
+	}
+
+	// url.Parse rejects the wildcard, so check the rest with a stand-in label
+	u, err := url.Parse(strings.Replace(entry, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid frame ancestor %q: must be an origin such as https://example.com", entry)
+	}
+	return strings.ToLower(strings.TrimSuffix(entry, "/")), nil
+}
+
+// frameAncestors returns the frame-ancestors sources of a user's embed
+// pages: the origins bound to them, or else the default list. With neither,
+// any site may frame them.
+func (h *StaticHandler) frameAncestors(username string) []string {
+	if sources, ok := h.usernameOrigins.FrameAncestors(username); ok {
+		return sources
+	}
+	if len(h.frameAncestorsDefault) > 0 {
+		return h.frameAncestorsDefault
+	}
+	return []string{"*"}
+}
+
+// intersectFrameAncestors returns the frame-ancestors sources allowing only
+// the sites both a and b allow, or 'none' if there are none
+func intersectFrameAncestors(a, b []string) []string {
+	var sources []string
+	seen := make(map[string]bool)
+	add := func(source string) {
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	for _, x := range a {
+		for _, y := range b {
+			switch {
+			case frameSourceCovers(x, y):
+				add(y)
+			case frameSourceCovers(y, x):
+				add(x)
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return []string{"'none'"}
+	}
+	return sources
+}
+
+// frameSource is a host source of frame-ancestors
+type frameSource struct {
+	scheme string
+	// host may start with *. for any subdomain
+	host string
+	// port is "" for the scheme's default, or "*" for any
+	port string
+}
+
+func parseFrameSource(source string) (frameSource, bool) {
+	scheme, rest, ok := strings.Cut(source, "://")
+	if !ok || rest == "" {
+		return frameSource{}, false
+	}
+	src := frameSource{scheme: scheme, host: rest}
+	if i := strings.LastIndex(rest, ":"); i != -1 && !strings.HasSuffix(rest, "]") {
+		src.host, src.port = rest[:i], rest[i+1:]
+	}
+	if src.port != "*" {
+		src.port = normalizePort(scheme, src.port)
+	}
+	return src, true
+}
+
+// frameSourceCovers reports whether every site the frame-ancestors source b
+// allows is also allowed by a
+func frameSourceCovers(a, b string) bool {
+	switch {
+	case a == "*":
+		return b != "'none'"
+	case a == "'none'" || b == "'none'" || b == "*":
+		return false
+	case a == "'self'" || b == "'self'":
+		return a == b
+	case strings.HasSuffix(a, ":"):
+		// A bare scheme allows any site using it
+		return strings.HasPrefix(b, a)
+	}
+
+	x, ok := parseFrameSource(a)
+	if !ok {
+		return false
+	}
+	y, ok := parseFrameSource(b)
+	if !ok || x.scheme != y.scheme || (x.port != "*" && x.port != y.port) {
+		return false
+	}
+	if domain, ok := strings.CutPrefix(x.host, "*"); ok {
+		return strings.HasSuffix(y.host, domain)
+	}
+	return x.host == y.host
+}
+
+// cspViolation is the part of a violation report that is logged and counted
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	BlockedURI         string `json:"blocked-uri"`
+	EffectiveDirective string `json:"effective-directive"`
+	ViolatedDirective  string `json:"violated-directive"`
+}
+
+// parseCSPReports reads the violations from a report body, either a single
+// report-uri report or a Reporting API batch
+func parseCSPReports(contentType string, body []byte) ([]cspViolation, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var batch []struct {
+			Type string `json:"type"`
+			Body struct {
+				DocumentURL        string `json:"documentURL"`
+				BlockedURL         string `json:"blockedURL"`
+				EffectiveDirective string `json:"effectiveDirective"`
+			} `json:"body"`
+		}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, err
+		}
+		var violations []cspViolation
+		for _, report := range batch {
+			if report.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURI:        report.Body.DocumentURL,
+				BlockedURI:         report.Body.BlockedURL,
+				EffectiveDirective: report.Body.EffectiveDirective,
+			})
+		}
+		return violations, nil
+	}
+
+	var report struct {
+		CSPReport cspViolation `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	return []cspViolation{report.CSPReport}, nil
+}
+
+// CSPReports logs and counts the Content-Security-Policy violations
+// browsers report, such as sites framing embed pages they may not
+type CSPReports struct {
+	origins *labelSet
+}
+
+// NewCSPReports creates a violation report handler
+func NewCSPReports() *CSPReports {
+	return &CSPReports{origins: newLabelSet(maxOriginLabels)}
+}
+
+// Handle accepts a violation report. Reports come from any browser, so
+// they are size limited and only bounded labels reach the metrics.
+func (c *CSPReports) Handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSPReportSize))
+	if err != nil {
+		http.Error(w, "Report too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	violations, err := parseCSPReports(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+
+	for _, v := range violations {
+		directive := v.EffectiveDirective
+		if directive == "" {
+			// Older browsers only send the violated directive with its value
+			directive, _, _ = strings.Cut(v.ViolatedDirective, " ")
+		}
+		if !cspDirectives[directive] {
+			directive = "other"
+		}
+		// For frame-ancestors the blocked URL is the framing page
+		origin := c.origins.label(refererOrigin(v.BlockedURI))
+		metrics.CSPViolationsTotal.WithLabelValues(directive, origin).Inc()
+		log.Printf("CSP violation: %s blocked %q on %q", directive, v.BlockedURI, v.DocumentURI)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
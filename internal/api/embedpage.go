@@ -0,0 +1,242 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+// embedPageScripts maps the embed pages to the widget script each loads
+var embedPageScripts = map[string]string{
+	"embed.html":         "widget.js",
+	"reviews-embed.html": "review-widget.js",
+}
+
+func isEmbedPage(urlPath string) bool {
+	_, ok := embedPageScripts[urlPath]
+	return ok
+}
+
+// embedPartials are the templates shared by the embed pages: Open Graph
+// tags for link previews, and Grafana Faro monitoring from unpkg when a
+// collector is configured
+const embedPartials = `{{define "og"}}{{with .OG}}
+    <meta property="og:type" content="website">
+    <meta property="og:title" content="{{.Title}}">
+    <meta property="og:image" content="{{.ImageURL}}">
+    <meta property="og:image:width" content="{{.Width}}">
+    <meta property="og:image:height" content="{{.Height}}">
+    <meta name="twitter:card" content="summary_large_image">
+    <meta name="twitter:image" content="{{.ImageURL}}">{{end}}{{end}}
+{{define "faro"}}{{if .FaroCollector}}
+    <script nonce="{{.Nonce}}">
+    (function () {
+      var webSdkScript = document.createElement("script");
+      webSdkScript.src = "https://unpkg.com/@grafana/faro-web-sdk@latest/dist/bundle/faro-web-sdk.iife.js";
+      webSdkScript.onload = function () {
+        window.GrafanaFaroWebSdk.initializeFaro({
+          url: {{.FaroCollector}},
+          app: {
+            name: "hardcover-embed-frontend",
+            version: "1.0.0",
+            environment: "production",
+          },
+        });
+
+        // Tracing can only be added once the SDK is initialized
+        var webTracingScript = document.createElement("script");
+        webTracingScript.src = "https://unpkg.com/@grafana/faro-web-tracing@latest/dist/bundle/faro-web-tracing.iife.js";
+        webTracingScript.onload = function () {
+          window.GrafanaFaroWebSdk.faro.instrumentations.add(
+            new window.GrafanaFaroWebTracing.TracingInstrumentation()
+          );
+        };
+        document.head.appendChild(webTracingScript);
+      };
+      document.head.appendChild(webSdkScript);
+    })();
+    </script>{{end}}{{end}}`
+
+// parseEmbedPage parses the template of an embed page
+func parseEmbedPage(name string, content []byte) (*template.Template, error) {
+	page, err := template.New(name).Parse(embedPartials)
+	if err != nil {
+		return nil, err
+	}
+	if page, err = page.Parse(string(content)); err != nil {
+		return nil, fmt.Errorf("failed to parse embed page %s: %w", name, err)
+	}
+	return page, nil
+}
+
+// embedPage is the data embed page templates are rendered with
+type embedPage struct {
+	// Nonce allows the page's own scripts and styles under its CSP
+	Nonce string
+	// APIURL is the scheme-relative URL of this server, for the widget
+	APIURL   string
+	Username string
+	// Shelf is the shelf the page shows, which is its widget's book type
+	Shelf    string
+	ShowDate string
+	Spoilers string
+	// Token is the embed token the widget passes on to the API
+	Token string
+	// Script is the versioned widget script the page loads
+	Script        ManifestEntry
+	OG            *ogMeta
+	FaroCollector string
+}
+
+// embedPageParams validates the query parameters of an embed page
+func embedPageParams(urlPath string, query url.Values) (embedPage, error) {
+	page := embedPage{Username: query.Get("username"), Token: query.Get("token")}
+	if !isValidUsername(page.Username) {
+		return page, fmt.Errorf("invalid username")
+	}
+
+	switch urlPath {
+	case "embed.html":
+		switch bookType := query.Get("type"); bookType {
+		case "":
+			page.Shelf = "currently-reading"
+		case "currently-reading", "last-read":
+			page.Shelf = bookType
+		default:
+			return page, fmt.Errorf("invalid type %q: must be currently-reading or last-read", bookType)
+		}
+	case "reviews-embed.html":
+		page.Shelf = "reviews"
+		switch page.ShowDate = query.Get("showDate"); page.ShowDate {
+		case "", "true", "false":
+		default:
+			return page, fmt.Errorf("invalid showDate %q: must be true or false", page.ShowDate)
+		}
+		switch page.Spoilers = query.Get("spoilers"); page.Spoilers {
+		case "", spoilersShow, spoilersBlur, spoilersHide, spoilersOmit:
+		default:
+			return page, fmt.Errorf("invalid spoilers %q: must be show, blur, hide or omit", page.Spoilers)
+		}
+	}
+	return page, nil
+}
+
+// newNonce returns a random CSP nonce
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// URL-safe characters need no escaping in the page
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pageScript returns the versioned URL, relative to the embed pages, and
+// the integrity of a widget script
+func (h *StaticHandler) pageScript(name string) ManifestEntry {
+	fileInfo, ok := h.files[name]
+	if !ok {
+		return ManifestEntry{URL: name}
+	}
+	return ManifestEntry{
+		URL:       fingerprintedPath(name, fileInfo.Fingerprint),
+		Integrity: fileInfo.Integrity,
+	}
+}
+
+// embedPageCSP returns the Content-Security-Policy for an embed page
+// rendered with nonce. Only the page's own scripts and styles may run, plus
+// Faro's scripts and collector when it is configured, and only the
+// frameAncestors sources may frame it. Violations are reported to
+// CSPReportPath.
+func (h *StaticHandler) embedPageCSP(nonce, frameAncestors string) string {
+	scriptSrc := "'nonce-" + nonce + "'"
+	connectSrc := "'self' https://hardcover.app https://*.hardcover.app"
+	if h.faroCollector != "" {
+		scriptSrc += " https://unpkg.com"
+		if u, err := url.Parse(h.faroCollector); err == nil && u.Host != "" {
+			connectSrc += " " + u.Scheme + "://" + u.Host
+		}
+	}
+	return fmt.Sprintf("default-src 'none'; img-src 'self' https://hardcover.app https://*.hardcover.app data:; style-src 'nonce-%s'; script-src %s; connect-src %s; base-uri 'none'; form-action 'none'; frame-ancestors %s; report-uri %s;", nonce, scriptSrc, connectSrc, frameAncestors, CSPReportPath)
+}
+
+// serveEmbedPage renders an embed page for the user and options in its
+// query, with Open Graph tags so link previews show the shelf's preview
+// image, and counts the load as an impression
+func (h *StaticHandler) serveEmbedPage(w http.ResponseWriter, r *http.Request, urlPath string, start time.Time) {
+	page, err := embedPageParams(urlPath, r.URL.Query())
+	if err != nil {
+		metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "400").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// With tokens required, the page may only be framed by the sites both
+	// the token's origin and the username's binding or FRAME_ANCESTORS
+	// allow. The framing page's origin isn't known here, so it is left to
+	// the browser.
+	frameAncestors := h.frameAncestors(page.Username)
+	if h.tokens != nil {
+		tok, err := h.tokens.check(page.Token, page.Shelf, page.Username)
+		if err != nil {
+			metrics.EmbedTokenChecksTotal.WithLabelValues(page.Shelf, err.Error()).Inc()
+			metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "401").Inc()
+			writeTokenError(w, err)
+			return
+		}
+		metrics.EmbedTokenChecksTotal.WithLabelValues(page.Shelf, "valid").Inc()
+		frameAncestors = intersectFrameAncestors(frameAncestors, tok.frameAncestors())
+	}
+
+	if page.Nonce, err = newNonce(); err != nil {
+		log.Printf("Error generating nonce: %v", err)
+		metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "500").Inc()
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Scheme-relative, so the widget calls back over the page's own scheme
+	page.APIURL = "//" + r.Host
+	page.Script = h.pageScript(embedPageScripts[urlPath])
+	token := ""
+	if h.tokens != nil {
+		token = page.Token
+	}
+	page.OG = embedOGMeta(requestBaseURL(r), page.Shelf, page.Username, token)
+	page.FaroCollector = h.faroCollector
+
+	var buf bytes.Buffer
+	if err := h.pages[urlPath].Execute(&buf, page); err != nil {
+		log.Printf("Error rendering embed page %s: %v", urlPath, err)
+		metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "500").Inc()
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", h.embedPageCSP(page.Nonce, strings.Join(frameAncestors, " ")))
+	// Every response has its own nonce, so none may be reused. This also
+	// counts every load as an impression.
+	w.Header().Set("Cache-Control", "no-store")
+
+	h.impressions.Record(r, page.Shelf, page.Username)
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if r.Method != "HEAD" {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			fmt.Printf("Error writing embed page %s: %v\n", urlPath, err)
+		}
+	}
+
+	metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "200").Inc()
+	metrics.StaticFileRequestDuration.WithLabelValues(urlPath).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+)
+
+// entryURL is the page a shelf entry links to: the review for reviews and
+// the book everywhere else
+func entryURL(v *shelfView, book hardcover.UserBook) string {
+	if v.Endpoint == "reviews" {
+		return hardcoverReviewURL(book.Book, v.Username)
+	}
+	return hardcoverBookURL(book.Book)
+}
+
+// entryDate is the most meaningful timestamp for a shelf entry
+func entryDate(book hardcover.UserBook) time.Time {
+	if book.ReviewedAt != nil && !book.ReviewedAt.IsZero() {
+		return book.ReviewedAt.Time
+	}
+	if book.LastReadDate != nil && !book.LastReadDate.IsZero() {
+		return book.LastReadDate.Time
+	}
+	return book.UpdatedAt
+}
+
+// entrySummary describes a book in one line, e.g. "by Author ★★★★"
+func entrySummary(book hardcover.UserBook) string {
+	var parts []string
+	if authors := bookAuthors(book.Book); authors != "" {
+		parts = append(parts, "by "+authors)
+	}
+	if book.Rating != nil {
+		parts = append(parts, ratingStars(*book.Rating))
+	}
+	return strings.Join(parts, " ")
+}
+
+func feedTitle(v *shelfView) string {
+	return fmt.Sprintf("@%s · %s", v.Username, shelves[v.Endpoint].title)
+}
+
+func feedURL(v *shelfView) string {
+	return requestBaseURL(v.Request) + v.Request.URL.Path
+}
+
+func profileURL(username string) string {
+	return "https://hardcover.app/@" + username
+}
+
+// jsonFeed is a JSON Feed 1.1 document, see https://jsonfeed.org/version/1.1
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID           string    `json:"id"`
+	URL          string    `json:"url"`
+	Title        string    `json:"title"`
+	ContentHTML  string    `json:"content_html,omitempty"`
+	ContentText  string    `json:"content_text"`
+	Summary      string    `json:"summary,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	DateModified time.Time `json:"date_modified"`
+}
+
+func renderJSONFeed(_ *Server, v *shelfView) ([]byte, error) {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feedTitle(v),
+		HomePageURL: profileURL(v.Username),
+		FeedURL:     feedURL(v),
+		Authors:     []jsonFeedAuthor{{Name: "@" + v.Username, URL: profileURL(v.Username)}},
+		Items:       make([]jsonFeedItem, 0, len(v.Books.Books)),
+	}
+
+	for _, book := range v.Books.Books {
+		item := jsonFeedItem{
+			ID:           entryURL(v, book),
+			URL:          entryURL(v, book),
+			Title:        book.Book.Title,
+			Summary:      entrySummary(book),
+			DateModified: entryDate(book),
+		}
+		if book.Book.Image != nil {
+			item.Image = book.Book.Image.URL
+		}
+		if book.Review != nil {
+			item.ContentHTML = book.Review.HTML
+			item.ContentText = book.Review.Text
+		} else {
+			item.ContentText = strings.TrimSpace(book.Book.Title + " " + item.Summary)
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(feed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// atomFeed is an Atom 1.0 (RFC 4287) feed document
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated string    `xml:"updated"`
+	Link    atomLink  `xml:"link"`
+	Summary *atomText `xml:"summary,omitempty"`
+	Content *atomText `xml:"content,omitempty"`
+}
+
+func renderAtom(_ *Server, v *shelfView) ([]byte, error) {
+	feed := atomFeed{
+		ID:      feedURL(v),
+		Title:   feedTitle(v),
+		Updated: v.Books.UpdatedAt.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: feedURL(v), Rel: "self"},
+			{Href: profileURL(v.Username), Rel: "alternate"},
+		},
+		Author: atomPerson{Name: "@" + v.Username, URI: profileURL(v.Username)},
+	}
+
+	for _, book := range v.Books.Books {
+		entry := atomEntry{
+			ID:      entryURL(v, book),
+			Title:   book.Book.Title,
+			Updated: entryDate(book).UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: entryURL(v, book), Rel: "alternate"},
+		}
+		if summary := entrySummary(book); summary != "" {
+			entry.Summary = &atomText{Type: "text", Body: summary}
+		}
+		if book.Review != nil {
+			entry.Content = &atomText{Type: "html", Body: book.Review.HTML}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// csvSafe neutralises cells that spreadsheet applications would otherwise
+// evaluate as formulas
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func formatDate(d *hardcover.Date) string {
+	if d == nil || d.IsZero() {
+		return ""
+	}
+	return d.Format("2006-01-02")
+}
+
+func renderCSV(_ *Server, v *shelfView) ([]byte, error) {
+	reviews := v.Endpoint == "reviews"
+
+	header := []string{"id", "title", "authors", "rating", "url", "updated_at", "last_read_date"}
+	if reviews {
+		header = append(header, "reviewed_at", "has_spoilers", "review")
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	for _, book := range v.Books.Books {
+		rating := ""
+		if book.Rating != nil {
+			rating = strconv.FormatFloat(*book.Rating, 'f', -1, 64)
+		}
+		record := []string{
+			strconv.Itoa(book.Book.ID),
+			csvSafe(book.Book.Title),
+			csvSafe(bookAuthors(book.Book)),
+			rating,
+			entryURL(v, book),
+			book.UpdatedAt.UTC().Format(time.RFC3339),
+			formatDate(book.LastReadDate),
+		}
+		if reviews {
+			record = append(record,
+				formatDate(book.ReviewedAt),
+				strconv.FormatBool(book.ReviewHasSpoilers),
+				csvSafe(reviewText(book)),
+			)
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// reviewText is the plain text of a book's review, if it has one
+func reviewText(book hardcover.UserBook) string {
+	if book.Review == nil {
+		return ""
+	}
+	return book.Review.Text
+}
+
+// htmlEntry is a shelf entry prepared for the HTML fragment templates
+type htmlEntry struct {
+	Title    string
+	URL      string
+	Authors  string
+	Stars    string
+	Rating   float64
+	Spoilers bool
+	// Review is the server-rendered review, already limited to allow-listed tags
+	Review template.HTML
+}
+
+var shelfFragmentTemplate = template.Must(template.New("shelf").Parse(`<ul class="hardcover-books">
+{{- range .}}
+  <li class="hardcover-book"><a href="{{.URL}}" rel="noopener">{{.Title}}</a>
+    {{- if .Authors}} by {{.Authors}}{{end}}
+    {{- if .Stars}} <span class="hardcover-rating" aria-label="{{.Rating}} out of 5">{{.Stars}}</span>{{end -}}
+  </li>
+{{- end}}
+</ul>
+`))
+
+var reviewsFragmentTemplate = template.Must(template.New("reviews").Parse(`<section class="hardcover-reviews">
+{{- range .}}
+  <article class="hardcover-review">
+    <h3><a href="{{.URL}}" rel="noopener">{{.Title}}</a></h3>
+    {{- if .Authors}}
+    <p class="hardcover-authors">by {{.Authors}}</p>
+    {{- end}}
+    {{- if .Stars}}
+    <p class="hardcover-rating" aria-label="{{.Rating}} out of 5">{{.Stars}}</p>
+    {{- end}}
+    {{- if .Spoilers}}
+    <p class="hardcover-spoiler-warning">Contains spoilers</p>
+    {{- end}}
+    {{- if .Review}}
+    <div class="hardcover-review-body">{{.Review}}</div>
+    {{- end}}
+  </article>
+{{- end}}
+</section>
+`))
+
+func renderHTMLFragment(_ *Server, v *shelfView) ([]byte, error) {
+	entries := make([]htmlEntry, 0, len(v.Books.Books))
+	for _, book := range v.Books.Books {
+		entry := htmlEntry{
+			Title:    book.Book.Title,
+			URL:      entryURL(v, book),
+			Authors:  bookAuthors(book.Book),
+			Spoilers: book.ReviewHasSpoilers,
+		}
+		if book.Review != nil {
+			entry.Review = template.HTML(book.Review.HTML)
+		}
+		if book.Rating != nil {
+			entry.Rating = *book.Rating
+			entry.Stars = ratingStars(*book.Rating)
+		}
+		entries = append(entries, entry)
+	}
+
+	tmpl := shelfFragmentTemplate
+	if v.Endpoint == "reviews" {
+		tmpl = reviewsFragmentTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,47 +1,126 @@
 package api
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
-	"strings"
+	"time"
 
 	"github.com/gouthamve/hardcover-book-embed/internal/cache"
 	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/images"
+	"github.com/gouthamve/hardcover-book-embed/internal/links"
 	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+	"github.com/gouthamve/hardcover-book-embed/internal/review"
 )
 
 type Server struct {
 	client         hardcover.Client
 	cache          *cache.MemoryCache
-	allowedOrigins string
+	allowedOrigins *AllowedOrigins
+	images         *images.Fetcher
+	blobs          *cache.BlobCache
+	disk           *cache.DiskCache
+	covers         *coverIndex
+	analyzer       *images.Analyzer
+	links          *links.Config
+	clicks         *clickTracker
+	impressions    *Impressions
+	// usernameOrigins binds usernames to the origins that may embed them
+	usernameOrigins *UsernameOrigins
 }
 
-func NewServer(client hardcover.Client, cache *cache.MemoryCache, allowedOrigins string) *Server {
-	return &Server{
+// ServerOption configures optional Server dependencies
+type ServerOption func(*Server)
+
+// WithBlobCache sets the cache used for generated images
+func WithBlobCache(blobs *cache.BlobCache) ServerOption {
+	return func(s *Server) {
+		s.blobs = blobs
+	}
+}
+
+// WithDiskCache sets the on-disk cache for proxied cover images. Without one,
+// proxied covers are kept in the in-memory blob cache.
+func WithDiskCache(disk *cache.DiskCache) ServerOption {
+	return func(s *Server) {
+		s.disk = disk
+	}
+}
+
+// WithImageAnalyzer sets the analyzer computing cover BlurHashes and colors.
+// Without one, covers are served without them.
+func WithImageAnalyzer(analyzer *images.Analyzer) ServerOption {
+	return func(s *Server) {
+		s.analyzer = analyzer
+	}
+}
+
+// WithLinkTemplates sets the templates for the outbound links of each book.
+// Without them, books only link to Hardcover.
+func WithLinkTemplates(templates *links.Config) ServerOption {
+	return func(s *Server) {
+		s.links = templates
+	}
+}
+
+// WithImpressions sets the tracker counting embed loads. Without one, loads
+// are not counted.
+func WithImpressions(impressions *Impressions) ServerOption {
+	return func(s *Server) {
+		s.impressions = impressions
+	}
+}
+
+// WithUsernameOrigins restricts the origins that may embed the shelves of
+// bound usernames. Without it, any allowed origin may embed any username.
+func WithUsernameOrigins(bindings *UsernameOrigins) ServerOption {
+	return func(s *Server) {
+		s.usernameOrigins = bindings
+	}
+}
+
+// WithImageFetcher sets the fetcher used to load cover images server-side
+func WithImageFetcher(fetcher *images.Fetcher) ServerOption {
+	return func(s *Server) {
+		s.images = fetcher
+	}
+}
+
+func NewServer(client hardcover.Client, cache *cache.MemoryCache, allowedOrigins *AllowedOrigins, opts ...ServerOption) *Server {
+	s := &Server{
 		client:         client,
 		cache:          cache,
 		allowedOrigins: allowedOrigins,
+		covers:         newCoverIndex(),
+		clicks:         newClickTracker(),
 	}
-}
 
-func (s *Server) enableCORS(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
+	for _, opt := range opts {
+		opt(s)
+	}
 
-	if s.allowedOrigins == "*" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-	} else if origin != "" {
-		allowedOrigins := strings.Split(s.allowedOrigins, ",")
-		for _, allowed := range allowedOrigins {
-			if strings.TrimSpace(allowed) == origin {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				break
-			}
-		}
+	if s.blobs == nil {
+		s.blobs = newDefaultBlobCache()
+	}
+	if s.images == nil {
+		s.images = images.NewFetcher(s.blobs)
 	}
 
+	return s
+}
+
+// newDefaultBlobCache creates the image cache used when none is configured
+func newDefaultBlobCache() *cache.BlobCache {
+	return cache.NewBlobCache(24*time.Hour, 64<<20)
+}
+
+// enableCORS sets the CORS and security headers of an API response, and
+// reports whether the request's origin, if any, is allowed
+func (s *Server) enableCORS(w http.ResponseWriter, r *http.Request) bool {
+	allowed := allowOrigin(w, r, s.allowedOrigins)
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("Access-Control-Max-Age", "86400")
@@ -50,159 +129,241 @@ func (s *Server) enableCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("X-Frame-Options", "DENY")
 	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none';")
+	return allowed
 }
 
-func (s *Server) HandleUserCurrentlyReading(w http.ResponseWriter, r *http.Request) {
-	s.enableCORS(w, r)
+// allowOrigin sets Access-Control-Allow-Origin for the request's origin if
+// allowed lets it read the response, and reports whether it does
+func allowOrigin(w http.ResponseWriter, r *http.Request, allowed *AllowedOrigins) bool {
+	origin := r.Header.Get("Origin")
+	ok := origin == "" || allowed.Allows(origin)
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+	if allowed.AllowsAny() {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else if origin != "" && ok {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
 	}
 
-	// Extract username from path parameter
-	username := r.PathValue("username")
+	if !allowed.AllowsAny() {
+		// Responses are cacheable, and the allowed origin differs per request
+		w.Header().Add("Vary", "Origin")
+	}
+	return ok
+}
+
+// shelf describes a list of a user's books served by the API
+type shelf struct {
+	// cacheKey prefixes the username in the response cache key
+	cacheKey string
+	// title is the human readable heading used in cards and feeds
+	title string
+	// description names the shelf in log messages
+	description string
+	// errorMessage is returned to clients when the upstream fetch fails
+	errorMessage string
+	fetch        func(client hardcover.Client, username string) (*hardcover.UserBooksResponse, error)
+	// process prepares fetched books before they are cached, if set
+	process func(books *hardcover.UserBooksResponse)
+	// view adapts cached books to the viewParams of a request, if set. It
+	// must not modify books, which is shared through the cache.
+	view       func(books *hardcover.UserBooksResponse, username string, params url.Values) (*hardcover.UserBooksResponse, error)
+	viewParams []string
+	// canonicalView rewrites view parameters to canonical values, if set,
+	// so equivalent requests share a cached view
+	canonicalView func(params url.Values)
+}
+
+// shelves maps endpoint names to the shelves they serve
+var shelves = map[string]shelf{
+	"currently-reading": {
+		cacheKey:     "currently_reading",
+		title:        "Currently reading",
+		description:  "currently reading books",
+		errorMessage: "Failed to fetch books",
+		fetch:        hardcover.Client.GetUserCurrentlyReadingBooksByUsername,
+	},
+	"last-read": {
+		cacheKey:     "last_read",
+		title:        "Last read",
+		description:  "last read books",
+		errorMessage: "Failed to fetch books",
+		fetch:        hardcover.Client.GetUserLastReadBooksByUsername,
+	},
+	"reviews": {
+		cacheKey:      "reviews",
+		title:         "Book reviews",
+		description:   "reviews",
+		errorMessage:  "Failed to fetch reviews",
+		fetch:         hardcover.Client.GetUserReviewsByUsername,
+		process:       renderReviews,
+		view:          reviewsView,
+		viewParams:    []string{"spoilers", "excerpt_length"},
+		canonicalView: reviewsCanonicalView,
+	},
+}
 
-	// Validate username (alphanumeric, hyphens, underscores)
-	if username == "" || !isValidUsername(username) {
-		http.Error(w, "Invalid username", http.StatusBadRequest)
-		return
+// userCacheKey is the response cache key of a user's shelf
+func (sh shelf) userCacheKey(username string) string {
+	return fmt.Sprintf("%s_%s", sh.cacheKey, username)
+}
+
+// userBooks returns the books on a user's shelf, from cache when possible
+func (s *Server) userBooks(endpoint, username string) (*hardcover.UserBooksResponse, error) {
+	sh, ok := shelves[endpoint]
+	if !ok {
+		return nil, fmt.Errorf("unknown shelf %q", endpoint)
 	}
 
-	cacheKey := fmt.Sprintf("currently_reading_%s", username)
+	cacheKey := sh.userCacheKey(username)
 
 	if cached, found := s.cache.Get(cacheKey); found {
-		metrics.CacheHitsTotal.WithLabelValues("currently-reading", username).Inc()
-		log.Printf("Serving cached currently reading books for user: %s", username)
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(cached); err != nil {
-			log.Printf("Error encoding cached response: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
-		return
+		metrics.Usernames.RecordCache(username, true)
+		metrics.CacheHitsTotal.WithLabelValues(endpoint, metrics.Usernames.Label(username)).Inc()
+		log.Printf("Serving cached %s for user: %s", sh.description, username)
+		return cached, nil
 	}
 
-	metrics.CacheMissesTotal.WithLabelValues("currently-reading", username).Inc()
+	metrics.Usernames.RecordCache(username, false)
+	metrics.CacheMissesTotal.WithLabelValues(endpoint, metrics.Usernames.Label(username)).Inc()
 
-	log.Printf("Fetching currently reading books for user: %s", username)
-	books, err := s.client.GetUserCurrentlyReadingBooksByUsername(username)
+	log.Printf("Fetching %s for user: %s", sh.description, username)
+	books, err := sh.fetch(s.client, username)
 	if err != nil {
-		log.Printf("Error fetching books for user %s: %v", username, err)
-		http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	s.cache.Set(cacheKey, books)
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(books); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if sh.process != nil {
+		sh.process(books)
 	}
-}
-
-// usernameRegex validates usernames containing only alphanumeric characters, hyphens, and underscores
-var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	s.covers.record(books)
 
-// isValidUsername checks if the username contains only alphanumeric characters, hyphens, and underscores
-func isValidUsername(username string) bool {
-	return usernameRegex.MatchString(username)
+	s.cache.Set(cacheKey, books)
+	return books, nil
 }
 
-func (s *Server) HandleUserLastRead(w http.ResponseWriter, r *http.Request) {
-	s.enableCORS(w, r)
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+// shelfMaxAge returns how long a user's shelf stays cached, which is how
+// long clients may reuse responses built from it
+func (s *Server) shelfMaxAge(endpoint, username string) time.Duration {
+	expiresAt, ok := s.cache.ExpiresAt(shelves[endpoint].userCacheKey(username))
+	if !ok {
+		return s.cache.TTL()
 	}
+	return max(time.Until(expiresAt), 0)
+}
 
-	// Extract username from path parameter
-	username := r.PathValue("username")
-
-	// Validate username (alphanumeric, hyphens, underscores)
-	if username == "" || !isValidUsername(username) {
-		http.Error(w, "Invalid username", http.StatusBadRequest)
-		return
+// applyView adapts a user's books to the request's view parameters. Views
+// are cached alongside the upstream response they were derived from.
+func (s *Server) applyView(endpoint, username string, books *hardcover.UserBooksResponse, query url.Values) (*hardcover.UserBooksResponse, error) {
+	sh := shelves[endpoint]
+	if sh.view == nil {
+		return books, nil
 	}
 
-	cacheKey := fmt.Sprintf("last_read_%s", username)
-
-	if cached, found := s.cache.Get(cacheKey); found {
-		metrics.CacheHitsTotal.WithLabelValues("last-read", username).Inc()
-		log.Printf("Serving cached last read books for user: %s", username)
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(cached); err != nil {
-			log.Printf("Error encoding cached response: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+	params := url.Values{}
+	for _, name := range sh.viewParams {
+		if value := query.Get(name); value != "" {
+			params.Set(name, value)
 		}
-		return
+	}
+	if len(params) == 0 {
+		return books, nil
+	}
+	if sh.canonicalView != nil {
+		sh.canonicalView(params)
 	}
 
-	metrics.CacheMissesTotal.WithLabelValues("last-read", username).Inc()
+	// Keying on the response timestamp means a refreshed shelf gets fresh views
+	cacheKey := fmt.Sprintf("%s_%s_%d_%s", sh.cacheKey, username, books.UpdatedAt.UnixNano(), params.Encode())
+	if cached, found := s.cache.Get(cacheKey); found {
+		return cached, nil
+	}
 
-	log.Printf("Fetching last read books for user: %s", username)
-	books, err := s.client.GetUserLastReadBooksByUsername(username)
+	view, err := sh.view(books, username, params)
 	if err != nil {
-		log.Printf("Error fetching last read books for user %s: %v", username, err)
-		http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	s.cache.Set(cacheKey, view)
+	return view, nil
+}
 
-	s.cache.Set(cacheKey, books)
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(books); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+// addLinks returns a copy of books with the outbound links configured for
+// username
+func (s *Server) addLinks(books *hardcover.UserBooksResponse, username string) *hardcover.UserBooksResponse {
+	linked := *books
+	linked.Books = make([]hardcover.UserBook, len(books.Books))
+	for i, book := range books.Books {
+		book.Links = s.bookLinks(book, username)
+		linked.Books[i] = book
 	}
+	return &linked
 }
 
-func (s *Server) HandleUserReviews(w http.ResponseWriter, r *http.Request) {
-	s.enableCORS(w, r)
+// bookLinks expands the link templates for a book served for username, and
+// links reviewed books to the review
+func (s *Server) bookLinks(book hardcover.UserBook, username string) map[string]string {
+	author := ""
+	if len(book.Book.Contributions) > 0 {
+		author = book.Book.Contributions[0].Author.Name
+	}
+	bookLinks := s.links.Expand(username, links.Book{
+		Slug:         book.Book.Slug,
+		Title:        book.Book.Title,
+		Author:       author,
+		ISBN:         book.Book.ISBN(),
+		HardcoverURL: hardcoverBookURL(book.Book),
+	})
+	if book.HasReview {
+		bookLinks[links.ReviewLink] = hardcoverReviewURL(book.Book, username)
+	}
+	return bookLinks
+}
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+// renderReviews renders each review server-side so every format and the
+// widgets share one sanitized rendering. Upstream review HTML is sanitized
+// in place, since embeds would otherwise trust it completely.
+func renderReviews(books *hardcover.UserBooksResponse) {
+	for i := range books.Books {
+		book := &books.Books[i]
+		if book.ReviewHTML != nil {
+			sanitized := sanitizeReviewHTML(*book.ReviewHTML)
+			book.ReviewHTML = &sanitized
+		}
+		book.Review = review.Render(*book)
 	}
+}
 
-	// Extract username from path parameter
-	username := r.PathValue("username")
+// sanitizeReviewHTML sanitizes upstream review HTML and records what was removed
+func sanitizeReviewHTML(s string) string {
+	sanitized, stats := review.Sanitize(s)
 
-	// Validate username (alphanumeric, hyphens, underscores)
-	if username == "" || !isValidUsername(username) {
-		http.Error(w, "Invalid username", http.StatusBadRequest)
-		return
+	result := "clean"
+	if stats.Modified() {
+		result = "modified"
 	}
+	metrics.ReviewHTMLSanitizedTotal.WithLabelValues(result).Inc()
+	metrics.ReviewHTMLRemovalsTotal.WithLabelValues("element").Add(float64(stats.Elements))
+	metrics.ReviewHTMLRemovalsTotal.WithLabelValues("attribute").Add(float64(stats.Attributes))
+	metrics.ReviewHTMLRemovalsTotal.WithLabelValues("url").Add(float64(stats.URLs))
 
-	cacheKey := fmt.Sprintf("reviews_%s", username)
+	return sanitized
+}
 
-	if cached, found := s.cache.Get(cacheKey); found {
-		metrics.CacheHitsTotal.WithLabelValues("reviews", username).Inc()
-		log.Printf("Serving cached reviews for user: %s", username)
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(cached); err != nil {
-			log.Printf("Error encoding cached response: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
-		return
-	}
+func (s *Server) HandleUserCurrentlyReading(w http.ResponseWriter, r *http.Request) {
+	s.handleShelf(w, r, "currently-reading")
+}
 
-	metrics.CacheMissesTotal.WithLabelValues("reviews", username).Inc()
+// usernameRegex validates usernames containing only alphanumeric characters, hyphens, and underscores
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 
-	log.Printf("Fetching reviews for user: %s", username)
-	books, err := s.client.GetUserReviewsByUsername(username)
-	if err != nil {
-		log.Printf("Error fetching reviews for user %s: %v", username, err)
-		http.Error(w, "Failed to fetch reviews", http.StatusInternalServerError)
-		return
-	}
+// isValidUsername checks if the username contains only alphanumeric characters, hyphens, and underscores
+func isValidUsername(username string) bool {
+	return usernameRegex.MatchString(username)
+}
 
-	s.cache.Set(cacheKey, books)
+func (s *Server) HandleUserLastRead(w http.ResponseWriter, r *http.Request) {
+	s.handleShelf(w, r, "last-read")
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(books); err != nil {
-		log.Printf("Error encoding response: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-	}
+func (s *Server) HandleUserReviews(w http.ResponseWriter, r *http.Request) {
+	s.handleShelf(w, r, "reviews")
 }
@@ -1,17 +1,49 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
 	"github.com/gouthamve/hardcover-book-embed/internal/cache"
 	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/images"
+	"github.com/gouthamve/hardcover-book-embed/internal/links"
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
 )
 
+// allOrigins allows API calls from any origin
+var allOrigins = &AllowedOrigins{any: true}
+
+// newUsernameOrigins loads username bindings from a file holding data
+func newUsernameOrigins(t *testing.T, data string) *UsernameOrigins {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "username-origins.json")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write username origins: %v", err)
+	}
+	bindings, err := LoadUsernameOrigins(path)
+	if err != nil {
+		t.Fatalf("failed to load username origins: %v", err)
+	}
+	return bindings
+}
+
 func TestHandleUserCurrentlyReading(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -61,7 +93,7 @@ func TestHandleUserCurrentlyReading(t *testing.T) {
 
 			// Create server with mock
 			cache := cache.NewMemoryCache(5 * time.Minute)
-			server := NewServer(mockClient, cache, "*")
+			server := NewServer(mockClient, cache, allOrigins)
 
 			// Create request
 			url := fmt.Sprintf("/api/books/currently-reading/%s", tt.username)
@@ -122,7 +154,7 @@ func TestCaching(t *testing.T) {
 
 	// Create server with short cache TTL for testing
 	cache := cache.NewMemoryCache(1 * time.Second)
-	server := NewServer(mockClient, cache, "*")
+	server := NewServer(mockClient, cache, allOrigins)
 
 	username := "cachetest"
 	url := fmt.Sprintf("/api/books/currently-reading/%s", username)
@@ -160,3 +192,1701 @@ func TestCaching(t *testing.T) {
 		t.Errorf("expected 2 API calls (cache expired), got %d", callCount)
 	}
 }
+
+func TestConditionalGet(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins)
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/books/currently-reading/testuser", nil)
+		req.SetPathValue("username", "testuser")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		server.HandleUserCurrentlyReading(w, req)
+		return w
+	}
+
+	w := get(nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
+	}
+	lastModified := w.Header().Get("Last-Modified")
+	if lastModified != "Fri, 11 Jul 2025 07:12:20 GMT" {
+		t.Errorf("expected Last-Modified from the response's updated_at, got %q", lastModified)
+	}
+	var maxAge int
+	if _, err := fmt.Sscanf(w.Header().Get("Cache-Control"), "public, max-age=%d", &maxAge); err != nil || maxAge <= 0 || maxAge > 300 {
+		t.Errorf("expected max-age within the cache TTL, got %q", w.Header().Get("Cache-Control"))
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected int
+	}{
+		{"matching ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"ETag in a list", map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{"weak ETag", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"stale ETag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": "Thu, 10 Jul 2025 07:12:20 GMT"}, http.StatusOK},
+		{"ETag wins over date", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.headers)
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+			if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Error("expected an empty body with 304")
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Errorf("expected ETag %s, got %s", etag, w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "gzip"},
+		{"GZIP", "gzip"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.expected {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.expected)
+		}
+	}
+}
+
+// decompress decodes a response body sent with a content coding
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+		r = gz
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress %s body: %v", encoding, err)
+	}
+	return string(decoded)
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins)
+	handler := CompressMiddleware(server.HandleUserCurrentlyReading)
+
+	get := func(username string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/books/currently-reading/"+username, nil)
+		req.SetPathValue("username", username)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	plain := get("testuser", nil)
+	if plain.Header().Get("Content-Encoding") != "" {
+		t.Fatal("expected no compression without Accept-Encoding")
+	}
+	if !strings.Contains(strings.Join(plain.Header().Values("Vary"), ","), "Accept-Encoding") {
+		t.Errorf("expected Vary to include Accept-Encoding, got %v", plain.Header().Values("Vary"))
+	}
+
+	for _, encoding := range []string{"br", "gzip"} {
+		t.Run(encoding, func(t *testing.T) {
+			w := get("testuser", map[string]string{"Accept-Encoding": encoding})
+			if w.Header().Get("Content-Encoding") != encoding {
+				t.Fatalf("expected Content-Encoding %s, got %q", encoding, w.Header().Get("Content-Encoding"))
+			}
+			if w.Body.Len() >= plain.Body.Len() {
+				t.Errorf("expected a smaller body, got %d bytes for %d", w.Body.Len(), plain.Body.Len())
+			}
+			if got := decompress(t, encoding, w.Body.Bytes()); got != plain.Body.String() {
+				t.Error("expected the compressed body to decompress to the plain one")
+			}
+
+			etag := w.Header().Get("ETag")
+			if etag != "W/"+plain.Header().Get("ETag") {
+				t.Errorf("expected a weak ETag, got %q", etag)
+			}
+			revalidated := get("testuser", map[string]string{"Accept-Encoding": encoding, "If-None-Match": etag})
+			if revalidated.Code != http.StatusNotModified || revalidated.Body.Len() != 0 {
+				t.Errorf("expected an empty 304, got %d with %d bytes", revalidated.Code, revalidated.Body.Len())
+			}
+		})
+	}
+
+	// Small responses, like errors, are not worth compressing
+	w := get("bad@user", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected an uncompressed 400, got %d with encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if !strings.Contains(w.Body.String(), "Invalid username") {
+		t.Errorf("expected the error message, got %q", w.Body.String())
+	}
+}
+
+// mockImageHTTPClient serves a 1x1 PNG for every request
+type mockImageHTTPClient struct {
+	requests int
+}
+
+func (m *mockImageHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	m.requests++
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"image/png"}},
+		Body:       io.NopCloser(&buf),
+	}, nil
+}
+
+func TestHandleUserCurrentlyReadingSVG(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	imageClient := &mockImageHTTPClient{}
+	fetcher := images.NewFetcherWithHTTPClient(cache.NewBlobCache(time.Minute, 1<<20), imageClient)
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins, WithImageFetcher(fetcher))
+
+	req := httptest.NewRequest("GET", "/api/books/currently-reading/testuser.svg?theme=dark&count=2", nil)
+	req.SetPathValue("username", "testuser.svg")
+	w := httptest.NewRecorder()
+	server.HandleUserCurrentlyReading(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "image/svg+xml") {
+		t.Errorf("expected SVG content type, got %q", ct)
+	}
+	if err := mockClient.AssertCalled("GetUserBooksByUsername", "testuser"); err != nil {
+		t.Error(err)
+	}
+
+	body := w.Body.String()
+	if got := strings.Count(body, "data:image/jpeg;base64,"); got != 2 {
+		t.Errorf("expected 2 inlined covers, got %d", got)
+	}
+	if !strings.Contains(body, "Shakespeare: The World as Stage") {
+		t.Error("expected book title in SVG")
+	}
+	if !strings.Contains(body, svgThemes["dark"].Background) {
+		t.Error("expected dark theme background")
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
+	}
+
+	// A conditional request with the same ETag should be answered with 304
+	req2 := httptest.NewRequest("GET", "/api/books/currently-reading/testuser.svg?theme=dark&count=2", nil)
+	req2.SetPathValue("username", "testuser.svg")
+	req2.Header.Set("If-None-Match", etag)
+	w2 := httptest.NewRecorder()
+	server.HandleUserCurrentlyReading(w2, req2)
+
+	if w2.Code != http.StatusNotModified {
+		t.Errorf("expected status 304, got %d", w2.Code)
+	}
+	if imageClient.requests != 2 {
+		t.Errorf("expected covers to be fetched once each, got %d fetches", imageClient.requests)
+	}
+}
+
+func TestHandleOGImage(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	blobs := cache.NewBlobCache(time.Minute, 1<<20)
+	fetcher := images.NewFetcherWithHTTPClient(blobs, &mockImageHTTPClient{})
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins,
+		WithBlobCache(blobs), WithImageFetcher(fetcher))
+
+	tests := []struct {
+		name           string
+		shelf          string
+		username       string
+		expectedStatus int
+	}{
+		{name: "currently reading", shelf: "currently-reading", username: "testuser.png", expectedStatus: http.StatusOK},
+		{name: "reviews", shelf: "reviews", username: "testuser.png", expectedStatus: http.StatusOK},
+		{name: "unknown shelf", shelf: "want-to-read", username: "testuser.png", expectedStatus: http.StatusNotFound},
+		{name: "missing extension", shelf: "last-read", username: "testuser", expectedStatus: http.StatusBadRequest},
+		{name: "invalid username", shelf: "last-read", username: "test@user.png", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", fmt.Sprintf("/og/%s/%s", tt.shelf, tt.username), nil)
+			req.SetPathValue("shelf", tt.shelf)
+			req.SetPathValue("username", tt.username)
+			w := httptest.NewRecorder()
+			server.HandleOGImage(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			img, err := png.Decode(w.Body)
+			if err != nil {
+				t.Fatalf("failed to decode PNG: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != 1200 || b.Dy() != 630 {
+				t.Errorf("expected 1200x630 image, got %dx%d", b.Dx(), b.Dy())
+			}
+		})
+	}
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/og/currently-reading/testuser.png", nil)
+		req.SetPathValue("shelf", "currently-reading")
+		req.SetPathValue("username", "testuser.png")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		server.HandleOGImage(w, req)
+		return w
+	}
+
+	// The image can be reused until the shelf it was drawn from expires
+	time.Sleep(1100 * time.Millisecond)
+	w := get("")
+	var maxAge int
+	if _, err := fmt.Sscanf(w.Header().Get("Cache-Control"), "public, max-age=%d", &maxAge); err != nil || maxAge <= 0 || maxAge >= 300 {
+		t.Errorf("expected max-age below the cache TTL, got %q", w.Header().Get("Cache-Control"))
+	}
+
+	etag := w.Header().Get("ETag")
+	for _, match := range []string{etag, `"other", ` + etag, "W/" + etag} {
+		if w := get(match); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: expected 304, got %d", match, w.Code)
+		}
+	}
+}
+
+func TestShelfTextFormats(t *testing.T) {
+	rating := 4.5
+	mockClient := hardcover.NewMockClient()
+	mockClient.GetUserBooksByUsernameFunc = func(username string) (*hardcover.UserBooksResponse, error) {
+		return &hardcover.UserBooksResponse{
+			Books: []hardcover.UserBook{
+				{
+					Rating: &rating,
+					Book: hardcover.Book{
+						ID:    1,
+						Title: "Salt: A World History",
+						Slug:  "salt",
+						Contributions: []hardcover.Contribution{
+							{Author: hardcover.Author{Name: "Mark Kurlansky"}},
+						},
+					},
+				},
+			},
+			Count:     1,
+			UpdatedAt: time.Now(),
+		}, nil
+	}
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins)
+
+	tests := []struct {
+		name         string
+		path         string
+		accept       string
+		expectedType string
+		expectedBody string
+	}{
+		{
+			name:         "markdown by extension",
+			path:         "testuser.md",
+			expectedType: "text/markdown",
+			expectedBody: "- [Salt: A World History](https://hardcover.app/books/salt) by Mark Kurlansky ★★★★½\n",
+		},
+		{
+			name:         "markdown by extension without ratings or links",
+			path:         "testuser.md?ratings=false&links=none",
+			expectedType: "text/markdown",
+			expectedBody: "- Salt: A World History by Mark Kurlansky\n",
+		},
+		{
+			name:         "markdown reference links",
+			path:         "testuser.md?links=reference&ratings=false",
+			expectedType: "text/markdown",
+			expectedBody: "- [Salt: A World History][1] by Mark Kurlansky\n\n[1]: https://hardcover.app/books/salt\n",
+		},
+		{
+			name:         "plain text by Accept header",
+			path:         "testuser",
+			accept:       "text/plain",
+			expectedType: "text/plain",
+			expectedBody: "- Salt: A World History by Mark Kurlansky ★★★★½ <https://hardcover.app/books/salt>\n",
+		},
+		{
+			name:         "JSON preferred over text",
+			path:         "testuser",
+			accept:       "application/json, text/plain",
+			expectedType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/books/currently-reading/"+tt.path, nil)
+			req.SetPathValue("username", strings.SplitN(tt.path, "?", 2)[0])
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			server.HandleUserCurrentlyReading(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.expectedType) {
+				t.Errorf("expected content type %q, got %q", tt.expectedType, ct)
+			}
+			if tt.expectedBody != "" && w.Body.String() != tt.expectedBody {
+				t.Errorf("unexpected body:\ngot:  %q\nwant: %q", w.Body.String(), tt.expectedBody)
+			}
+		})
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	server := NewServer(hardcover.NewMockClient(), cache.NewMemoryCache(5*time.Minute), allOrigins)
+
+	tests := []struct {
+		name           string
+		handler        func(http.ResponseWriter, *http.Request)
+		username       string
+		accept         string
+		expectedStatus int
+		expectedType   string
+	}{
+		{name: "default is JSON", handler: server.HandleUserCurrentlyReading, username: "testuser", expectedStatus: http.StatusOK, expectedType: "application/json"},
+		{name: "wildcard is JSON", handler: server.HandleUserCurrentlyReading, username: "testuser", accept: "*/*", expectedStatus: http.StatusOK, expectedType: "application/json"},
+		{name: "browser navigation is JSON", handler: server.HandleUserCurrentlyReading, username: "testuser", accept: "text/html,application/xhtml+xml,*/*;q=0.8", expectedStatus: http.StatusOK, expectedType: "application/json"},
+		{name: "quality values are honoured", handler: server.HandleUserLastRead, username: "testuser", accept: "application/json;q=0.5, application/atom+xml", expectedStatus: http.StatusOK, expectedType: "application/atom+xml"},
+		{name: "JSON Feed by extension", handler: server.HandleUserReviews, username: "testuser.feed.json", expectedStatus: http.StatusOK, expectedType: "application/feed+json"},
+		{name: "CSV by extension", handler: server.HandleUserReviews, username: "testuser.csv", expectedStatus: http.StatusOK, expectedType: "text/csv"},
+		{name: "HTML fragment by extension", handler: server.HandleUserReviews, username: "testuser.html", expectedStatus: http.StatusOK, expectedType: "text/html"},
+		{name: "unsupported type", handler: server.HandleUserCurrentlyReading, username: "testuser", accept: "application/pdf", expectedStatus: http.StatusNotAcceptable},
+		{name: "SVG not offered for reviews", handler: server.HandleUserReviews, username: "testuser", accept: "image/svg+xml", expectedStatus: http.StatusNotAcceptable},
+		{name: "SVG extension on reviews", handler: server.HandleUserReviews, username: "testuser.svg", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/books/x/"+tt.username, nil)
+			req.SetPathValue("username", tt.username)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if vary := w.Header().Get("Vary"); vary != "Accept" {
+				t.Errorf("expected Vary: Accept, got %q", vary)
+			}
+			if tt.expectedType != "" && !strings.HasPrefix(w.Header().Get("Content-Type"), tt.expectedType) {
+				t.Errorf("expected content type %q, got %q", tt.expectedType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandleUserReviewsSanitizesAndRenders(t *testing.T) {
+	reviewHTML := `<p onclick="x()">Loved it <a href="javascript:alert(1)">here</a></p><script>alert(1)</script>`
+	mockClient := hardcover.NewMockClient()
+	mockClient.GetUserReviewsByUsernameFunc = func(username string) (*hardcover.UserBooksResponse, error) {
+		return &hardcover.UserBooksResponse{
+			Books: []hardcover.UserBook{
+				{
+					Book:       hardcover.Book{ID: 1, Title: "Dune", Slug: "dune"},
+					ReviewHTML: &reviewHTML,
+					ReviewSlate: &hardcover.ReviewSlate{Document: hardcover.SlateDocument{
+						Children: []hardcover.SlateBlock{
+							{Type: "paragraph", Children: []hardcover.SlateText{{Text: "Loved "}, {Text: "it", Bold: true}}},
+						},
+					}},
+					HasReview: true,
+				},
+			},
+			Count:     1,
+			UpdatedAt: time.Now(),
+		}, nil
+	}
+	memCache := cache.NewMemoryCache(5 * time.Minute)
+	server := NewServer(mockClient, memCache, allOrigins)
+
+	req := httptest.NewRequest("GET", "/api/books/reviews/testuser", nil)
+	req.SetPathValue("username", "testuser")
+	w := httptest.NewRecorder()
+	server.HandleUserReviews(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var response hardcover.UserBooksResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	book := response.Books[0]
+	if want := "<p>Loved it here</p>"; book.ReviewHTML == nil || *book.ReviewHTML != want {
+		t.Errorf("expected sanitized review_html %q, got %v", want, book.ReviewHTML)
+	}
+	if book.Review == nil {
+		t.Fatal("expected a rendered review")
+	}
+	if want := "<p>Loved <strong>it</strong></p>"; book.Review.HTML != want {
+		t.Errorf("expected review.html %q, got %q", want, book.Review.HTML)
+	}
+	if book.Review.Markdown != "Loved **it**" || book.Review.Text != "Loved it" || book.Review.WordCount != 2 {
+		t.Errorf("unexpected rendered review: %+v", book.Review)
+	}
+
+	// The sanitized response is what gets cached
+	cached, found := memCache.Get("reviews_testuser")
+	if !found {
+		t.Fatal("expected reviews to be cached")
+	}
+	if strings.Contains(*cached.Books[0].ReviewHTML, "script") {
+		t.Errorf("cached review_html was not sanitized: %s", *cached.Books[0].ReviewHTML)
+	}
+}
+
+func TestHandleUserReviewsSpoilers(t *testing.T) {
+	spoilerRaw := "The butler did it"
+	mockClient := hardcover.NewMockClient()
+	mockClient.GetUserReviewsByUsernameFunc = func(username string) (*hardcover.UserBooksResponse, error) {
+		return &hardcover.UserBooksResponse{
+			Books: []hardcover.UserBook{
+				{
+					Book: hardcover.Book{ID: 1, Title: "Marked", Slug: "marked"},
+					ReviewSlate: &hardcover.ReviewSlate{Document: hardcover.SlateDocument{
+						Children: []hardcover.SlateBlock{
+							{Type: "paragraph", Children: []hardcover.SlateText{{Text: "Loved it."}}},
+							{Type: "spoiler", Children: []hardcover.SlateText{{Text: "Everyone dies."}}},
+						},
+					}},
+					ReviewHasSpoilers: true,
+				},
+				{
+					Book:              hardcover.Book{ID: 2, Title: "Flagged", Slug: "flagged"},
+					ReviewRaw:         &spoilerRaw,
+					ReviewHasSpoilers: true,
+				},
+			},
+			Count:     2,
+			UpdatedAt: time.Now(),
+		}, nil
+	}
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins)
+
+	get := func(query string) (int, hardcover.UserBooksResponse, string) {
+		req := httptest.NewRequest("GET", "/api/books/reviews/testuser"+query, nil)
+		req.SetPathValue("username", "testuser")
+		w := httptest.NewRecorder()
+		server.HandleUserReviews(w, req)
+
+		var response hardcover.UserBooksResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+		}
+		return w.Code, response, w.Body.String()
+	}
+
+	t.Run("omit", func(t *testing.T) {
+		code, response, body := get("?spoilers=omit")
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		if strings.Contains(body, "dies") || strings.Contains(body, "butler") {
+			t.Errorf("expected spoilers to be omitted, got %s", body)
+		}
+		if response.Count != 1 || response.Books[0].Review.Text != "Loved it." {
+			t.Errorf("unexpected response: %+v", response)
+		}
+	})
+
+	t.Run("hide", func(t *testing.T) {
+		code, response, _ := get("?spoilers=hide")
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		if response.Count != 2 {
+			t.Fatalf("expected 2 reviews, got %d", response.Count)
+		}
+		marked := response.Books[0].Review
+		if marked.Text != "Loved it." || marked.Spoiler == nil || !strings.Contains(marked.Spoiler.Text, "Everyone dies.") {
+			t.Errorf("unexpected teaser for marked spoilers: %+v", marked)
+		}
+		flagged := response.Books[1]
+		if flagged.Review.Text != "" || flagged.Review.Spoiler == nil || flagged.Review.Spoiler.Text != spoilerRaw {
+			t.Errorf("unexpected teaser for flagged review: %+v", flagged.Review)
+		}
+		if flagged.ReviewRaw != nil {
+			t.Errorf("expected review_raw to be dropped, got %q", *flagged.ReviewRaw)
+		}
+	})
+
+	t.Run("show leaves the cache untouched", func(t *testing.T) {
+		_, response, body := get("")
+		if !strings.Contains(body, "Everyone dies.") || response.Books[1].ReviewRaw == nil {
+			t.Errorf("expected full reviews, got %s", body)
+		}
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		if code, _, _ := get("?spoilers=maybe"); code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", code)
+		}
+	})
+}
+
+func TestHandleUserReviewsExcerpt(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/books/reviews/testuser"+query, nil)
+		req.SetPathValue("username", "testuser")
+		w := httptest.NewRecorder()
+		server.HandleUserReviews(w, req)
+		return w
+	}
+
+	w := get("?excerpt_length=25")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var response hardcover.UserBooksResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	excerpt := response.Books[0].Excerpt
+	if excerpt == nil {
+		t.Fatal("expected an excerpt")
+	}
+	// Lengths are rounded down to 20
+	if excerpt.Text != "This was an amazing…" || !excerpt.Truncated {
+		t.Errorf("unexpected excerpt: %+v", excerpt)
+	}
+	if excerpt.URL != "https://hardcover.app/books/mock-reviewed-book/reviews/@testuser" {
+		t.Errorf("unexpected excerpt URL: %s", excerpt.URL)
+	}
+	if book := response.Books[0]; book.Review != nil || book.ReviewRaw != nil || book.ReviewHTML != nil || book.ReviewObject != nil || book.ReviewSlate != nil {
+		t.Errorf("expected the full review to be left out, got %+v", book)
+	}
+
+	// Views are cached, so the upstream is only asked once
+	get("?excerpt_length=25")
+	if w := get("?excerpt_length=49"); w.Body.String() != get("?excerpt_length=25").Body.String() {
+		t.Error("expected lengths in the same bucket to share a view")
+	}
+	get("")
+	if len(mockClient.GetReviewsCalls) != 1 {
+		t.Errorf("expected 1 upstream call, got %d", len(mockClient.GetReviewsCalls))
+	}
+
+	if w := get(""); strings.Contains(w.Body.String(), `"excerpt"`) || !strings.Contains(w.Body.String(), `"review_html"`) {
+		t.Error("expected the full review and no excerpt without excerpt_length")
+	}
+
+	for _, length := range []string{"abc", "5", "100000"} {
+		if w := get("?excerpt_length=" + length); w.Code != http.StatusBadRequest {
+			t.Errorf("excerpt_length=%s: expected status 400, got %d", length, w.Code)
+		}
+	}
+}
+
+func TestReviewsCanonicalView(t *testing.T) {
+	tests := map[string]string{
+		"20":     "20",
+		"49":     "20",
+		"50":     "50",
+		"280":    "200",
+		"4999":   "3000",
+		"5000":   "5000",
+		"5":      "5",
+		"100000": "100000",
+		"abc":    "abc",
+	}
+	for length, want := range tests {
+		params := url.Values{"excerpt_length": {length}}
+		reviewsCanonicalView(params)
+		if got := params.Get("excerpt_length"); got != want {
+			t.Errorf("excerpt_length=%s: expected %s, got %s", length, want, got)
+		}
+	}
+}
+
+func TestHandleCoverImage(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	imageClient := &mockImageHTTPClient{}
+	blobs := cache.NewBlobCache(time.Minute, 1<<20)
+	disk, err := cache.NewDiskCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create disk cache: %v", err)
+	}
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins,
+		WithBlobCache(blobs), WithDiskCache(disk),
+		WithImageFetcher(images.NewFetcherWithHTTPClient(blobs, imageClient)))
+
+	getCover := func(bookID, query, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/img/"+bookID+query, nil)
+		req.SetPathValue("bookID", bookID)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		server.HandleCoverImage(w, req)
+		return w
+	}
+
+	// Covers are only proxied for books we have served
+	if w := getCover("386725", "", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the shelf is loaded, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/books/currently-reading/testuser?images=proxy", nil)
+	req.SetPathValue("username", "testuser")
+	w := httptest.NewRecorder()
+	server.HandleUserCurrentlyReading(w, req)
+
+	var response hardcover.UserBooksResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if got := response.Books[0].Book.Image.URL; got != "http://example.com/img/386725" {
+		t.Errorf("expected cover URL to point at the proxy, got %s", got)
+	}
+
+	w = getCover("386725", "?w=100", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("expected image/jpeg, got %q", ct)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Errorf("expected a strong ETag, got %q", etag)
+	}
+
+	// Widths are rounded up to the same variant, served from the disk cache
+	if w := getCover("386725", "?w=120", etag); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", w.Code)
+	}
+	if imageClient.requests != 1 {
+		t.Errorf("expected 1 upstream image request, got %d", imageClient.requests)
+	}
+	// Lists and weak validators, as sent after compression, match too
+	for _, match := range []string{`"other", ` + etag, "W/" + etag, "*"} {
+		if w := getCover("386725", "?w=100", match); w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: expected 304, got %d", match, w.Code)
+		}
+	}
+
+	w = getCover("386725", "?format=png", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("expected PNG cover, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if _, err := png.Decode(w.Body); err != nil {
+		t.Errorf("failed to decode PNG cover: %v", err)
+	}
+
+	for _, query := range []string{"?w=abc", "?w=-1", "?format=gif"} {
+		if w := getCover("386725", query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, w.Code)
+		}
+	}
+	if w := getCover("abc", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a non-numeric ID, got %d", w.Code)
+	}
+}
+
+func TestHandlePlaceholderCover(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	blobs := cache.NewBlobCache(time.Minute, 1<<20)
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins, WithBlobCache(blobs))
+
+	getPlaceholder := func(file, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/img/placeholder/"+file+query, nil)
+		req.SetPathValue("file", file)
+		w := httptest.NewRecorder()
+		server.HandlePlaceholderCover(w, req)
+		return w
+	}
+
+	// Unknown books still get a colored cover, cached only briefly
+	w := getPlaceholder("1896516.svg", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("expected short max-age for an unknown book, got %q", cc)
+	}
+	// and their PNGs are drawn without being kept
+	if w := getPlaceholder("1896516.png", "?w=120"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if _, found := blobs.Get("placeholder_1896516_120__"); found {
+		t.Error("expected the PNG of an unknown book not to be cached")
+	}
+
+	req := httptest.NewRequest("GET", "/api/books/currently-reading/testuser", nil)
+	req.SetPathValue("username", "testuser")
+	rec := httptest.NewRecorder()
+	server.HandleUserCurrentlyReading(rec, req)
+
+	var response hardcover.UserBooksResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	cover := response.Books[4].Book.Image
+	if cover.URL != "http://example.com/img/placeholder/1896516.svg" || !cover.IsPlaceholder {
+		t.Errorf("expected an absolute placeholder URL, got %+v", cover)
+	}
+
+	w = getPlaceholder("1896516.svg", "")
+	if ct := w.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("expected image/svg+xml, got %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "Irani Cafe") {
+		t.Errorf("expected the title in the placeholder, got %s", w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != fmt.Sprintf("public, max-age=%d", coverMaxAge) {
+		t.Errorf("expected long max-age once the book is known, got %q", cc)
+	}
+
+	w = getPlaceholder("1896516.png", "?w=120")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("expected PNG placeholder, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("failed to decode PNG placeholder: %v", err)
+	}
+	if got := img.Bounds().Size(); got != (image.Point{120, 180}) {
+		t.Errorf("expected a 120x180 placeholder, got %v", got)
+	}
+	known, _ := server.covers.placeholder(1896516)
+	if _, found := blobs.Get(fmt.Sprintf("placeholder_1896516_120_%s_%s", known.Title, known.Author)); !found {
+		t.Error("expected the PNG of a known book to be cached")
+	}
+
+	for _, file := range []string{"abc.svg", "1896516.gif", "0.svg", "1896516"} {
+		if w := getPlaceholder(file, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", file, w.Code)
+		}
+	}
+	if w := getPlaceholder("1896516.png", "?w=abc"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid width, got %d", w.Code)
+	}
+}
+
+func TestCoverIndexPrunes(t *testing.T) {
+	index := newCoverIndex()
+	index.maxBooks = 10
+
+	for id := 1; id <= 25; id++ {
+		index.record(&hardcover.UserBooksResponse{Books: []hardcover.UserBook{{
+			Book: hardcover.Book{ID: id, Image: &hardcover.Image{URL: fmt.Sprintf("https://assets.hardcover.app/%d.jpg", id)}},
+		}}})
+	}
+
+	if len(index.books) > index.maxBooks {
+		t.Errorf("expected at most %d books, got %d", index.maxBooks, len(index.books))
+	}
+	if _, ok := index.get(25); !ok {
+		t.Error("expected the latest book to be kept")
+	}
+	if _, ok := index.get(1); ok {
+		t.Error("expected the first book to be forgotten")
+	}
+}
+
+func TestCoverAnalysis(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	fetcher := images.NewFetcherWithHTTPClient(cache.NewBlobCache(time.Minute, 1<<20), &mockImageHTTPClient{})
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins,
+		WithImageFetcher(fetcher), WithImageAnalyzer(images.NewAnalyzer(fetcher, 1, 10)))
+
+	var lastModified string
+	getBooks := func() *hardcover.UserBooksResponse {
+		req := httptest.NewRequest("GET", "/api/books/currently-reading/testuser", nil)
+		req.SetPathValue("username", "testuser")
+		w := httptest.NewRecorder()
+		server.HandleUserCurrentlyReading(w, req)
+		lastModified = w.Header().Get("Last-Modified")
+
+		var response hardcover.UserBooksResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return &response
+	}
+
+	// The first response never waits for covers to be analyzed
+	start := time.Now().Truncate(time.Second)
+	books := getBooks()
+	if lastModified != "Fri, 11 Jul 2025 07:12:20 GMT" {
+		t.Errorf("expected Last-Modified from the response's updated_at, got %q", lastModified)
+	}
+	if books.Books[0].Book.Image.BlurHash != "" {
+		t.Errorf("expected no BlurHash before analysis, got %q", books.Books[0].Book.Image.BlurHash)
+	}
+	// Placeholders know their color up front
+	if got := books.Books[4].Book.Image.DominantColor; got == "" {
+		t.Error("expected a dominant color for the placeholder cover")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for books.Books[0].Book.Image.BlurHash == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		books = getBooks()
+	}
+
+	cover := books.Books[0].Book.Image
+	if cover.BlurHash == "" {
+		t.Fatal("expected a BlurHash once the cover was analyzed")
+	}
+	// The mock cover is a single transparent black pixel
+	if cover.DominantColor != "#000000" {
+		t.Errorf("expected dominant color #000000, got %q", cover.DominantColor)
+	}
+	// Annotating covers changes the body, so Last-Modified moves with it
+	if modified, err := http.ParseTime(lastModified); err != nil || modified.Before(start) {
+		t.Errorf("expected Last-Modified from the cover analysis, got %q", lastModified)
+	}
+}
+
+func TestLinkTemplates(t *testing.T) {
+	templates, err := links.Parse([]byte(`{
+		"templates": {"bookshop": "https://bookshop.org/a/12345/{isbn}"},
+		"users": {"testuser": {"blog": "https://example.com/reviews/{slug}"}}
+	}`))
+	if err != nil {
+		t.Fatalf("failed to parse link templates: %v", err)
+	}
+	server := NewServer(hardcover.NewMockClient(), cache.NewMemoryCache(5*time.Minute), allOrigins, WithLinkTemplates(templates))
+
+	req := httptest.NewRequest("GET", "/api/books/currently-reading/testuser", nil)
+	req.SetPathValue("username", "testuser")
+	w := httptest.NewRecorder()
+	server.HandleUserCurrentlyReading(w, req)
+
+	var response hardcover.UserBooksResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	got := response.Books[0].Links
+	want := map[string]string{
+		"hardcover": "https://hardcover.app/books/shakespeare-the-world-as-stage",
+		"bookshop":  "https://bookshop.org/a/12345/9780007197903",
+		"blog":      "https://example.com/reviews/shakespeare-the-world-as-stage",
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected links %v, got %v", want, got)
+	}
+	for name, link := range want {
+		if got[name] != link {
+			t.Errorf("link %s: expected %q, got %q", name, link, got[name])
+		}
+	}
+
+	// Books without an ISBN have no bookshop link
+	if _, ok := response.Books[1].Links["bookshop"]; ok {
+		t.Errorf("expected no bookshop link without an ISBN, got %v", response.Books[1].Links)
+	}
+}
+
+func TestHandleClick(t *testing.T) {
+	templates, err := links.Parse([]byte(`{"templates": {"bookshop": "https://bookshop.org/a/12345/{isbn}"}}`))
+	if err != nil {
+		t.Fatalf("failed to parse link templates: %v", err)
+	}
+	server := NewServer(hardcover.NewMockClient(), cache.NewMemoryCache(5*time.Minute), allOrigins, WithLinkTemplates(templates))
+
+	click := func(shelf, username, bookID, query, referer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/r/"+shelf+"/"+username+"/"+bookID+query, nil)
+		req.SetPathValue("shelf", shelf)
+		req.SetPathValue("username", username)
+		req.SetPathValue("bookID", bookID)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		w := httptest.NewRecorder()
+		server.HandleClick(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		shelf    string
+		bookID   string
+		query    string
+		status   int
+		location string
+	}{
+		{"default link", "currently-reading", "386725", "", http.StatusFound, "https://hardcover.app/books/shakespeare-the-world-as-stage"},
+		{"named link", "currently-reading", "386725", "?link=bookshop", http.StatusFound, "https://bookshop.org/a/12345/9780007197903"},
+		{"book without the link", "currently-reading", "1946043", "?link=bookshop", http.StatusNotFound, ""},
+		{"review link", "reviews", "3", "?link=review", http.StatusFound, "https://hardcover.app/books/mock-reviewed-book/reviews/@testuser"},
+		{"book not on the shelf", "currently-reading", "999", "", http.StatusNotFound, ""},
+		{"unknown shelf", "want-to-read", "386725", "", http.StatusNotFound, ""},
+		{"invalid book ID", "currently-reading", "abc", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := click(tt.shelf, "testuser", tt.bookID, tt.query, "https://blog.example.com/reading?x=1")
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("expected Location %q, got %q", tt.location, got)
+			}
+		})
+	}
+
+	click("currently-reading", "TestUser", "386725", "", "")
+
+	stats := httptest.NewRecorder()
+	server.HandleClickStats(stats, httptest.NewRequest("GET", "/clicks", nil))
+
+	var counts []clickCount
+	if err := json.NewDecoder(stats.Body).Decode(&counts); err != nil {
+		t.Fatalf("failed to decode click stats: %v", err)
+	}
+	want := []clickCount{
+		{clickKey{Shelf: "currently-reading", Username: "testuser", BookID: 386725, Origin: "https://blog.example.com"}, 2},
+		{clickKey{Shelf: "currently-reading", Username: "testuser", BookID: 386725, Origin: "none"}, 1},
+		{clickKey{Shelf: "reviews", Username: "testuser", BookID: 3, Origin: "https://blog.example.com"}, 1},
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("expected %d click counts, got %+v", len(want), counts)
+	}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Errorf("click count %d: expected %+v, got %+v", i, want[i], counts[i])
+		}
+	}
+}
+
+func TestImpressions(t *testing.T) {
+	impressions := NewImpressions()
+	server := NewServer(hardcover.NewMockClient(), cache.NewMemoryCache(5*time.Minute), allOrigins, WithImpressions(impressions))
+
+	load := func(username string, headers map[string]string) {
+		req := httptest.NewRequest("GET", "/api/books/currently-reading/"+username, nil)
+		req.SetPathValue("username", username)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		server.HandleUserCurrentlyReading(httptest.NewRecorder(), req)
+	}
+
+	load("testuser", map[string]string{"Origin": "https://Blog.example.com"})
+	load("TestUser", map[string]string{"Referer": "https://blog.example.com/reading/list?ref=1"})
+	load("testuser", nil)
+	// The widget inside our own embed page was counted with the page
+	load("testuser", map[string]string{"Referer": "http://example.com/static/embed.html?username=testuser"})
+
+	summary := impressions.Summary()
+	want := []impressionCount{
+		{impressionKey{Origin: "https://blog.example.com", Shelf: "currently-reading", Username: "testuser"}, 2},
+		{impressionKey{Origin: "none", Shelf: "currently-reading", Username: "testuser"}, 1},
+	}
+	if summary.Total != 3 || len(summary.Embeds) != len(want) {
+		t.Fatalf("unexpected impressions: %+v", summary)
+	}
+	for i := range want {
+		if summary.Embeds[i] != want[i] {
+			t.Errorf("embed %d: expected %+v, got %+v", i, want[i], summary.Embeds[i])
+		}
+	}
+
+	w := httptest.NewRecorder()
+	impressions.HandleSummary(w, httptest.NewRequest("GET", "/impressions", nil))
+	var decoded ImpressionSummary
+	if err := json.NewDecoder(w.Body).Decode(&decoded); err != nil {
+		t.Fatalf("failed to decode impression summary: %v", err)
+	}
+	if decoded.ByOrigin["https://blog.example.com"] != 2 {
+		t.Errorf("unexpected summary JSON: %+v", decoded)
+	}
+}
+
+func TestLabelSet(t *testing.T) {
+	labels := newLabelSet(2)
+	for _, tt := range []struct{ value, want string }{
+		{"a", "a"}, {"b", "b"}, {"c", "other"}, {"a", "a"},
+	} {
+		if got := labels.label(tt.value); got != tt.want {
+			t.Errorf("label(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCSPReports(t *testing.T) {
+	reports := NewCSPReports()
+	framing := metrics.CSPViolationsTotal.WithLabelValues("frame-ancestors", "https://evil.example")
+	scripts := metrics.CSPViolationsTotal.WithLabelValues("script-src-elem", "https://cdn.example")
+	framingBefore, scriptsBefore := testutil.ToFloat64(framing), testutil.ToFloat64(scripts)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    int
+	}{
+		{
+			name:        "report-uri report",
+			contentType: "application/csp-report",
+			body:        `{"csp-report":{"document-uri":"https://embed.example/static/embed.html?username=alice","blocked-uri":"https://evil.example/page","violated-directive":"frame-ancestors https://example.com"}}`,
+			expected:    http.StatusNoContent,
+		},
+		{
+			name:        "Reporting API batch",
+			contentType: "application/reports+json",
+			body:        `[{"type":"csp-violation","body":{"documentURL":"https://embed.example/static/embed.html","blockedURL":"https://cdn.example/x.js","effectiveDirective":"script-src-elem"}},{"type":"deprecation","body":{}}]`,
+			expected:    http.StatusNoContent,
+		},
+		{name: "invalid JSON", contentType: "application/csp-report", body: "{", expected: http.StatusBadRequest},
+		{
+			name:        "oversized report",
+			contentType: "application/csp-report",
+			body:        `{"csp-report":{"blocked-uri":"` + strings.Repeat("a", maxCSPReportSize) + `"}}`,
+			expected:    http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", CSPReportPath, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			reports.Handle(w, req)
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(framing) - framingBefore; got != 1 {
+		t.Errorf("expected 1 framing violation, got %v", got)
+	}
+	if got := testutil.ToFloat64(scripts) - scriptsBefore; got != 1 {
+		t.Errorf("expected 1 script violation, got %v", got)
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	origins, err := ParseAllowedOrigins("https://example.com, https://*.preview.example.com,http://localhost:*, https://app.example.com:8443, ~https://pr-[0-9]+\\.review\\.example\\.org")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://example.com", true},
+		{"https://EXAMPLE.com:443", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"https://evil-example.com", false},
+		{"https://pr-123.preview.example.com", true},
+		{"https://a.b.preview.example.com", true},
+		{"https://preview.example.com", false},
+		{"https://pr-123.preview.example.com.evil.net", false},
+		{"http://localhost:3000", true},
+		{"http://localhost", true},
+		{"https://localhost:3000", false},
+		{"https://app.example.com:8443", true},
+		{"https://app.example.com", false},
+		{"https://pr-42.review.example.org", true},
+		{"https://pr-42.review.example.org.evil.net", false},
+		{"https://pr-x.review.example.org", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := origins.Allows(tt.origin); got != tt.want {
+			t.Errorf("Allows(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	sources, skipped := origins.FrameAncestors()
+	if got := strings.Join(sources, " "); got != "https://example.com https://*.preview.example.com http://localhost:* https://app.example.com:8443" {
+		t.Errorf("unexpected frame ancestors: %q", got)
+	}
+	if len(skipped) != 1 {
+		t.Errorf("expected the regular expression to be skipped, got %q", skipped)
+	}
+
+	for _, list := range []string{"example.com", "ftp://example.com", "https://example.com/path", "https://ex*.com", "~(", "https://example.com:"} {
+		if _, err := ParseAllowedOrigins(list); err == nil {
+			t.Errorf("expected an error for %q", list)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	origins, err := ParseAllowedOrigins("https://example.com,https://*.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), origins)
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantStatus int
+		wantACAO   string
+	}{
+		{name: "allowed origin", method: "GET", origin: "https://example.com", wantStatus: http.StatusOK, wantACAO: "https://example.com"},
+		{name: "allowed subdomain", method: "GET", origin: "https://pr-1.example.com", wantStatus: http.StatusOK, wantACAO: "https://pr-1.example.com"},
+		// Browsers enforce CORS on simple requests themselves
+		{name: "disallowed origin", method: "GET", origin: "https://evil.net", wantStatus: http.StatusOK},
+		{name: "no origin", method: "GET", wantStatus: http.StatusOK},
+		{name: "allowed preflight", method: "OPTIONS", origin: "https://blog.example.com", wantStatus: http.StatusOK, wantACAO: "https://blog.example.com"},
+		{name: "disallowed preflight", method: "OPTIONS", origin: "https://evil.net", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/books/currently-reading/alice", nil)
+			req.SetPathValue("username", "alice")
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			server.HandleUserCurrentlyReading(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantACAO {
+				t.Errorf("expected Access-Control-Allow-Origin %q, got %q", tt.wantACAO, got)
+			}
+			if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Origin") {
+				t.Errorf("expected Vary to include Origin, got %v", w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestUsernameOrigins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "username-origins.json")
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("failed to write username origins: %v", err)
+		}
+	}
+	write(`{"Alice": ["https://alice.example", "https://*.alice.example"]}`)
+	bindings, err := LoadUsernameOrigins(path)
+	if err != nil {
+		t.Fatalf("failed to load username origins: %v", err)
+	}
+
+	request := func(header, value string) *http.Request {
+		req := httptest.NewRequest("GET", "http://embed.example/api/books/last-read/alice", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return req
+	}
+	tests := []struct {
+		name     string
+		req      *http.Request
+		username string
+		want     bool
+	}{
+		{name: "bound origin", req: request("Origin", "https://alice.example"), username: "alice", want: true},
+		{name: "bound subdomain", req: request("Origin", "https://blog.alice.example"), username: "ALICE", want: true},
+		{name: "other origin", req: request("Origin", "https://hotlink.example"), username: "alice", want: false},
+		{name: "other referer", req: request("Referer", "https://hotlink.example/page"), username: "alice", want: false},
+		{name: "no origin", req: request("", ""), username: "alice", want: true},
+		{name: "opaque origin", req: request("Origin", "null"), username: "alice", want: false},
+		{name: "own embed page", req: request("Origin", "https://embed.example"), username: "alice", want: true},
+		{name: "unbound username", req: request("Origin", "https://hotlink.example"), username: "bob", want: true},
+	}
+	for _, tt := range tests {
+		if got := bindings.Allows(tt.req, tt.username); got != tt.want {
+			t.Errorf("%s: Allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Reloading picks up new bindings, and keeps the old ones on error
+	write(`{"bob": ["https://bob.example"]}`)
+	if err := bindings.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if bindings.Bound("alice") || !bindings.Bound("bob") {
+		t.Errorf("expected only bob to be bound after reload")
+	}
+	for _, data := range []string{`{`, `{"bad user": ["https://example.com"]}`, `{"bob": []}`, `{"bob": ["example.com"]}`} {
+		write(data)
+		if err := bindings.Reload(); err == nil {
+			t.Errorf("expected an error reloading %s", data)
+		}
+	}
+	if !bindings.Bound("bob") {
+		t.Errorf("expected bob to stay bound after failed reloads")
+	}
+
+	var unbound *UsernameOrigins
+	if unbound.Bound("alice") || !unbound.Allows(request("Origin", "https://hotlink.example"), "alice") {
+		t.Errorf("expected a nil UsernameOrigins to bind no one")
+	}
+}
+
+func TestHandleShelfUsernameOrigins(t *testing.T) {
+	mockClient := hardcover.NewMockClient()
+	bindings := newUsernameOrigins(t, `{"alice": ["https://alice.example"]}`)
+	server := NewServer(mockClient, cache.NewMemoryCache(5*time.Minute), allOrigins, WithUsernameOrigins(bindings))
+	denials := metrics.OriginDenialsTotal.WithLabelValues("last-read", "other", "https://hotlink.example")
+	before := testutil.ToFloat64(denials)
+
+	get := func(username, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/books/last-read/"+username, nil)
+		req.SetPathValue("username", username)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		server.HandleUserLastRead(w, req)
+		return w
+	}
+
+	w := get("alice", "https://hotlink.example")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+	var body struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != "origin_not_allowed" {
+		t.Errorf("expected a JSON origin_not_allowed error, got %s", w.Body.String())
+	}
+	if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Origin") {
+		t.Errorf("expected Vary to include Origin, got %v", w.Header().Values("Vary"))
+	}
+	if got := testutil.ToFloat64(denials) - before; got != 1 {
+		t.Errorf("expected 1 denial, got %v", got)
+	}
+	// Denied requests don't reach Hardcover
+	if len(mockClient.GetLastReadBooksCalls) != 0 {
+		t.Errorf("expected no Hardcover calls for a denied request, got %v", mockClient.GetLastReadBooksCalls)
+	}
+
+	if w := get("alice", "https://alice.example"); w.Code != http.StatusOK {
+		t.Errorf("expected the bound origin to get 200, got %d", w.Code)
+	}
+	// Sandboxed frames on any site send Origin: null, and no Referer with
+	// no-referrer
+	if w := get("alice", "null"); w.Code != http.StatusForbidden {
+		t.Errorf("expected an opaque origin to get 403, got %d", w.Code)
+	}
+	if w := get("bob", "https://hotlink.example"); w.Code != http.StatusOK {
+		t.Errorf("expected an unbound username to get 200, got %d", w.Code)
+	}
+
+	// Preview images and click redirects are bound too
+	og := httptest.NewRequest("GET", "/og/last-read/alice.png", nil)
+	og.SetPathValue("shelf", "last-read")
+	og.SetPathValue("username", "alice.png")
+	og.Header.Set("Referer", "https://hotlink.example/page")
+	w = httptest.NewRecorder()
+	server.HandleOGImage(w, og)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a hotlinked preview image to get 403, got %d", w.Code)
+	}
+
+	click := httptest.NewRequest("GET", "/r/last-read/alice/1", nil)
+	click.SetPathValue("shelf", "last-read")
+	click.SetPathValue("username", "alice")
+	click.SetPathValue("bookID", "1")
+	click.Header.Set("Referer", "https://hotlink.example/page")
+	w = httptest.NewRecorder()
+	server.HandleClick(w, click)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a click from another site to get 403, got %d", w.Code)
+	}
+	if len(mockClient.GetLastReadBooksCalls) != 2 {
+		t.Errorf("expected denied requests not to reach Hardcover, got %v", mockClient.GetLastReadBooksCalls)
+	}
+}
+
+func TestEmbedTokens(t *testing.T) {
+	tokens, err := NewEmbedTokens([]byte(strings.Repeat("s", MinTokenSecretSize)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewEmbedTokens([]byte("short")); err == nil {
+		t.Errorf("expected a short secret to be refused")
+	}
+	now := time.Now()
+	tokens.now = func() time.Time { return now }
+
+	mint := func(tok EmbedToken) string {
+		t.Helper()
+		token, err := tokens.Mint(tok)
+		if err != nil {
+			t.Fatalf("failed to mint token: %v", err)
+		}
+		return token
+	}
+	expires := now.Add(time.Hour).Unix()
+	alice := mint(EmbedToken{Username: "Alice", Origin: "https://alice.example", Expires: expires})
+	aliceReviews := mint(EmbedToken{Username: "alice", Shelf: "reviews", Origin: "*", Expires: expires})
+
+	for _, tok := range []EmbedToken{
+		{Username: "bad user", Origin: "*", Expires: expires},
+		{Username: "alice", Shelf: "wishlist", Origin: "*", Expires: expires},
+		{Username: "alice", Expires: expires},
+		{Username: "alice", Origin: "https://a.example,https://b.example", Expires: expires},
+		{Username: "alice", Origin: "*", Expires: now.Unix()},
+	} {
+		if _, err := tokens.Mint(tok); err == nil {
+			t.Errorf("expected an error minting %+v", tok)
+		}
+	}
+
+	tampered := strings.Replace(alice, ".", ".x", 1)
+	otherSecret, _ := NewEmbedTokens([]byte(strings.Repeat("o", MinTokenSecretSize)))
+	forged, _ := otherSecret.Mint(EmbedToken{Username: "alice", Origin: "*", Expires: expires})
+
+	tests := []struct {
+		name   string
+		shelf  string
+		token  string
+		origin string
+		want   error
+	}{
+		{name: "valid", shelf: "last-read", token: alice, origin: "https://alice.example", want: nil},
+		{name: "no origin", shelf: "last-read", token: alice, want: nil},
+		{name: "own embed page", shelf: "last-read", token: alice, origin: "http://example.com", want: nil},
+		{name: "any origin", shelf: "reviews", token: aliceReviews, origin: "https://elsewhere.example", want: nil},
+		{name: "missing", shelf: "last-read", origin: "https://alice.example", want: errTokenMissing},
+		{name: "malformed", shelf: "last-read", token: "v1.abc", want: errTokenMalformed},
+		{name: "tampered", shelf: "last-read", token: tampered, want: errTokenSignature},
+		{name: "other secret", shelf: "last-read", token: forged, want: errTokenSignature},
+		{name: "wrong shelf", shelf: "last-read", token: aliceReviews, want: errTokenShelf},
+		{name: "wrong origin", shelf: "last-read", token: alice, origin: "https://hotlink.example", want: errTokenOrigin},
+		{name: "opaque origin", shelf: "last-read", token: alice, origin: "null", want: errTokenOrigin},
+		{name: "opaque origin, any origin", shelf: "reviews", token: aliceReviews, origin: "null", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/api/books/"+tt.shelf+"/alice?token="+tt.token, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if _, err := tokens.authorize(req, tt.shelf, "alice"); err != tt.want {
+				t.Errorf("authorize = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/books/last-read/bob?token="+alice, nil)
+	if _, err := tokens.authorize(req, "last-read", "bob"); err != errTokenUsername {
+		t.Errorf("expected a token for another username to be refused, got %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := tokens.Verify(alice); err != errTokenExpired {
+		t.Errorf("expected an expired token to be refused, got %v", err)
+	}
+}
+
+func TestEmbedTokenMiddleware(t *testing.T) {
+	tokens, err := NewEmbedTokens([]byte(strings.Repeat("s", MinTokenSecretSize)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := tokens.Mint(EmbedToken{Username: "alice", Origin: "https://alice.example", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("failed to mint token: %v", err)
+	}
+	server := NewServer(hardcover.NewMockClient(), cache.NewMemoryCache(5*time.Minute), allOrigins)
+
+	get := func(tokens *EmbedTokens, method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetPathValue("username", strings.TrimPrefix(strings.Split(path, "?")[0], "/api/books/last-read/"))
+		req.Header.Set("Origin", "https://alice.example")
+		w := httptest.NewRecorder()
+		tokens.Middleware("last-read")(server.HandleUserLastRead)(w, req)
+		return w
+	}
+
+	if w := get(tokens, "GET", "/api/books/last-read/alice.json?token="+token); w.Code != http.StatusOK {
+		t.Errorf("expected a valid token to get 200, got %d", w.Code)
+	}
+	if w := get(tokens, "OPTIONS", "/api/books/last-read/alice"); w.Code != http.StatusOK {
+		t.Errorf("expected preflights to pass without a token, got %d", w.Code)
+	}
+	if w := get(nil, "GET", "/api/books/last-read/alice"); w.Code != http.StatusOK {
+		t.Errorf("expected no token to be needed without a secret, got %d", w.Code)
+	}
+
+	w := get(tokens, "GET", "/api/books/last-read/alice")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != "invalid_token" {
+		t.Errorf("expected a JSON invalid_token error, got %s", w.Body.String())
+	}
+
+	// Preview images and click redirects take the shelf from their path
+	getPath := func(path, shelf, username string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetPathValue("shelf", shelf)
+		req.SetPathValue("username", username)
+		w := httptest.NewRecorder()
+		tokens.Middleware("")(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})(w, req)
+		return w.Code
+	}
+	if code := getPath("/og/last-read/alice.png?token="+token, "last-read", "alice.png"); code != http.StatusOK {
+		t.Errorf("expected a preview image with a valid token to get 200, got %d", code)
+	}
+	if code := getPath("/og/last-read/alice.png", "last-read", "alice.png"); code != http.StatusUnauthorized {
+		t.Errorf("expected a preview image without a token to get 401, got %d", code)
+	}
+	if code := getPath("/r/reviews/bob/1?token="+token, "reviews", "bob"); code != http.StatusUnauthorized {
+		t.Errorf("expected a click for another username to get 401, got %d", code)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, list := range []string{"10.0.0.0/33", "proxy.internal"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("expected an error for %q", list)
+		}
+	}
+
+	// One request a second, in bursts of two
+	allowed, err := ParseAllowedOrigins("https://*.example, https://alice.blog")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	limiter := NewRateLimiter(WithIPLimit(60, 2), WithOriginLimit(60, 3, allowed), WithTrustedProxies(trusted))
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	handler := limiter.Middleware("last-read")(ok)
+
+	get := func(remoteAddr, forwardedFor, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://embed.example/api/books/last-read/alice", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	for i := range 2 {
+		if w := get("203.0.113.1:1234", "", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	w := get("203.0.113.1:1234", "", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected 429 with Retry-After 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error != "rate_limited" {
+		t.Errorf("expected a JSON rate_limited error, got %s", w.Body.String())
+	}
+
+	// Other clients have their own buckets, and an untrusted connection
+	// can't choose its address through X-Forwarded-For
+	if w := get("203.0.113.2:1234", "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected another IP to get 200, got %d", w.Code)
+	}
+	if w := get("203.0.113.1:1234", "198.51.100.7", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected X-Forwarded-For from an untrusted client to be ignored, got %d", w.Code)
+	}
+	// Through trusted proxies, the client is the last untrusted hop
+	for i := range 2 {
+		if w := get("10.1.2.3:80", "203.0.113.1, 198.51.100.7, 10.9.9.9", ""); w.Code != http.StatusOK {
+			t.Fatalf("proxied request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	if w := get("192.168.1.1:80", "203.0.113.9, 198.51.100.7", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 198.51.100.7 to be limited through any proxy, got %d", w.Code)
+	}
+	// IPv6 clients share a bucket per /64
+	get("[2001:db8::1]:443", "", "")
+	get("[2001:db8::2]:443", "", "")
+	if w := get("[2001:db8::3]:443", "", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected addresses in a /64 to share a bucket, got %d", w.Code)
+	}
+
+	// Origins are limited across client IPs, but refused requests don't
+	// count against their IP
+	for i, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		if w := get(ip+":1", "", "https://scraper.example"); w.Code != http.StatusOK {
+			t.Fatalf("origin request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	if w := get("198.51.100.4:1", "", "https://scraper.example"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the origin to be limited, got %d", w.Code)
+	}
+	if w := get("198.51.100.4:1", "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected the refused request not to count against its IP, got %d", w.Code)
+	}
+	if w := get("198.51.100.5:1", "", "http://embed.example"); w.Code != http.StatusOK {
+		t.Errorf("expected our own embed pages not to be limited by origin, got %d", w.Code)
+	}
+
+	// Origins that aren't allowed share one bucket, so made-up origins
+	// neither get fresh buckets nor crowd out the allowed ones
+	for i := range 1000 {
+		get(fmt.Sprintf("192.0.2.%d:1", i%250), "", fmt.Sprintf("https://random-%d.invalid", i))
+	}
+	limiter.mu.Lock()
+	origins := len(limiter.origins.buckets)
+	limiter.mu.Unlock()
+	if origins != 2 {
+		t.Errorf("expected buckets only for scraper.example and the unknown origins, got %d", origins)
+	}
+	for i := range 3 {
+		if w := get(fmt.Sprintf("198.51.100.%d:1", 10+i), "", "https://alice.blog"); w.Code != http.StatusOK {
+			t.Errorf("allowed origin request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+	if w := get("198.51.100.20:1", "", "https://random-1001.invalid"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected unknown origins to share a limited bucket, got %d", w.Code)
+	}
+
+	// Buckets refill, and idle ones are evicted
+	now = now.Add(time.Second)
+	if w := get("203.0.113.1:1234", "", ""); w.Code != http.StatusOK {
+		t.Errorf("expected a refilled bucket to get 200, got %d", w.Code)
+	}
+	now = now.Add(bucketIdleTimeout)
+	get("203.0.113.1:1234", "", "")
+	limiter.mu.Lock()
+	ips := len(limiter.ips.buckets)
+	limiter.mu.Unlock()
+	if ips != 1 {
+		t.Errorf("expected idle buckets to be evicted, %d left", ips)
+	}
+
+	var unlimited *RateLimiter
+	w = httptest.NewRecorder()
+	unlimited.Middleware("last-read")(ok)(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a nil RateLimiter to limit nothing, got %d", w.Code)
+	}
+}
+
+func TestRateLimiterCORS(t *testing.T) {
+	allowed, err := ParseAllowedOrigins("https://alice.blog")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	get := func(handler http.HandlerFunc, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/books/last-read/alice", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name        string
+		origins     *AllowedOrigins
+		origin      string
+		allowOrigin string
+	}{
+		{"allowed origin", allowed, "https://alice.blog", "https://alice.blog"},
+		{"other origin", allowed, "https://scraper.example", ""},
+		{"any origin", allOrigins, "https://scraper.example", "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewRateLimiter(WithIPLimit(60, 1), WithCORSOrigins(tt.origins)).Middleware("last-read")(ok)
+			get(handler, tt.origin)
+			w := get(handler, tt.origin)
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected 429, got %d", w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("expected Access-Control-Allow-Origin %q, got %q", tt.allowOrigin, got)
+			}
+			if got := w.Header().Get("Access-Control-Expose-Headers"); got != "Retry-After" {
+				t.Errorf("expected Retry-After to be exposed, got %q", got)
+			}
+			if vary := w.Header().Get("Vary"); (vary == "Origin") == tt.origins.AllowsAny() {
+				t.Errorf("expected Vary: Origin unless any origin is allowed, got %q", vary)
+			}
+		})
+	}
+}
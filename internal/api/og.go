@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/ogimage"
+	"github.com/gouthamve/hardcover-book-embed/internal/placeholder"
+)
+
+// ogCoverTimeout bounds how long we wait for covers before drawing placeholders
+const ogCoverTimeout = 5 * time.Second
+
+// ogPlaceholderWidth is the width placeholder covers are drawn at before
+// being scaled onto the card
+const ogPlaceholderWidth = 240
+
+// ogHeading is the heading drawn on the preview image for a shelf
+func ogHeading(sh shelf) string {
+	return sh.title + " on Hardcover"
+}
+
+// HandleOGImage serves a 1200x630 PNG preview of a user's shelf for social
+// media link previews
+func (s *Server) HandleOGImage(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.PathValue("shelf")
+	sh, ok := shelves[endpoint]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	username, ok := strings.CutSuffix(r.PathValue("username"), ".png")
+	if !ok || username == "" || !isValidUsername(username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+
+	// Link preview crawlers send no Referer, but pages showing the image do
+	if !s.usernameOrigins.Allows(r, username) {
+		s.usernameOrigins.deny(w, r, endpoint, username)
+		return
+	}
+
+	books, err := s.userBooks(endpoint, username)
+	if err != nil {
+		log.Printf("Error fetching %s for user %s: %v", endpoint, username, err)
+		http.Error(w, "Failed to fetch books", http.StatusInternalServerError)
+		return
+	}
+
+	// Keying on the response timestamp means a refreshed shelf gets a fresh image
+	cacheKey := fmt.Sprintf("og_%s_%s_%d", endpoint, username, books.UpdatedAt.UnixNano())
+
+	var data []byte
+	if cached, found := s.blobs.Get(cacheKey); found {
+		data = cached.Data
+	} else {
+		data, err = s.renderOGImage(r.Context(), ogHeading(sh), username, books)
+		if err != nil {
+			log.Printf("Error rendering preview image for user %s: %v", username, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.blobs.Set(cacheKey, data, "image/png")
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+
+	w.Header().Set("Content-Type", "image/png")
+	// The image is rerendered once the shelf it was drawn from expires
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.shelfMaxAge(endpoint, username).Seconds())))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing preview image: %v", err)
+	}
+}
+
+// renderOGImage loads covers for the first books on the shelf and draws the card
+func (s *Server) renderOGImage(ctx context.Context, heading, username string, books *hardcover.UserBooksResponse) ([]byte, error) {
+	shown := books.Books
+	if len(shown) > ogimage.MaxCovers {
+		shown = shown[:ogimage.MaxCovers]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ogCoverTimeout)
+	defer cancel()
+
+	card := ogimage.Card{
+		Heading:  heading,
+		Username: username,
+		Titles:   make([]string, len(shown)),
+		Covers:   make([]image.Image, len(shown)),
+	}
+
+	var wg sync.WaitGroup
+	for i, book := range shown {
+		card.Titles[i] = book.Book.Title
+		if book.Book.Image == nil || book.Book.Image.URL == "" {
+			continue
+		}
+		if book.Book.Image.IsPlaceholder {
+			cover, err := placeholder.Image(placeholderCover(book), ogPlaceholderWidth)
+			if err != nil {
+				log.Printf("Error drawing placeholder cover for book %d: %v", book.Book.ID, err)
+				continue
+			}
+			card.Covers[i] = cover
+			continue
+		}
+		wg.Add(1)
+		go func(i int, imageURL string) {
+			defer wg.Done()
+			cover, err := s.images.Decode(ctx, imageURL)
+			if err != nil {
+				log.Printf("Error fetching cover %s: %v", imageURL, err)
+				return
+			}
+			card.Covers[i] = cover
+		}(i, book.Book.Image.URL)
+	}
+	wg.Wait()
+
+	return ogimage.Render(card)
+}
+
+// ogMeta describes an embed page in Open Graph and Twitter card tags
+type ogMeta struct {
+	Title    string
+	ImageURL string
+	Width    int
+	Height   int
+}
+
+// embedOGMeta returns the Open Graph description of an embed page for
+// endpoint and username, or nil if there is none. baseURL is the absolute
+// origin of this server. The page's embed token, if any, is passed on to
+// the image.
+func embedOGMeta(baseURL, endpoint, username, token string) *ogMeta {
+	sh, ok := shelves[endpoint]
+	if !ok || !isValidUsername(username) {
+		return nil
+	}
+
+	imageURL := fmt.Sprintf("%s/og/%s/%s.png", baseURL, endpoint, url.PathEscape(username))
+	if token != "" {
+		imageURL += "?token=" + url.QueryEscape(token)
+	}
+	return &ogMeta{
+		Title:    fmt.Sprintf("@%s · %s", username, ogHeading(sh)),
+		ImageURL: imageURL,
+		Width:    ogimage.Width,
+		Height:   ogimage.Height,
+	}
+}
+
+// requestBaseURL reconstructs the scheme and host the client used to reach
+// us, honouring X-Forwarded-Proto from a TLS-terminating proxy
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// originRule matches the origins of one ALLOWED_ORIGINS entry
+type originRule struct {
+	scheme string
+	// host is the exact host, or for a wildcard rule the domain whose
+	// subdomains match
+	host     string
+	wildcard bool
+	// port is the port, "" for the scheme's default, or "*" for any
+	port string
+	// pattern, when set, is matched against the whole origin instead
+	pattern *regexp.Regexp
+	// source is the entry as configured
+	source string
+}
+
+// AllowedOrigins are the origins allowed to call the API cross-origin. A nil
+// AllowedOrigins allows none.
+type AllowedOrigins struct {
+	any   bool
+	rules []originRule
+}
+
+// ParseAllowedOrigins parses a comma-separated list of origin rules:
+//
+//   - * allows any origin
+//   - https://example.com allows exactly that origin; ports other than the
+//     scheme's default must be given, as in http://localhost:8080
+//   - https://*.example.com allows any subdomain of example.com, but not
+//     example.com itself
+//   - http://localhost:* allows any port
+//   - ~regexp allows origins the regular expression matches in full, such as
+//     ~https://pr-[0-9]+\.preview\.example\.com
+//
+// Regular expressions can't contain commas.
+func ParseAllowedOrigins(list string) (*AllowedOrigins, error) {
+	origins := &AllowedOrigins{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			origins.any = true
+		case strings.HasPrefix(entry, "~"):
+			pattern, err := regexp.Compile(`^(?:` + entry[1:] + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed origin %q: %w", entry, err)
+			}
+			origins.rules = append(origins.rules, originRule{pattern: pattern, source: entry})
+		default:
+			rule, err := parseOriginRule(entry)
+			if err != nil {
+				return nil, err
+			}
+			origins.rules = append(origins.rules, rule)
+		}
+	}
+	return origins, nil
+}
+
+// parseOriginRule parses an exact or wildcard origin rule
+func parseOriginRule(entry string) (originRule, error) {
+	rule := originRule{source: entry}
+	scheme, rest, ok := strings.Cut(entry, "://")
+	if !ok {
+		return rule, fmt.Errorf("invalid allowed origin %q: must include the scheme, as in https://example.com", entry)
+	}
+	rule.scheme = strings.ToLower(scheme)
+	if rule.scheme != "http" && rule.scheme != "https" {
+		return rule, fmt.Errorf("invalid allowed origin %q: scheme must be http or https", entry)
+	}
+	rest = strings.TrimSuffix(rest, "/")
+	if strings.ContainsAny(rest, "/?#@") {
+		return rule, fmt.Errorf("invalid allowed origin %q: must be an origin, without a path", entry)
+	}
+
+	host := rest
+	if i := strings.LastIndex(rest, ":"); i != -1 && !strings.HasSuffix(rest, "]") {
+		host, rule.port = rest[:i], rest[i+1:]
+		if rule.port == "" {
+			return rule, fmt.Errorf("invalid allowed origin %q: empty port", entry)
+		}
+	}
+	if domain, ok := strings.CutPrefix(host, "*."); ok {
+		rule.wildcard = true
+		host = domain
+	}
+	if host == "" || strings.Contains(host, "*") {
+		return rule, fmt.Errorf("invalid allowed origin %q: wildcards must be a leading *. label", entry)
+	}
+	port := rule.port
+	if port == "*" {
+		port = ""
+	}
+	// Check the rest with the URL parser, leaving out the wildcards
+	u, err := url.Parse(rule.scheme + "://" + strings.ToLower(host) + portSuffix(port))
+	if err != nil || u.Hostname() == "" {
+		return rule, fmt.Errorf("invalid allowed origin %q", entry)
+	}
+	rule.host = u.Hostname()
+	if rule.port != "*" {
+		rule.port = normalizePort(rule.scheme, u.Port())
+	}
+	return rule, nil
+}
+
+func portSuffix(port string) string {
+	if port == "" {
+		return ""
+	}
+	return ":" + port
+}
+
+// normalizePort returns "" for the default port of scheme
+func normalizePort(scheme, port string) string {
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		return ""
+	}
+	return port
+}
+
+// matches reports whether the rule allows the origin u, whose canonical
+// form is origin
+func (rule originRule) matches(u *url.URL, origin string) bool {
+	if rule.pattern != nil {
+		return rule.pattern.MatchString(origin)
+	}
+	if u.Scheme != rule.scheme {
+		return false
+	}
+	if rule.port != "*" && normalizePort(u.Scheme, u.Port()) != rule.port {
+		return false
+	}
+	host := u.Hostname()
+	if rule.wildcard {
+		return strings.HasSuffix(host, "."+rule.host)
+	}
+	return host == rule.host
+}
+
+// Allows reports whether origin, the value of an Origin header, may call the
+// API
+func (a *AllowedOrigins) Allows(origin string) bool {
+	if a == nil || origin == "" {
+		return false
+	}
+	if a.any {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return false
+	}
+	canonical := u.Scheme + "://" + u.Hostname() + portSuffix(normalizePort(u.Scheme, u.Port()))
+	for _, rule := range a.rules {
+		if rule.matches(u, canonical) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAny reports whether every origin is allowed, so that responses can
+// use Access-Control-Allow-Origin: *
+func (a *AllowedOrigins) AllowsAny() bool {
+	return a != nil && a.any
+}
+
+// FrameAncestors returns the rules as frame-ancestors sources. Regular
+// expressions can't be expressed in CSP, so they are returned separately,
+// as skipped.
+func (a *AllowedOrigins) FrameAncestors() (sources, skipped []string) {
+	if a == nil {
+		return nil, nil
+	}
+	if a.any {
+		return []string{"*"}, nil
+	}
+	for _, rule := range a.rules {
+		if rule.pattern != nil {
+			skipped = append(skipped, rule.source)
+			continue
+		}
+		host := rule.host
+		if rule.wildcard {
+			host = "*." + host
+		}
+		sources = append(sources, rule.scheme+"://"+host+portSuffix(rule.port))
+	}
+	return sources, skipped
+}
+
+// String returns the rules as configured
+func (a *AllowedOrigins) String() string {
+	if a == nil {
+		return ""
+	}
+	var entries []string
+	if a.any {
+		entries = append(entries, "*")
+	}
+	for _, rule := range a.rules {
+		entries = append(entries, rule.source)
+	}
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,337 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+const (
+	// bucketIdleTimeout is how long an unused bucket is kept at least.
+	// Buckets are kept until they have refilled, so a new bucket behaves the
+	// same.
+	bucketIdleTimeout = 10 * time.Minute
+	// maxBuckets caps the buckets of each kind. Clients beyond it share a
+	// single bucket until idle ones are evicted.
+	maxBuckets = 50000
+)
+
+// bucket is the token bucket of one client IP or origin
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// bucketSet holds the token buckets of one kind of key
+type bucketSet struct {
+	kind    string
+	limit   rate.Limit
+	burst   int
+	buckets map[string]*bucket
+	// idle is how long an unused bucket is kept
+	idle time.Duration
+	// overflow is shared by the keys that didn't fit
+	overflow *bucket
+}
+
+func newBucketSet(kind string, perMinute float64, burst int) *bucketSet {
+	limit := rate.Limit(perMinute / 60)
+	// A bucket must hold at least one request, or it never allows any
+	burst = max(burst, 1)
+	refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+	return &bucketSet{
+		kind:     kind,
+		limit:    limit,
+		burst:    burst,
+		buckets:  make(map[string]*bucket),
+		idle:     max(bucketIdleTimeout, refill),
+		overflow: &bucket{limiter: rate.NewLimiter(limit, burst)},
+	}
+}
+
+// get returns the bucket of key, creating it if needed
+func (s *bucketSet) get(key string, now time.Time) *bucket {
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= maxBuckets {
+			b = s.overflow
+		} else {
+			b = &bucket{limiter: rate.NewLimiter(s.limit, s.burst)}
+			s.buckets[key] = b
+			metrics.RateLimitBuckets.WithLabelValues(s.kind).Set(float64(len(s.buckets)))
+		}
+	}
+	b.lastSeen = now
+	return b
+}
+
+// evict removes the buckets that have been idle long enough to refill
+func (s *bucketSet) evict(now time.Time) {
+	cutoff := now.Add(-s.idle)
+	for key, b := range s.buckets {
+		if b.lastSeen.Before(cutoff) {
+			delete(s.buckets, key)
+		}
+	}
+	metrics.RateLimitBuckets.WithLabelValues(s.kind).Set(float64(len(s.buckets)))
+}
+
+// unknownOrigin is the bucket key shared by origins that aren't allowed
+const unknownOrigin = "unknown"
+
+// RateLimiter limits inbound requests with token buckets per client IP and
+// per embedding origin, so a single client can't use up the shared upstream
+// budget by cycling usernames past the cache
+type RateLimiter struct {
+	mu      sync.Mutex
+	ips     *bucketSet
+	origins *bucketSet
+	// allowedOrigins get a bucket each; other origins share one
+	allowedOrigins *AllowedOrigins
+	trusted        []*net.IPNet
+	lastEvict      time.Time
+	now            func() time.Time
+	// corsOrigins may read refusals, if set
+	corsOrigins *AllowedOrigins
+}
+
+// RateLimitOption configures optional RateLimiter behaviour
+type RateLimitOption func(*RateLimiter)
+
+// WithIPLimit allows each client IP perMinute requests, in bursts of up to
+// burst. IPv6 clients are limited by /64, since one host can use many
+// addresses of its network.
+func WithIPLimit(perMinute float64, burst int) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.ips = newBucketSet("ip", perMinute, burst)
+	}
+}
+
+// WithOriginLimit allows the pages of each embedding origin in allowed
+// perMinute requests, in bursts of up to burst. The Origin and Referer
+// headers are chosen by the client, so all other origins share a single
+// bucket; otherwise a client could get a new bucket with every request, and
+// crowd real embeds out of theirs. Requests without an Origin or Referer
+// are only limited by IP.
+func WithOriginLimit(perMinute float64, burst int, allowed *AllowedOrigins) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.origins = newBucketSet("origin", perMinute, burst)
+		l.allowedOrigins = allowed
+	}
+}
+
+// WithCORSOrigins lets the pages of the origins in allowed read refusals, so
+// widgets on them can tell a rate limit from a network error and honour
+// Retry-After
+func WithCORSOrigins(allowed *AllowedOrigins) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.corsOrigins = allowed
+	}
+}
+
+// WithTrustedProxies trusts the X-Forwarded-For headers set by proxies in
+// networks to name the client
+func WithTrustedProxies(networks []*net.IPNet) RateLimitOption {
+	return func(l *RateLimiter) {
+		l.trusted = networks
+	}
+}
+
+// NewRateLimiter creates a rate limiter. Without WithIPLimit or
+// WithOriginLimit it limits nothing.
+func NewRateLimiter(opts ...RateLimitOption) *RateLimiter {
+	l := &RateLimiter{now: time.Now}
+	for _, opt := range opts {
+		opt(l)
+	}
+	l.lastEvict = l.now()
+	return l
+}
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and
+// CIDR networks
+func ParseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (l *RateLimiter) isTrusted(ip net.IP) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client that made r. When the connection
+// comes from a trusted proxy, X-Forwarded-For is followed from the right
+// past the trusted proxies, so clients can't pick their own address by
+// sending the header themselves.
+func (l *RateLimiter) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Anything further left was written by the client
+			break
+		}
+		ip = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// ipKey returns the bucket key of a client IP
+func ipKey(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// reserve takes a token from b, or returns how long until one is left.
+// Refused reservations are cancelled, so refused requests don't use up
+// tokens.
+func reserve(b *bucket, now time.Time) (*rate.Reservation, time.Duration) {
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return nil, delay
+	}
+	return res, 0
+}
+
+// allow reports whether r is within its limits, and otherwise which limit
+// it exceeded and when to retry
+func (l *RateLimiter) allow(r *http.Request) (string, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastEvict) >= bucketIdleTimeout/2 {
+		for _, set := range []*bucketSet{l.ips, l.origins} {
+			if set != nil {
+				set.evict(now)
+			}
+		}
+		l.lastEvict = now
+	}
+
+	var ipReservation *rate.Reservation
+	if l.ips != nil {
+		var delay time.Duration
+		if ipReservation, delay = reserve(l.ips.get(ipKey(l.clientIP(r)), now), now); delay > 0 {
+			return "ip", delay
+		}
+	}
+
+	if l.origins != nil {
+		origin := requestOrigin(r)
+		// Visitors of our own embed pages all share our origin
+		if origin != "none" && !strings.HasSuffix(origin, "://"+strings.ToLower(r.Host)) {
+			if !l.allowedOrigins.Allows(origin) {
+				origin = unknownOrigin
+			}
+			if _, delay := reserve(l.origins.get(origin, now), now); delay > 0 {
+				// The request is refused, so it doesn't count against its IP
+				if ipReservation != nil {
+					ipReservation.CancelAt(now)
+				}
+				return "origin", delay
+			}
+		}
+	}
+	return "", 0
+}
+
+// Middleware answers requests over their limits with 429 Too Many Requests
+// and a Retry-After header, readable by the origins of WithCORSOrigins. A
+// nil RateLimiter limits nothing.
+func (l *RateLimiter) Middleware(endpoint string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if l == nil || (l.ips == nil && l.origins == nil) {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			kind, delay := l.allow(r)
+			if kind == "" {
+				next(w, r)
+				return
+			}
+
+			metrics.RateLimitedRequestsTotal.WithLabelValues(endpoint, kind).Inc()
+			retryAfter := int(math.Ceil(delay.Seconds()))
+			client := "address"
+			if kind == "origin" {
+				client = "site"
+			}
+
+			if l.corsOrigins != nil {
+				allowOrigin(w, r, l.corsOrigins)
+				w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusTooManyRequests)
+			if err := json.NewEncoder(w).Encode(map[string]string{
+				"error":   "rate_limited",
+				"message": fmt.Sprintf("Too many requests from this %s, retry in %d seconds", client, retryAfter),
+			}); err != nil {
+				log.Printf("Error writing response: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+)
+
+// shelfView is the input every renderer works from
+type shelfView struct {
+	Request  *http.Request
+	Endpoint string
+	Username string
+	Books    *hardcover.UserBooksResponse
+}
+
+// renderer produces one representation of a shelf or the reviews list
+type renderer struct {
+	// ext selects the renderer from the path, e.g. "alice.md"
+	ext string
+	// mediaType selects the renderer from the Accept header
+	mediaType   string
+	contentType string
+	// endpoints limits the renderer to some shelves; empty means all
+	endpoints []string
+	// extensionOnly renderers are never picked from the Accept header
+	extensionOnly bool
+	// inlinesCovers renderers fetch covers themselves, so cover URLs are
+	// never rewritten to our proxy for them
+	inlinesCovers bool
+	// headers are set on every response from this renderer
+	headers map[string]string
+	render  func(s *Server, v *shelfView) ([]byte, error)
+}
+
+func (rd *renderer) supports(endpoint string) bool {
+	return len(rd.endpoints) == 0 || slices.Contains(rd.endpoints, endpoint)
+}
+
+// renderers is the registry of available representations. The first entry
+// is the default when the client expresses no preference, and earlier
+// entries win when a wildcard Accept range matches several.
+var renderers = []*renderer{
+	{
+		ext:         ".json",
+		mediaType:   "application/json",
+		contentType: "application/json",
+		render:      renderJSON,
+	},
+	{
+		ext:         ".feed.json",
+		mediaType:   "application/feed+json",
+		contentType: "application/feed+json; charset=utf-8",
+		render:      renderJSONFeed,
+	},
+	{
+		ext:         ".atom",
+		mediaType:   "application/atom+xml",
+		contentType: "application/atom+xml; charset=utf-8",
+		render:      renderAtom,
+	},
+	{
+		ext:         ".md",
+		mediaType:   "text/markdown",
+		contentType: "text/markdown; charset=utf-8",
+		render:      renderMarkdown,
+	},
+	{
+		ext:         ".txt",
+		mediaType:   "text/plain",
+		contentType: "text/plain; charset=utf-8",
+		render:      renderPlainText,
+	},
+	{
+		ext:         ".csv",
+		mediaType:   "text/csv",
+		contentType: "text/csv; charset=utf-8",
+		render:      renderCSV,
+	},
+	{
+		ext:         ".html",
+		mediaType:   "text/html",
+		contentType: "text/html; charset=utf-8",
+		// Browsers list text/html first when navigating, and a visit to an
+		// API URL should keep showing the JSON
+		extensionOnly: true,
+		render:        renderHTMLFragment,
+	},
+	{
+		ext:           ".svg",
+		mediaType:     "image/svg+xml",
+		contentType:   "image/svg+xml; charset=utf-8",
+		endpoints:     []string{"currently-reading", "last-read"},
+		inlinesCovers: true,
+		headers: map[string]string{
+			// Covers are data URIs and styling is inline; nothing else may load
+			"Content-Security-Policy": "default-src 'none'; img-src data:; style-src 'unsafe-inline';",
+		},
+		render: renderSVG,
+	},
+}
+
+// renderersByExt orders renderers by descending extension length so that
+// ".feed.json" is tried before ".json"
+var renderersByExt = func() []*renderer {
+	byLength := slices.Clone(renderers)
+	sort.SliceStable(byLength, func(i, j int) bool {
+		return len(byLength[i].ext) > len(byLength[j].ext)
+	})
+	return byLength
+}()
+
+// splitFormat separates a registered format extension from a username path
+// value. The returned renderer is nil when there is no extension.
+func splitFormat(value string) (string, *renderer) {
+	for _, rd := range renderersByExt {
+		if name, ok := strings.CutSuffix(value, rd.ext); ok {
+			return name, rd
+		}
+	}
+	return value, nil
+}
+
+// acceptRange is one media range from an Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header ordered by
+// preference. Ranges with equal quality keep their original order.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// negotiate picks the renderer for endpoint from the Accept header. It
+// returns nil when none of the acceptable types can be produced.
+func negotiate(accept, endpoint string) *renderer {
+	if strings.TrimSpace(accept) == "" {
+		return renderers[0]
+	}
+
+	for _, ar := range parseAccept(accept) {
+		for _, rd := range renderers {
+			if rd.extensionOnly || !rd.supports(endpoint) {
+				continue
+			}
+			if mediaRangeMatches(ar.mediaType, rd.mediaType) {
+				return rd
+			}
+		}
+	}
+	return nil
+}
+
+// mediaRangeMatches reports whether mediaType falls within an Accept media
+// range such as "text/*" or "*/*"
+func mediaRangeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(mediaRange, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+	return false
+}
+
+// handleShelf serves a shelf in the representation chosen by path extension
+// or Accept header
+func (s *Server) handleShelf(w http.ResponseWriter, r *http.Request, endpoint string) {
+	allowed := s.enableCORS(w, r)
+
+	if r.Method == "OPTIONS" {
+		// Refuse preflights from other origins, rather than leaving the
+		// browser to notice the missing Access-Control-Allow-Origin
+		if !allowed {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	// Extract username from path parameter, which may carry a format
+	// extension such as .svg or .md
+	username, rd := splitFormat(r.PathValue("username"))
+	if rd == nil {
+		rd = negotiate(r.Header.Get("Accept"), endpoint)
+		if rd == nil {
+			http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+			return
+		}
+	} else if !rd.supports(endpoint) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Validate username (alphanumeric, hyphens, underscores)
+	if username == "" || !isValidUsername(username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+
+	// Bound usernames may only be embedded by their own sites, checked
+	// before the shelf is fetched so hotlinks cost no upstream requests
+	if s.usernameOrigins.Bound(username) {
+		if s.allowedOrigins.AllowsAny() {
+			// The response depends on the origin even with CORS open
+			w.Header().Add("Vary", "Origin")
+		}
+		if !s.usernameOrigins.Allows(r, username) {
+			s.usernameOrigins.deny(w, r, endpoint, username)
+			return
+		}
+	}
+
+	books, err := s.userBooks(endpoint, username)
+	if err != nil {
+		log.Printf("Error fetching %s for user %s: %v", shelves[endpoint].description, username, err)
+		http.Error(w, shelves[endpoint].errorMessage, http.StatusInternalServerError)
+		return
+	}
+
+	if books, err = s.applyView(endpoint, username, books, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	proxy := false
+	switch r.URL.Query().Get("images") {
+	case "", "direct":
+	case "proxy":
+		proxy = true
+	default:
+		http.Error(w, "Invalid images parameter: must be direct or proxy", http.StatusBadRequest)
+		return
+	}
+	// The body changes when the shelf is fetched again or more covers are
+	// analyzed, whichever happened last
+	books, analyzedAt := s.annotateImages(books)
+	lastModified := books.UpdatedAt
+	if analyzedAt.After(lastModified) {
+		lastModified = analyzedAt
+	}
+	books = s.addLinks(books, username)
+	if !rd.inlinesCovers {
+		books = rewriteImageURLs(books, requestBaseURL(r), proxy)
+	}
+
+	body, err := rd.render(s, &shelfView{
+		Request:  r,
+		Endpoint: endpoint,
+		Username: username,
+		Books:    books,
+	})
+	if err != nil {
+		log.Printf("Error rendering %s response: %v", rd.mediaType, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	s.impressions.Record(r, endpoint, username)
+
+	w.Header().Set("Content-Type", rd.contentType)
+	for name, value := range rd.headers {
+		w.Header().Set(name, value)
+	}
+
+	// Responses can be reused until the shelf they were built from expires
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.shelfMaxAge(endpoint, username).Seconds())))
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// notModified reports whether a conditional request can be answered with 304.
+// If-Modified-Since is only consulted without If-None-Match.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, etag)
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. The
+// comparison is weak, so compressed responses still match their ETags.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func renderJSON(_ *Server, v *shelfView) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v.Books); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
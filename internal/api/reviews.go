@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/review"
+)
+
+// Spoiler handling modes for the reviews endpoint's spoilers parameter:
+// show and blur send everything (blur is applied by the widget), hide moves
+// spoilers into review.spoiler behind a teaser, and omit never sends them.
+const (
+	spoilersShow = "show"
+	spoilersBlur = "blur"
+	spoilersHide = "hide"
+	spoilersOmit = "omit"
+)
+
+// Bounds for the excerpt_length parameter, in characters
+const (
+	minExcerptLength = 20
+	maxExcerptLength = 5000
+)
+
+// excerptLengths are the excerpt lengths the reviews endpoint cuts to.
+// Requested lengths are rounded down to the previous one, so excerpts never
+// outgrow the space the widget asked for and only a few views of each
+// user's reviews are ever cached.
+var excerptLengths = []int{minExcerptLength, 50, 100, 150, 200, 300, 400, 500, 750, 1000, 1500, 2000, 3000, maxExcerptLength}
+
+// reviewsCanonicalView rounds a valid excerpt_length down to one of
+// excerptLengths. Invalid values are left for reviewsView to reject.
+func reviewsCanonicalView(params url.Values) {
+	n, err := strconv.Atoi(params.Get("excerpt_length"))
+	if err != nil || n < minExcerptLength || n > maxExcerptLength {
+		return
+	}
+	length := excerptLengths[0]
+	for _, l := range excerptLengths {
+		if l <= n {
+			length = l
+		}
+	}
+	params.Set("excerpt_length", strconv.Itoa(length))
+}
+
+// reviewsView applies the reviews endpoint's spoilers and excerpt_length
+// parameters to a cached response. Reviews given an excerpt are sent without
+// their full renderings. Books are copied before they are changed.
+func reviewsView(books *hardcover.UserBooksResponse, username string, params url.Values) (*hardcover.UserBooksResponse, error) {
+	mode := params.Get("spoilers")
+	switch mode {
+	case "", spoilersShow, spoilersBlur, spoilersHide, spoilersOmit:
+	default:
+		return nil, fmt.Errorf("invalid spoilers parameter %q: must be show, blur, hide or omit", mode)
+	}
+
+	excerptLength := 0
+	if value := params.Get("excerpt_length"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < minExcerptLength || n > maxExcerptLength {
+			return nil, fmt.Errorf("invalid excerpt_length %q: must be between %d and %d", value, minExcerptLength, maxExcerptLength)
+		}
+		excerptLength = n
+	}
+
+	view := *books
+	view.Books = make([]hardcover.UserBook, 0, len(books.Books))
+	for _, book := range books.Books {
+		if mode == spoilersHide || mode == spoilersOmit {
+			var ok bool
+			if book, ok = stripSpoilers(book, mode); !ok {
+				continue
+			}
+		}
+		if excerptLength > 0 && book.Review != nil && book.Review.Text != "" {
+			text, truncated := review.Excerpt(book.Review.Text, excerptLength)
+			book.Excerpt = &hardcover.ReviewExcerpt{
+				Text:      text,
+				Truncated: truncated,
+				URL:       hardcoverReviewURL(book.Book, username),
+			}
+			// The excerpt stands in for the review, which may be long
+			book.Review = nil
+			book.ReviewRaw = nil
+			book.ReviewHTML = nil
+			book.ReviewObject = nil
+			book.ReviewSlate = nil
+		}
+		view.Books = append(view.Books, book)
+	}
+	view.Count = len(view.Books)
+	return &view, nil
+}
+
+// stripSpoilers removes spoilers from a review for the hide and omit modes.
+// A review flagged as containing spoilers without marking which parts are
+// treated as a spoiler in full. ok is false when the book should be left out.
+func stripSpoilers(book hardcover.UserBook, mode string) (hardcover.UserBook, bool) {
+	teaser, found := review.RenderTeaser(book)
+	if !found && !book.ReviewHasSpoilers {
+		return book, true
+	}
+	if !found {
+		teaser = nil
+	}
+
+	// The upstream renderings would reveal the spoilers
+	full := book.Review
+	book.ReviewRaw = nil
+	book.ReviewHTML = nil
+	book.ReviewObject = nil
+	book.ReviewSlate = nil
+
+	if mode == spoilersOmit {
+		if teaser == nil {
+			return book, false
+		}
+		book.Review = teaser
+		return book, true
+	}
+
+	if teaser == nil {
+		teaser = &hardcover.RenderedReview{}
+	}
+	teaser.Spoiler = full
+	book.Review = teaser
+	return book, true
+}
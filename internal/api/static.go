@@ -1,15 +1,21 @@
 package api
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io"
+	"html/template"
+	"io/fs"
+	"mime"
 	"net/http"
-	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
@@ -17,86 +23,213 @@ import (
 
 // StaticFile holds metadata about a static file
 type StaticFile struct {
+	// Path is the file's name in the handler's file system
 	Path         string
 	ETag         string
 	LastModified time.Time
 	Size         int64
+	// Fingerprint identifies the content in versioned file names such as
+	// widget.<fingerprint>.js
+	Fingerprint string
+	// Integrity is the Subresource Integrity value of the content
+	Integrity string
+
+	content []byte
 }
 
-// StaticHandler serves static files with proper caching headers
+const (
+	// fingerprintLength is the number of hex digits in versioned file names
+	fingerprintLength = 12
+	// unversionedMaxAge is how long browsers may reuse files requested by
+	// their plain names, which change on every release
+	unversionedMaxAge = 5 * time.Minute
+)
+
+// fingerprintedName matches versioned file names such as widget.<hash>.js
+var fingerprintedName = regexp.MustCompile(`^(.+)\.([0-9a-f]{12})(\.[^./]+)$`)
+
+// splitFingerprint returns the plain file name and fingerprint of a
+// versioned file name, or urlPath and "" for other names
+func splitFingerprint(urlPath string) (string, string) {
+	m := fingerprintedName.FindStringSubmatch(urlPath)
+	if m == nil {
+		return urlPath, ""
+	}
+	return m[1] + m[3], m[2]
+}
+
+// fingerprintedPath returns the versioned name of a file
+func fingerprintedPath(urlPath, fingerprint string) string {
+	ext := filepath.Ext(urlPath)
+	return strings.TrimSuffix(urlPath, ext) + "." + fingerprint + ext
+}
+
+// StaticHandler serves static files with proper caching headers. Files are
+// loaded, hashed and compressed once, when the handler is created.
 type StaticHandler struct {
-	root  string
 	files map[string]*StaticFile
-	mu    sync.RWMutex
+	// precompressed holds compressed copies of compressible files, by ETag
+	// and then content coding
+	precompressed map[string]map[string][]byte
+	// pages holds the templates of the embed pages
+	pages map[string]*template.Template
+
+	impressions *Impressions
+	// faroCollector is the Grafana Faro collector URL embed pages report to,
+	// or "" to leave Faro out
+	faroCollector string
+	// frameAncestorsDefault are the sites that may frame embed pages, unless
+	// usernameOrigins binds the page's username to others
+	frameAncestorsDefault []string
+	usernameOrigins       *UsernameOrigins
+	// tokens, when set, are required on embed pages
+	tokens *EmbedTokens
+}
+
+// StaticOption configures optional StaticHandler behaviour
+type StaticOption func(*StaticHandler)
+
+// WithEmbedImpressions counts embed page loads as impressions
+func WithEmbedImpressions(impressions *Impressions) StaticOption {
+	return func(h *StaticHandler) {
+		h.impressions = impressions
+	}
 }
 
-// NewStaticHandler creates a new static file handler
-func NewStaticHandler(root string) *StaticHandler {
-	return &StaticHandler{
-		root:  root,
-		files: make(map[string]*StaticFile),
+// WithFaroCollector adds Grafana Faro monitoring, reporting to collectorURL,
+// to embed pages
+func WithFaroCollector(collectorURL string) StaticOption {
+	return func(h *StaticHandler) {
+		h.faroCollector = collectorURL
 	}
 }
 
-// calculateETag generates an ETag for a file
-func calculateETag(path string) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return "", err
+// WithFrameAncestors restricts the sites that may frame embed pages to
+// sources, as parsed by ParseFrameAncestors. Without it any site may.
+func WithFrameAncestors(sources []string) StaticOption {
+	return func(h *StaticHandler) {
+		h.frameAncestorsDefault = sources
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			// Log but don't fail on close error
-			fmt.Printf("Error closing file %s: %v\n", path, err)
-		}
-	}()
+}
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+// WithEmbedUsernameOrigins restricts the sites that may frame the embed
+// pages of bound usernames to their origins, in place of the
+// WithFrameAncestors list
+func WithEmbedUsernameOrigins(bindings *UsernameOrigins) StaticOption {
+	return func(h *StaticHandler) {
+		h.usernameOrigins = bindings
 	}
+}
 
-	return fmt.Sprintf(`"%x"`, hash.Sum(nil)), nil
+// WithEmbedTokens requires a valid embed token on embed pages, which then
+// may only be framed by the token's origin
+func WithEmbedTokens(tokens *EmbedTokens) StaticOption {
+	return func(h *StaticHandler) {
+		h.tokens = tokens
+	}
 }
 
-// getOrUpdateFileInfo gets cached file info or updates it if stale
-func (h *StaticHandler) getOrUpdateFileInfo(urlPath string) (*StaticFile, error) {
-	filePath := filepath.Join(h.root, urlPath)
+// NewStaticHandler creates a static file handler serving the files of fsys
+func NewStaticHandler(fsys fs.FS, opts ...StaticOption) (*StaticHandler, error) {
+	h := &StaticHandler{
+		files:         make(map[string]*StaticFile),
+		precompressed: make(map[string]map[string][]byte),
+		pages:         make(map[string]*template.Template),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
 
-	// Check file exists and get info
-	info, err := os.Stat(filePath)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		return h.loadFile(fsys, name)
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to load static files: %w", err)
 	}
+	return h, nil
+}
 
-	h.mu.RLock()
-	cached, exists := h.files[urlPath]
-	h.mu.RUnlock()
+// calculateETag generates an ETag for file content
+func calculateETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(content))
+}
 
-	// If cached and not modified, return cached version
-	if exists && cached.LastModified.Equal(info.ModTime()) {
-		return cached, nil
+// loadFile reads a file and precomputes everything needed to serve it
+func (h *StaticHandler) loadFile(fsys fs.FS, name string) error {
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
 	}
-
-	// Calculate new ETag
-	etag, err := calculateETag(filePath)
+	info, err := fs.Stat(fsys, name)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Update cache
-	fileInfo := &StaticFile{
-		Path:         filePath,
+	// Calculate new ETag, fingerprint and integrity
+	etag := calculateETag(content)
+	digest := sha512.Sum384(content)
+
+	h.files[name] = &StaticFile{
+		Path:         name,
 		ETag:         etag,
 		LastModified: info.ModTime(),
-		Size:         info.Size(),
+		Size:         int64(len(content)),
+		Fingerprint:  hex.EncodeToString(digest[:])[:fingerprintLength],
+		Integrity:    "sha384-" + base64.StdEncoding.EncodeToString(digest[:]),
+		content:      content,
+	}
+
+	// Embed pages are rendered per request, so there is nothing to precompress
+	if isEmbedPage(name) {
+		page, err := parseEmbedPage(name, content)
+		if err != nil {
+			return err
+		}
+		h.pages[name] = page
+		return nil
+	}
+	if !compressible(mime.TypeByExtension(filepath.Ext(name))) {
+		return nil
+	}
+	variants, err := precompress(content)
+	if err != nil {
+		return err
 	}
+	if len(variants) > 0 {
+		h.precompressed[etag] = variants
+	}
+	return nil
+}
 
-	h.mu.Lock()
-	h.files[urlPath] = fileInfo
-	h.mu.Unlock()
+// precompress compresses a file with every supported content coding,
+// keeping the copies that are smaller than the file
+func precompress(content []byte) (map[string][]byte, error) {
+	variants := make(map[string][]byte, len(encodings))
+	for _, encoding := range encodings {
+		compressed, err := compressBytes(encoding, content)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(content) {
+			variants[encoding] = compressed
+		}
+	}
+	return variants, nil
+}
 
-	return fileInfo, nil
+// compressedVariant returns the precompressed copy of a file to serve for r,
+// if any, and whether the file has compressed copies at all
+func (h *StaticHandler) compressedVariant(fileInfo *StaticFile, r *http.Request) (string, []byte, bool) {
+	variants := h.precompressed[fileInfo.ETag]
+	if len(variants) == 0 {
+		return "", nil, false
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	return encoding, variants[encoding], true
 }
 
 // ServeHTTP handles static file requests
@@ -119,25 +252,43 @@ func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if urlPath == manifestPath {
+		h.serveManifest(w, r, start)
+		return
+	}
+
+	// Versioned names are aliases of the plain file with that content
+	urlPath, fingerprint := splitFingerprint(urlPath)
+
 	// Get file info
-	fileInfo, err := h.getOrUpdateFileInfo(urlPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "404").Inc()
-			http.NotFound(w, r)
-		} else {
-			metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "500").Inc()
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+	fileInfo, ok := h.files[urlPath]
+	if !ok {
+		metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "404").Inc()
+		http.NotFound(w, r)
+		return
+	}
+
+	// Other versions are gone, and their names must keep meaning their content
+	if fingerprint != "" && (fingerprint != fileInfo.Fingerprint || isEmbedPage(urlPath)) {
+		metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "404").Inc()
+		http.NotFound(w, r)
 		return
 	}
 
 	// Set caching headers
 	w.Header().Set("ETag", fileInfo.ETag)
-	w.Header().Set("Last-Modified", fileInfo.LastModified.UTC().Format(http.TimeFormat))
+	// Embedded files have no modification time
+	if !fileInfo.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", fileInfo.LastModified.UTC().Format(http.TimeFormat))
+	}
 
-	// Set cache control for 1 year (immutable for versioned assets)
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if fingerprint != "" {
+		// Versioned names never change content, so cache them for 1 year
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// Plain names get each release's changes after a short while
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(unversionedMaxAge.Seconds())))
+	}
 
 	// Set content type based on file extension
 	switch filepath.Ext(urlPath) {
@@ -148,25 +299,21 @@ func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case ".html":
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	default:
-		// Let ServeFile detect the content type
+		// Let ServeContent detect the content type
 	}
 
 	// Security headers
 	// CSP for HTML files - restrictive policy to prevent XSS
 	if filepath.Ext(urlPath) == ".html" {
-		// Allow inline scripts with nonce for our embed pages
-		// These pages need inline scripts to parse URL parameters
-		if urlPath == "embed.html" || urlPath == "reviews-embed.html" {
-			// For embed pages, allow unsafe-inline for the parameter parsing script
-			// This is acceptable since these pages don't display user content directly
-			// Also allow Grafana Faro collector for analytics and scripts from unpkg.com
-			w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' https://hardcover.app https://*.hardcover.app data:; style-src 'self' 'unsafe-inline'; script-src 'self' 'unsafe-inline' https://unpkg.com; connect-src 'self' https://hardcover.app https://*.hardcover.app https://faro-collector-prod-us-central-0.grafana.net; frame-ancestors *;")
-		} else {
+		// Embed pages get a CSP with a nonce and the sites that may frame
+		// them when rendered. X-Frame-Options can't list sites, so they
+		// rely on frame-ancestors alone.
+		if !isEmbedPage(urlPath) {
 			// For other HTML pages, use strict CSP
-			w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' https://hardcover.app https://*.hardcover.app data:; style-src 'self' 'unsafe-inline'; script-src 'self'; connect-src 'self' https://hardcover.app https://*.hardcover.app; frame-ancestors 'none';")
+			w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' https://hardcover.app https://*.hardcover.app data:; style-src 'self' 'unsafe-inline'; script-src 'self'; connect-src 'self' https://hardcover.app https://*.hardcover.app; frame-ancestors 'none'; report-uri "+CSPReportPath+";")
+			w.Header().Set("X-Frame-Options", "DENY")
 		}
 		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.Header().Set("X-Frame-Options", "SAMEORIGIN") // Allow framing for embed pages
 	}
 
 	// CORS for JavaScript files
@@ -176,10 +323,32 @@ func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Security-Policy", "default-src 'none'; connect-src *;")
 	}
 
+	// Embed pages are rendered per request, so the file's own validators
+	// don't apply to them
+	if isEmbedPage(urlPath) {
+		w.Header().Del("ETag")
+		w.Header().Del("Last-Modified")
+		h.serveEmbedPage(w, r, urlPath, start)
+		return
+	}
+
+	// Serve a precompressed copy to clients accepting one
+	encoding, compressed, hasVariants := h.compressedVariant(fileInfo, r)
+	if hasVariants {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if compressed != nil {
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("ETag", "W/"+fileInfo.ETag)
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(urlPath)))
+		}
+	}
+
 	// Check conditional requests
 	// Check If-None-Match (ETag)
 	if match := r.Header.Get("If-None-Match"); match != "" {
-		if match == fileInfo.ETag {
+		if etagMatches(match, fileInfo.ETag) {
 			metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "304").Inc()
 			metrics.StaticFileRequestDuration.WithLabelValues(urlPath).Observe(time.Since(start).Seconds())
 			w.WriteHeader(http.StatusNotModified)
@@ -190,7 +359,7 @@ func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Check If-Modified-Since
 	if modifiedSince := r.Header.Get("If-Modified-Since"); modifiedSince != "" {
 		t, err := time.Parse(http.TimeFormat, modifiedSince)
-		if err == nil && !fileInfo.LastModified.After(t) {
+		if err == nil && !fileInfo.LastModified.IsZero() && !fileInfo.LastModified.After(t) {
 			metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "304").Inc()
 			metrics.StaticFileRequestDuration.WithLabelValues(urlPath).Observe(time.Since(start).Seconds())
 			w.WriteHeader(http.StatusNotModified)
@@ -198,13 +367,85 @@ func (h *StaticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Set Content-Length
-	w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size, 10))
+	if compressed != nil {
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		if r.Method != "HEAD" {
+			if _, err := w.Write(compressed); err != nil {
+				fmt.Printf("Error writing static file %s: %v\n", urlPath, err)
+			}
+		}
+		metrics.CompressionInputBytesTotal.WithLabelValues("static", encoding).Add(float64(fileInfo.Size))
+		metrics.CompressionOutputBytesTotal.WithLabelValues("static", encoding).Add(float64(len(compressed)))
+
+		metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "200").Inc()
+		metrics.StaticFileRequestDuration.WithLabelValues(urlPath).Observe(time.Since(start).Seconds())
+		return
+	}
 
 	// Serve the file
-	http.ServeFile(w, r, fileInfo.Path)
+	http.ServeContent(w, r, urlPath, fileInfo.LastModified, bytes.NewReader(fileInfo.content))
 
 	// Record successful request
 	metrics.StaticFileRequestsTotal.WithLabelValues(urlPath, "200").Inc()
 	metrics.StaticFileRequestDuration.WithLabelValues(urlPath).Observe(time.Since(start).Seconds())
 }
+
+// manifestPath is where the manifest of versioned file names is served
+const manifestPath = "manifest.json"
+
+// ManifestEntry is the versioned URL and Subresource Integrity value of a
+// static file
+type ManifestEntry struct {
+	URL       string `json:"url"`
+	Integrity string `json:"integrity"`
+}
+
+// manifest maps the names of the scripts and stylesheets to their versioned
+// URLs
+func (h *StaticHandler) manifest(baseURL string) map[string]ManifestEntry {
+	manifest := make(map[string]ManifestEntry)
+	for name, fileInfo := range h.files {
+		if ext := filepath.Ext(name); ext != ".js" && ext != ".css" {
+			continue
+		}
+		manifest[name] = ManifestEntry{
+			URL:       baseURL + "/static/" + fingerprintedPath(name, fileInfo.Fingerprint),
+			Integrity: fileInfo.Integrity,
+		}
+	}
+	return manifest
+}
+
+// serveManifest serves the manifest as JSON. It changes with every release,
+// so it is always revalidated.
+func (h *StaticHandler) serveManifest(w http.ResponseWriter, r *http.Request, start time.Time) {
+	body, err := json.MarshalIndent(h.manifest(requestBaseURL(r)), "", "  ")
+	if err != nil {
+		metrics.StaticFileRequestsTotal.WithLabelValues(manifestPath, "500").Inc()
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	etag := calculateETag(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		metrics.StaticFileRequestsTotal.WithLabelValues(manifestPath, "304").Inc()
+		metrics.StaticFileRequestDuration.WithLabelValues(manifestPath).Observe(time.Since(start).Seconds())
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method != "HEAD" {
+		if _, err := w.Write(body); err != nil {
+			fmt.Printf("Error writing static manifest: %v\n", err)
+		}
+	}
+
+	metrics.StaticFileRequestsTotal.WithLabelValues(manifestPath, "200").Inc()
+	metrics.StaticFileRequestDuration.WithLabelValues(manifestPath).Observe(time.Since(start).Seconds())
+}
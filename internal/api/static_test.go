@@ -0,0 +1,577 @@
+package api
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/web"
+)
+
+// newEmbedPageHandler creates a handler serving the real embed pages
+func newEmbedPageHandler(t *testing.T, opts ...StaticOption) *StaticHandler {
+	t.Helper()
+	static, err := fs.Sub(web.Files, "static")
+	if err != nil {
+		t.Fatalf("failed to open static files: %v", err)
+	}
+	handler, err := NewStaticHandler(static, opts...)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	return handler
+}
+
+// nonceRegex extracts the nonce of an embed page's CSP
+var nonceRegex = regexp.MustCompile(`script-src 'nonce-([^']+)'`)
+
+func TestEmbedPage(t *testing.T) {
+	handler := newEmbedPageHandler(t)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected int
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "shelf",
+			path:     "/static/embed.html?username=alice&type=last-read",
+			expected: http.StatusOK,
+			contains: []string{
+				`data-api-url="//example.com"`,
+				`data-username="alice"`,
+				`data-book-type="last-read"`,
+				`<meta property="og:title" content="@alice · Last read on Hardcover">`,
+				`<meta property="og:image" content="http://example.com/og/last-read/alice.png">`,
+				`src="widget.` + handler.files["widget.js"].Fingerprint + `.js" integrity="` + handler.files["widget.js"].Integrity + `"`,
+			},
+			excludes: []string{"faro", "{{"},
+		},
+		{
+			name:     "default shelf",
+			path:     "/static/embed.html?username=alice",
+			expected: http.StatusOK,
+			contains: []string{`data-book-type="currently-reading"`},
+		},
+		{
+			name:     "reviews",
+			path:     "/static/reviews-embed.html?username=alice&showDate=false&spoilers=blur",
+			expected: http.StatusOK,
+			contains: []string{`data-show-date="false"`, `data-spoilers="blur"`, `src="review-widget.`},
+		},
+		{
+			name:     "reviews without options",
+			path:     "/static/reviews-embed.html?username=alice",
+			expected: http.StatusOK,
+			excludes: []string{"data-show-date", "data-spoilers"},
+		},
+		{name: "missing username", path: "/static/embed.html", expected: http.StatusBadRequest},
+		{name: "invalid username", path: "/static/embed.html?username=%22%3E%3Cscript%3E", expected: http.StatusBadRequest},
+		{name: "invalid type", path: "/static/embed.html?username=alice&type=reviews", expected: http.StatusBadRequest},
+		{name: "invalid showDate", path: "/static/reviews-embed.html?username=alice&showDate=yes", expected: http.StatusBadRequest},
+		{name: "invalid spoilers", path: "/static/reviews-embed.html?username=alice&spoilers=all", expected: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.expected {
+				t.Fatalf("expected status %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+			if tt.expected != http.StatusOK {
+				return
+			}
+
+			body := html.UnescapeString(w.Body.String())
+			for _, want := range tt.contains {
+				if !strings.Contains(body, want) {
+					t.Errorf("expected page to contain %q, got %s", want, body)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(body, unwanted) {
+					t.Errorf("expected page not to contain %q, got %s", unwanted, body)
+				}
+			}
+
+			csp := w.Header().Get("Content-Security-Policy")
+			if strings.Contains(csp, "unsafe-inline") || strings.Contains(csp, "unpkg.com") {
+				t.Errorf("expected a strict CSP, got %q", csp)
+			}
+			m := nonceRegex.FindStringSubmatch(csp)
+			if m == nil {
+				t.Fatalf("expected a script nonce in CSP, got %q", csp)
+			}
+			if got := strings.Count(body, `nonce="`+m[1]+`"`); got != 2 {
+				t.Errorf("expected the style and script to carry the nonce, found it %d times", got)
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("expected Cache-Control no-store, got %q", cc)
+			}
+		})
+	}
+
+	// Every response gets a fresh nonce
+	nonces := make(map[string]bool)
+	for range 3 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/embed.html?username=alice", nil))
+		nonces[nonceRegex.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))[1]] = true
+	}
+	if len(nonces) != 3 {
+		t.Errorf("expected 3 distinct nonces, got %d", len(nonces))
+	}
+}
+
+func TestEmbedPageFaro(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []StaticOption
+		wantFaro  bool
+		wantInCSP string
+	}{
+		{name: "without a collector", wantInCSP: "connect-src 'self' https://hardcover.app https://*.hardcover.app;"},
+		{
+			name:      "with a collector",
+			opts:      []StaticOption{WithFaroCollector("https://faro.example.net/collect/abc")},
+			wantFaro:  true,
+			wantInCSP: "connect-src 'self' https://hardcover.app https://*.hardcover.app https://faro.example.net;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newEmbedPageHandler(t, tt.opts...)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/embed.html?username=alice", nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			body := w.Body.String()
+			if got := strings.Contains(body, `url: "https://faro.example.net/collect/abc"`); got != tt.wantFaro {
+				t.Errorf("expected Faro snippet %v, got body %s", tt.wantFaro, body)
+			}
+			csp := w.Header().Get("Content-Security-Policy")
+			if !strings.Contains(csp, tt.wantInCSP) {
+				t.Errorf("expected CSP to contain %q, got %q", tt.wantInCSP, csp)
+			}
+			if strings.Contains(csp, "unpkg.com") != tt.wantFaro {
+				t.Errorf("expected unpkg.com in CSP only with Faro, got %q", csp)
+			}
+			if m := nonceRegex.FindStringSubmatch(csp); tt.wantFaro && (m == nil || strings.Count(body, `nonce="`+m[1]+`"`) != 3) {
+				t.Errorf("expected the Faro snippet to carry the nonce, got body %s", body)
+			}
+		})
+	}
+}
+
+func TestEmbedPageImpressions(t *testing.T) {
+	impressions := NewImpressions()
+	handler := newEmbedPageHandler(t, WithEmbedImpressions(impressions))
+
+	load := func(query, referer string) int {
+		req := httptest.NewRequest("GET", "/static/embed.html"+query, nil)
+		req.Header.Set("Referer", referer)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	load("?username=alice", "https://blog.example.com/about")
+	load("?username=alice&type=last-read", "")
+	load("?username=alice&type=last-read", "")
+	// Pages without a username are rejected and not counted
+	if code := load("", "https://blog.example.com/"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a username, got %d", code)
+	}
+
+	summary := impressions.Summary()
+	if summary.Total != 3 {
+		t.Errorf("expected 3 impressions, got %+v", summary)
+	}
+	if summary.ByOrigin["https://blog.example.com"] != 1 || summary.ByOrigin["none"] != 2 {
+		t.Errorf("unexpected impressions by origin: %v", summary.ByOrigin)
+	}
+	if summary.ByShelf["last-read"] != 2 || summary.ByShelf["currently-reading"] != 1 {
+		t.Errorf("unexpected impressions by shelf: %v", summary.ByShelf)
+	}
+}
+
+func TestStaticPrecompressed(t *testing.T) {
+	root := t.TempDir()
+	script := strings.Repeat("console.log('hardcover widget');\n", 100)
+	if err := os.WriteFile(filepath.Join(root, "widget.js"), []byte(script), 0o644); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "tiny.js"), []byte("1"), 0o644); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+	handler, err := NewStaticHandler(os.DirFS(root))
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	get := func(file string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/static/"+file, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := get("widget.js", nil)
+	if plain.Body.String() != script || plain.Header().Get("Content-Encoding") != "" {
+		t.Fatal("expected the file uncompressed without Accept-Encoding")
+	}
+	if plain.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", plain.Header().Get("Vary"))
+	}
+
+	for _, encoding := range []string{"br", "gzip"} {
+		t.Run(encoding, func(t *testing.T) {
+			w := get("widget.js", map[string]string{"Accept-Encoding": encoding})
+			if w.Header().Get("Content-Encoding") != encoding {
+				t.Fatalf("expected Content-Encoding %s, got %q", encoding, w.Header().Get("Content-Encoding"))
+			}
+			if got := decompress(t, encoding, w.Body.Bytes()); got != script {
+				t.Error("expected the compressed copy to decompress to the file")
+			}
+			etag := w.Header().Get("ETag")
+			if etag != "W/"+plain.Header().Get("ETag") {
+				t.Errorf("expected a weak ETag for the compressed copy, got %q", etag)
+			}
+			if w := get("widget.js", map[string]string{"Accept-Encoding": encoding, "If-None-Match": etag}); w.Code != http.StatusNotModified {
+				t.Errorf("expected 304, got %d", w.Code)
+			}
+		})
+	}
+
+	// Files that don't shrink are always served as they are
+	tiny := get("tiny.js", map[string]string{"Accept-Encoding": "br, gzip"})
+	if tiny.Header().Get("Content-Encoding") != "" || tiny.Header().Get("Vary") != "" {
+		t.Errorf("expected tiny.js uncompressed, got headers %v", tiny.Header())
+	}
+}
+
+func TestStaticFingerprints(t *testing.T) {
+	root := t.TempDir()
+	script := "console.log('hardcover widget');\n"
+	if err := os.WriteFile(filepath.Join(root, "widget.js"), []byte(script), 0o644); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "embed.html"), []byte("<!-- og:meta -->"), 0o644); err != nil {
+		t.Fatalf("failed to write embed page: %v", err)
+	}
+	handler, err := NewStaticHandler(os.DirFS(root))
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	manifestResponse := get("/static/manifest.json")
+	if manifestResponse.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for the manifest, got %d", manifestResponse.Code)
+	}
+	var manifest map[string]ManifestEntry
+	if err := json.Unmarshal(manifestResponse.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("failed to decode manifest: %v", err)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("expected only widget.js in the manifest, got %v", manifest)
+	}
+	digest := sha512.Sum384([]byte(script))
+	fingerprint := hex.EncodeToString(digest[:])[:fingerprintLength]
+	expected := ManifestEntry{
+		URL:       "http://example.com/static/widget." + fingerprint + ".js",
+		Integrity: "sha384-" + base64.StdEncoding.EncodeToString(digest[:]),
+	}
+	if manifest["widget.js"] != expected {
+		t.Errorf("expected manifest entry %+v, got %+v", expected, manifest["widget.js"])
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		expected     int
+		cacheControl string
+	}{
+		{"versioned name", "/static/widget." + fingerprint + ".js", http.StatusOK, "public, max-age=31536000, immutable"},
+		{"plain name", "/static/widget.js", http.StatusOK, "public, max-age=300"},
+		{"old version", "/static/widget.0123456789ab.js", http.StatusNotFound, ""},
+		{"versioned embed page", "/static/embed." + fingerprint + ".html", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.path)
+			if w.Code != tt.expected {
+				t.Fatalf("expected status %d, got %d", tt.expected, w.Code)
+			}
+			if tt.expected != http.StatusOK {
+				return
+			}
+			if w.Body.String() != script {
+				t.Errorf("expected the script, got %q", w.Body.String())
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != tt.cacheControl {
+				t.Errorf("expected Cache-Control %q, got %q", tt.cacheControl, cc)
+			}
+		})
+	}
+}
+
+func TestStaticEmbeddedFiles(t *testing.T) {
+	// Embedded files have no modification time
+	handler, err := NewStaticHandler(fstest.MapFS{
+		"widget.js": {Data: []byte("console.log('hardcover widget');\n")},
+	})
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/widget.js", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if w.Header().Get("Last-Modified") != "" {
+		t.Errorf("expected no Last-Modified, got %q", w.Header().Get("Last-Modified"))
+	}
+	if w.Header().Get("ETag") == "" || w.Header().Get("Content-Length") != "33" {
+		t.Errorf("expected precomputed ETag and size, got headers %v", w.Header())
+	}
+
+	req := httptest.NewRequest("GET", "/static/widget.js", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected If-Modified-Since to be ignored, got %d", w.Code)
+	}
+}
+
+func TestParseFrameAncestors(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{list: "", want: nil},
+		{list: "*", want: []string{"*"}},
+		{list: "https://example.com, https://*.preview.example.com", want: []string{"https://example.com", "https://*.preview.example.com"}},
+		{list: "HTTPS://Example.com/ 'self'", want: []string{"https://example.com", "'self'"}},
+		{list: "https: http://localhost:8080", want: []string{"https:", "http://localhost:8080"}},
+		{list: "https://example.com/blog", wantErr: true},
+		{list: "example.com", wantErr: true},
+		{list: "https://example.com;script-src", wantErr: true},
+		{list: "'unsafe-inline'", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			got, err := ParseFrameAncestors(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseFrameAncestors(%q) error = %v, wantErr %v", tt.list, err, tt.wantErr)
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("ParseFrameAncestors(%q) = %q, want %q", tt.list, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbedPageFrameAncestors(t *testing.T) {
+	bindings := newUsernameOrigins(t, `{"alice": ["https://alice.example"], "carol": ["~https://[a-z]+\\.carol\\.example"]}`)
+	tests := []struct {
+		name     string
+		opts     []StaticOption
+		username string
+		want     string
+	}{
+		{name: "unrestricted", username: "alice", want: "frame-ancestors *;"},
+		{
+			name:     "default list",
+			opts:     []StaticOption{WithFrameAncestors([]string{"https://example.com", "https://*.example.com"})},
+			username: "alice",
+			want:     "frame-ancestors https://example.com https://*.example.com;",
+		},
+		{
+			name: "username list",
+			opts: []StaticOption{
+				WithFrameAncestors([]string{"https://example.com"}),
+				WithEmbedUsernameOrigins(bindings),
+			},
+			username: "Alice",
+			want:     "frame-ancestors https://alice.example;",
+		},
+		{
+			name: "other username",
+			opts: []StaticOption{
+				WithFrameAncestors([]string{"https://example.com"}),
+				WithEmbedUsernameOrigins(bindings),
+			},
+			username: "bob",
+			want:     "frame-ancestors https://example.com;",
+		},
+		{
+			name:     "username bound to a regular expression",
+			opts:     []StaticOption{WithEmbedUsernameOrigins(bindings)},
+			username: "carol",
+			want:     "frame-ancestors 'none';",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newEmbedPageHandler(t, tt.opts...)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/reviews-embed.html?username="+tt.username, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			csp := w.Header().Get("Content-Security-Policy")
+			if !strings.Contains(csp, tt.want) {
+				t.Errorf("expected CSP to contain %q, got %q", tt.want, csp)
+			}
+			if !strings.Contains(csp, "report-uri "+CSPReportPath+";") {
+				t.Errorf("expected CSP to report violations, got %q", csp)
+			}
+			// X-Frame-Options can't allow specific sites, so it must not
+			// override frame-ancestors
+			if xfo := w.Header().Get("X-Frame-Options"); xfo != "" {
+				t.Errorf("expected no X-Frame-Options on embed pages, got %q", xfo)
+			}
+		})
+	}
+}
+
+func TestEmbedPageTokens(t *testing.T) {
+	tokens, err := NewEmbedTokens([]byte(strings.Repeat("s", MinTokenSecretSize)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := tokens.Mint(EmbedToken{Username: "alice", Shelf: "reviews", Origin: "https://*.alice.example", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("failed to mint token: %v", err)
+	}
+	handler := newEmbedPageHandler(t, WithEmbedTokens(tokens))
+
+	get := func(page string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/"+page, nil))
+		return w
+	}
+
+	w := get("reviews-embed.html?username=alice&token=" + token)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `data-token="`+token+`"`) {
+		t.Errorf("expected the widget to get the token, got %s", w.Body.String())
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors https://*.alice.example;") {
+		t.Errorf("expected the token's origin to restrict framing, got %q", csp)
+	}
+	// Link preview crawlers fetch the image without the page, so it carries the token
+	if !strings.Contains(w.Body.String(), `/og/reviews/alice.png?token=`+token+`"`) {
+		t.Errorf("expected the preview image URL to carry the token, got %s", w.Body.String())
+	}
+
+	for _, page := range []string{
+		"reviews-embed.html?username=alice",
+		"reviews-embed.html?username=bob&token=" + token,
+		"embed.html?username=alice&token=" + token,
+	} {
+		if w := get(page); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", page, w.Code)
+		}
+	}
+}
+
+func TestIntersectFrameAncestors(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want string
+	}{
+		{[]string{"*"}, []string{"https://alice.example"}, "https://alice.example"},
+		{[]string{"https://alice.example"}, []string{"*"}, "https://alice.example"},
+		{[]string{"https://*.alice.example"}, []string{"https://blog.alice.example"}, "https://blog.alice.example"},
+		{[]string{"https://alice.example", "https://bob.example"}, []string{"https://*.alice.example", "https://bob.example"}, "https://bob.example"},
+		{[]string{"https:"}, []string{"https://alice.example", "http://alice.example"}, "https://alice.example"},
+		{[]string{"http://localhost:*"}, []string{"http://localhost:8080"}, "http://localhost:8080"},
+		{[]string{"https://alice.example:443"}, []string{"https://alice.example"}, "https://alice.example"},
+		{[]string{"https://alice.example"}, []string{"https://evil.example"}, "'none'"},
+		{[]string{"'self'"}, []string{"https://alice.example"}, "'none'"},
+		{[]string{"'none'"}, []string{"*"}, "'none'"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(intersectFrameAncestors(tt.a, tt.b), " "); got != tt.want {
+			t.Errorf("intersectFrameAncestors(%v, %v) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEmbedPageTokenNarrowsFraming(t *testing.T) {
+	tokens, err := NewEmbedTokens([]byte(strings.Repeat("s", MinTokenSecretSize)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mint := func(username, origin string) string {
+		t.Helper()
+		token, err := tokens.Mint(EmbedToken{Username: username, Origin: origin, Expires: time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatalf("failed to mint token: %v", err)
+		}
+		return token
+	}
+	handler := newEmbedPageHandler(t, WithEmbedTokens(tokens),
+		WithFrameAncestors([]string{"https://*.example"}),
+		WithEmbedUsernameOrigins(newUsernameOrigins(t, `{"alice": ["https://alice.example"]}`)))
+
+	tests := []struct {
+		name string
+		page string
+		want string
+	}{
+		{"token for any origin keeps the binding", "embed.html?username=alice&token=" + mint("alice", "*"), "frame-ancestors https://alice.example;"},
+		{"token outside the binding", "embed.html?username=alice&token=" + mint("alice", "https://evil.example"), "frame-ancestors 'none';"},
+		{"token within FRAME_ANCESTORS", "embed.html?username=bob&token=" + mint("bob", "https://bob.example"), "frame-ancestors https://bob.example;"},
+		{"token for any origin keeps FRAME_ANCESTORS", "embed.html?username=bob&token=" + mint("bob", "*"), "frame-ancestors https://*.example;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/"+tt.page, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+			if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, tt.want) {
+				t.Errorf("expected %q in the CSP, got %q", tt.want, csp)
+			}
+		})
+	}
+}
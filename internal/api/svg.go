@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/placeholder"
+)
+
+const (
+	svgDefaultCount = 5
+	svgMaxCount     = 5
+
+	// svgCoverTimeout bounds how long we wait for cover thumbnails before
+	// falling back to placeholders
+	svgCoverTimeout = 5 * time.Second
+
+	// starPoints is a 12x12 five-pointed star
+	starPoints = "6,0.5 7.6,4.3 11.7,4.6 8.6,7.3 9.5,11.3 6,9.2 2.5,11.3 3.4,7.3 0.3,4.6 4.4,4.3"
+)
+
+// svgTheme holds the colors used to draw an SVG card
+type svgTheme struct {
+	Background string
+	Border     string
+	Text       string
+	Muted      string
+	Star       string
+	EmptyStar  string
+	Cover      string
+}
+
+var svgThemes = map[string]svgTheme{
+	"light": {
+		Background: "#ffffff",
+		Border:     "#e5e7eb",
+		Text:       "#111827",
+		Muted:      "#6b7280",
+		Star:       "#fbbf24",
+		EmptyStar:  "#e5e7eb",
+		Cover:      "#e5e7eb",
+	},
+	"dark": {
+		Background: "#0d1117",
+		Border:     "#30363d",
+		Text:       "#e6edf3",
+		Muted:      "#8b949e",
+		Star:       "#fbbf24",
+		EmptyStar:  "#30363d",
+		Cover:      "#21262d",
+	},
+}
+
+// svgOptions are the query parameters accepted by the SVG card endpoints
+type svgOptions struct {
+	Theme   svgTheme
+	Layout  string // "list" or "grid"
+	Count   int
+	Ratings bool
+}
+
+// parseSVGOptions reads theme, layout, count and ratings from the query string,
+// falling back to defaults for missing or invalid values
+func parseSVGOptions(query url.Values) svgOptions {
+	opts := svgOptions{
+		Theme:   svgThemes["light"],
+		Layout:  "list",
+		Count:   svgDefaultCount,
+		Ratings: true,
+	}
+
+	if theme, ok := svgThemes[query.Get("theme")]; ok {
+		opts.Theme = theme
+	}
+	if layout := query.Get("layout"); layout == "grid" || layout == "list" {
+		opts.Layout = layout
+	}
+	if count, err := strconv.Atoi(query.Get("count")); err == nil && count > 0 {
+		opts.Count = min(count, svgMaxCount)
+	}
+	if ratings := query.Get("ratings"); ratings != "" {
+		opts.Ratings = ratings != "false" && ratings != "0"
+	}
+
+	return opts
+}
+
+// renderSVG renders books as a self-contained SVG card. Covers are inlined
+// as data URIs because image proxies such as GitHub's camo do not load
+// external resources referenced from SVGs.
+func renderSVG(s *Server, v *shelfView) ([]byte, error) {
+	opts := parseSVGOptions(v.Request.URL.Query())
+
+	shown := v.Books.Books
+	if len(shown) > opts.Count {
+		shown = shown[:opts.Count]
+	}
+
+	coverWidth := 48
+	if opts.Layout == "grid" {
+		coverWidth = 80
+	}
+	covers := s.coverDataURIs(v.Request.Context(), shown, coverWidth*2)
+
+	if opts.Layout == "grid" {
+		return []byte(renderGridSVG(shelves[v.Endpoint].title, v.Username, shown, covers, opts)), nil
+	}
+	return []byte(renderListSVG(shelves[v.Endpoint].title, v.Username, shown, covers, opts)), nil
+}
+
+// coverDataURIs fetches thumbnails for books concurrently and returns them as
+// data URIs, indexed like books. Covers that fail to load are left empty.
+func (s *Server) coverDataURIs(ctx context.Context, books []hardcover.UserBook, width int) []string {
+	ctx, cancel := context.WithTimeout(ctx, svgCoverTimeout)
+	defer cancel()
+
+	covers := make([]string, len(books))
+	var wg sync.WaitGroup
+	for i, book := range books {
+		if book.Book.Image == nil || book.Book.Image.URL == "" {
+			continue
+		}
+		if book.Book.Image.IsPlaceholder {
+			covers[i] = "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(placeholder.SVG(placeholderCover(book)))
+			continue
+		}
+		wg.Add(1)
+		go func(i int, imageURL string) {
+			defer wg.Done()
+			thumb, err := s.images.Thumbnail(ctx, imageURL, width)
+			if err != nil {
+				log.Printf("Error fetching cover %s: %v", imageURL, err)
+				return
+			}
+			covers[i] = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(thumb)
+		}(i, book.Book.Image.URL)
+	}
+	wg.Wait()
+
+	return covers
+}
+
+func renderListSVG(title, username string, books []hardcover.UserBook, covers []string, opts svgOptions) string {
+	const (
+		width      = 420
+		header     = 44
+		rowHeight  = 88
+		coverW     = 48
+		coverH     = 72
+		textOffset = 16 + coverW + 14
+	)
+
+	rows := max(len(books), 1)
+	height := header + rows*rowHeight + 4
+
+	var b strings.Builder
+	writeSVGHeader(&b, width, height, title, username, opts.Theme)
+
+	if len(books) == 0 {
+		fmt.Fprintf(&b, `<text x="16" y="%d" class="muted">Nothing on this shelf yet</text>`, header+28)
+	}
+
+	for i, book := range books {
+		y := header + i*rowHeight
+		writeSVGCover(&b, 16, y, coverW, coverH, covers[i], opts.Theme)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" class="title">%s</text>`, textOffset, y+22, svgEscape(truncateRunes(book.Book.Title, 38)))
+		if authors := bookAuthors(book.Book); authors != "" {
+			fmt.Fprintf(&b, `<text x="%d" y="%d" class="muted">%s</text>`, textOffset, y+42, svgEscape(truncateRunes(authors, 48)))
+		}
+		if opts.Ratings && book.Rating != nil {
+			writeSVGStars(&b, textOffset, y+52, *book.Rating, opts.Theme)
+		}
+	}
+
+	b.WriteString(`</svg>`)
+	return b.String()
+}
+
+func renderGridSVG(title, username string, books []hardcover.UserBook, covers []string, opts svgOptions) string {
+	const (
+		header = 44
+		coverW = 80
+		coverH = 120
+		gap    = 12
+	)
+
+	columns := max(len(books), 1)
+	width := max(32+columns*coverW+(columns-1)*gap, 240)
+	height := header + coverH + 28
+	if opts.Ratings {
+		height += 16
+	}
+
+	var b strings.Builder
+	writeSVGHeader(&b, width, height, title, username, opts.Theme)
+
+	if len(books) == 0 {
+		fmt.Fprintf(&b, `<text x="16" y="%d" class="muted">Nothing on this shelf yet</text>`, header+28)
+	}
+
+	for i, book := range books {
+		x := 16 + i*(coverW+gap)
+		writeSVGCover(&b, x, header, coverW, coverH, covers[i], opts.Theme)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" class="caption">%s</text>`, x, header+coverH+16, svgEscape(truncateRunes(book.Book.Title, 12)))
+		if opts.Ratings && book.Rating != nil {
+			writeSVGStars(&b, x, header+coverH+22, *book.Rating, opts.Theme)
+		}
+	}
+
+	b.WriteString(`</svg>`)
+	return b.String()
+}
+
+func writeSVGHeader(b *strings.Builder, width, height int, title, username string, theme svgTheme) {
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s">`,
+		width, height, width, height, svgEscape(title+" by @"+username))
+	fmt.Fprintf(b, `<style>text{font-family:-apple-system,BlinkMacSystemFont,'Segoe UI',Helvetica,Arial,sans-serif;fill:%s}.heading{font-size:14px;font-weight:600}.title{font-size:14px;font-weight:600}.caption{font-size:11px}.muted{font-size:12px;fill:%s}</style>`,
+		theme.Text, theme.Muted)
+	fmt.Fprintf(b, `<rect x="0.5" y="0.5" width="%d" height="%d" rx="6" fill="%s" stroke="%s"/>`, width-1, height-1, theme.Background, theme.Border)
+	fmt.Fprintf(b, `<text x="16" y="27" class="heading">%s</text>`, svgEscape(title))
+	fmt.Fprintf(b, `<text x="%d" y="27" class="muted" text-anchor="end">@%s</text>`, width-16, svgEscape(username))
+}
+
+func writeSVGCover(b *strings.Builder, x, y, width, height int, dataURI string, theme svgTheme) {
+	fmt.Fprintf(b, `<rect x="%d" y="%d" width="%d" height="%d" rx="3" fill="%s"/>`, x, y, width, height, theme.Cover)
+	if dataURI != "" {
+		fmt.Fprintf(b, `<image x="%d" y="%d" width="%d" height="%d" preserveAspectRatio="xMidYMid slice" href="%s"/>`, x, y, width, height, dataURI)
+	}
+}
+
+// writeSVGStars draws five 12px stars, filling whole and half stars for rating
+func writeSVGStars(b *strings.Builder, x, y int, rating float64, theme svgTheme) {
+	for i := 0; i < 5; i++ {
+		sx := x + i*14
+		fmt.Fprintf(b, `<polygon transform="translate(%d %d)" points="%s" fill="%s"/>`, sx, y, starPoints, theme.EmptyStar)
+
+		fill := rating - float64(i)
+		switch {
+		case fill >= 1:
+			fmt.Fprintf(b, `<polygon transform="translate(%d %d)" points="%s" fill="%s"/>`, sx, y, starPoints, theme.Star)
+		case fill >= 0.5:
+			// A nested svg clips its content to its viewport
+			fmt.Fprintf(b, `<svg x="%d" y="%d" width="6" height="12"><polygon points="%s" fill="%s"/></svg>`, sx, y, starPoints, theme.Star)
+		}
+	}
+}
+
+// bookAuthors joins the names of up to two contributors
+func bookAuthors(book hardcover.Book) string {
+	names := make([]string, 0, 2)
+	for _, contribution := range book.Contributions {
+		if contribution.Author.Name == "" {
+			continue
+		}
+		if len(names) == 2 {
+			names = append(names, "et al.")
+			break
+		}
+		names = append(names, contribution.Author.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// truncateRunes shortens s to at most n runes, adding an ellipsis when cut
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
+
+func svgEscape(s string) string {
+	return html.EscapeString(s)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+	"github.com/gouthamve/hardcover-book-embed/internal/review"
+)
+
+// textOptions are the template parameters accepted by the text renderings
+type textOptions struct {
+	// Links is "inline", "reference" or "none"
+	Links   string
+	Ratings bool
+}
+
+func parseTextOptions(query url.Values) textOptions {
+	opts := textOptions{
+		Links:   "inline",
+		Ratings: true,
+	}
+
+	switch links := query.Get("links"); links {
+	case "inline", "reference", "none":
+		opts.Links = links
+	}
+	if ratings := query.Get("ratings"); ratings != "" {
+		opts.Ratings = ratings != "false" && ratings != "0"
+	}
+
+	return opts
+}
+
+func renderMarkdown(_ *Server, v *shelfView) ([]byte, error) {
+	return []byte(renderBooksText(v, true)), nil
+}
+
+func renderPlainText(_ *Server, v *shelfView) ([]byte, error) {
+	return []byte(renderBooksText(v, false)), nil
+}
+
+// renderBooksText renders a shelf or the reviews list as Markdown or plain text
+func renderBooksText(v *shelfView, markdown bool) string {
+	opts := parseTextOptions(v.Request.URL.Query())
+	if v.Endpoint == "reviews" {
+		return renderReviewsText(v.Books.Books, v.Username, markdown, opts)
+	}
+	return renderShelfText(v.Books.Books, markdown, opts)
+}
+
+// renderShelfText renders one list item per book:
+//
+//   - [Title](url) by Author ★★★★
+func renderShelfText(books []hardcover.UserBook, markdown bool, opts textOptions) string {
+	var b strings.Builder
+	var refs []string
+
+	for _, book := range books {
+		bookURL := hardcoverBookURL(book.Book)
+		title := book.Book.Title
+		if markdown {
+			title = review.MarkdownEscape(title)
+		}
+
+		b.WriteString("- ")
+		switch {
+		case opts.Links == "none" || !markdown:
+			b.WriteString(title)
+		case opts.Links == "reference":
+			refs = append(refs, bookURL)
+			fmt.Fprintf(&b, "[%s][%d]", title, len(refs))
+		default:
+			fmt.Fprintf(&b, "[%s](%s)", title, bookURL)
+		}
+
+		writeBylineText(&b, book, markdown, opts)
+
+		if !markdown && opts.Links != "none" {
+			fmt.Fprintf(&b, " <%s>", bookURL)
+		}
+		b.WriteString("\n")
+	}
+
+	writeReferences(&b, refs)
+	return b.String()
+}
+
+// renderReviewsText renders each review as a heading followed by its paragraphs
+func renderReviewsText(books []hardcover.UserBook, username string, markdown bool, opts textOptions) string {
+	var b strings.Builder
+	var refs []string
+
+	for i, book := range books {
+		if i > 0 {
+			if markdown {
+				b.WriteString("\n---\n\n")
+			} else {
+				b.WriteString("\n----------------------------------------\n\n")
+			}
+		}
+
+		reviewURL := hardcoverReviewURL(book.Book, username)
+		title := book.Book.Title
+
+		if markdown {
+			title = review.MarkdownEscape(title)
+			b.WriteString("## ")
+			switch opts.Links {
+			case "none":
+				b.WriteString(title)
+			case "reference":
+				refs = append(refs, reviewURL)
+				fmt.Fprintf(&b, "[%s][%d]", title, len(refs))
+			default:
+				fmt.Fprintf(&b, "[%s](%s)", title, reviewURL)
+			}
+		} else {
+			b.WriteString(title)
+		}
+
+		writeBylineText(&b, book, markdown, opts)
+		b.WriteString("\n")
+
+		if !markdown && opts.Links != "none" {
+			b.WriteString(reviewURL + "\n")
+		}
+
+		if book.ReviewHasSpoilers {
+			if markdown {
+				b.WriteString("\n*Contains spoilers*\n")
+			} else {
+				b.WriteString("\n[Contains spoilers]\n")
+			}
+		}
+
+		if book.Review != nil {
+			body := book.Review.Text
+			if markdown {
+				body = book.Review.Markdown
+			}
+			b.WriteString("\n" + body + "\n")
+		}
+	}
+
+	writeReferences(&b, refs)
+	return b.String()
+}
+
+// writeBylineText appends " by Author" and the rating stars for book
+func writeBylineText(b *strings.Builder, book hardcover.UserBook, markdown bool, opts textOptions) {
+	if authors := bookAuthors(book.Book); authors != "" {
+		if markdown {
+			authors = review.MarkdownEscape(authors)
+		}
+		b.WriteString(" by " + authors)
+	}
+	if opts.Ratings && book.Rating != nil {
+		b.WriteString(" " + ratingStars(*book.Rating))
+	}
+}
+
+// writeReferences appends Markdown reference link definitions
+func writeReferences(b *strings.Builder, refs []string) {
+	if len(refs) == 0 {
+		return
+	}
+	b.WriteString("\n")
+	for i, ref := range refs {
+		fmt.Fprintf(b, "[%d]: %s\n", i+1, ref)
+	}
+}
+
+// ratingStars renders a rating out of five as ★ characters with ½ for halves
+func ratingStars(rating float64) string {
+	full := int(math.Floor(rating))
+	stars := strings.Repeat("★", full)
+	if rating-float64(full) >= 0.5 {
+		stars += "½"
+	}
+	return stars
+}
+
+func hardcoverBookURL(book hardcover.Book) string {
+	return "https://hardcover.app/books/" + url.PathEscape(book.Slug)
+}
+
+func hardcoverReviewURL(book hardcover.Book, username string) string {
+	return fmt.Sprintf("https://hardcover.app/books/%s/reviews/@%s", url.PathEscape(book.Slug), url.PathEscape(username))
+}
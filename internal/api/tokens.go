@@ -0,0 +1,237 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+const (
+	// tokenVersion prefixes tokens, so their layout can change later
+	tokenVersion = "v1"
+	// MinTokenSecretSize is the shortest secret tokens may be signed with
+	MinTokenSecretSize = 32
+)
+
+// Reasons a token is refused, which are also its metric results
+var (
+	errTokenMissing   = errors.New("missing")
+	errTokenMalformed = errors.New("malformed")
+	errTokenSignature = errors.New("bad_signature")
+	errTokenExpired   = errors.New("expired")
+	errTokenUsername  = errors.New("wrong_username")
+	errTokenShelf     = errors.New("wrong_shelf")
+	errTokenOrigin    = errors.New("wrong_origin")
+)
+
+// EmbedToken is what a signed embed token grants: embedding a username's
+// shelf from an origin until it expires
+type EmbedToken struct {
+	Username string `json:"u"`
+	// Shelf is the one shelf allowed, or "" for all of them
+	Shelf string `json:"s,omitempty"`
+	// Origin is the origin rule, in the syntax of ALLOWED_ORIGINS, of the
+	// sites that may embed the shelf, or "*" for any
+	Origin  string `json:"o"`
+	Expires int64  `json:"e"`
+}
+
+// EmbedTokens mints and verifies embed tokens signed with a secret. A token
+// is the base64 JSON of an EmbedToken and its HMAC-SHA256, so the server
+// keeps no state about the tokens it issued.
+type EmbedTokens struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// NewEmbedTokens creates a token signer and verifier for secret
+func NewEmbedTokens(secret []byte) (*EmbedTokens, error) {
+	if len(secret) < MinTokenSecretSize {
+		return nil, fmt.Errorf("token secret must be at least %d bytes", MinTokenSecretSize)
+	}
+	return &EmbedTokens{secret: secret, now: time.Now}, nil
+}
+
+func (t *EmbedTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(tokenVersion + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Mint returns a signed token granting tok
+func (t *EmbedTokens) Mint(tok EmbedToken) (string, error) {
+	if !isValidUsername(tok.Username) {
+		return "", fmt.Errorf("invalid username %q", tok.Username)
+	}
+	tok.Username = strings.ToLower(tok.Username)
+	if _, ok := shelves[tok.Shelf]; tok.Shelf != "" && !ok {
+		return "", fmt.Errorf("invalid shelf %q: must be currently-reading, last-read or reviews", tok.Shelf)
+	}
+	if tok.Origin == "" {
+		return "", fmt.Errorf("origin is required, use * for any")
+	}
+	if _, err := ParseAllowedOrigins(tok.Origin); err != nil || strings.Contains(tok.Origin, ",") {
+		return "", fmt.Errorf("invalid origin %q", tok.Origin)
+	}
+	if tok.Expires <= t.now().Unix() {
+		return "", fmt.Errorf("expiry must be in the future")
+	}
+
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return tokenVersion + "." + payload + "." + t.sign(payload), nil
+}
+
+// Verify checks the signature and expiry of a token and returns what it
+// grants
+func (t *EmbedTokens) Verify(token string) (EmbedToken, error) {
+	var tok EmbedToken
+	version, rest, _ := strings.Cut(token, ".")
+	payload, signature, ok := strings.Cut(rest, ".")
+	if version != tokenVersion || !ok {
+		return tok, errTokenMalformed
+	}
+	if !hmac.Equal([]byte(signature), []byte(t.sign(payload))) {
+		return tok, errTokenSignature
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return tok, errTokenMalformed
+	}
+	if err := json.Unmarshal(data, &tok); err != nil {
+		return tok, errTokenMalformed
+	}
+	if t.now().Unix() >= tok.Expires {
+		return tok, errTokenExpired
+	}
+	return tok, nil
+}
+
+// check verifies token and that it grants username's shelf
+func (t *EmbedTokens) check(token, shelf, username string) (EmbedToken, error) {
+	if token == "" {
+		return EmbedToken{}, errTokenMissing
+	}
+	tok, err := t.Verify(token)
+	if err != nil {
+		return tok, err
+	}
+	if !strings.EqualFold(tok.Username, username) {
+		return tok, errTokenUsername
+	}
+	if tok.Shelf != "" && tok.Shelf != shelf {
+		return tok, errTokenShelf
+	}
+	return tok, nil
+}
+
+// authorize checks that the token of r allows embedding username's shelf
+// from the page that made r. Requests without an Origin or Referer, and
+// requests from this server's own embed pages, which check the token when
+// they are served, can't be checked against the origin. Requests from
+// opaque origins, which any site can make, are only allowed by tokens for
+// any origin.
+func (t *EmbedTokens) authorize(r *http.Request, shelf, username string) (EmbedToken, error) {
+	tok, err := t.check(r.URL.Query().Get("token"), shelf, username)
+	if err != nil {
+		return tok, err
+	}
+
+	if hasOpaqueOrigin(r) {
+		if tok.Origin != "*" {
+			return tok, errTokenOrigin
+		}
+		return tok, nil
+	}
+	origin := requestOrigin(r)
+	if origin == "none" || strings.HasSuffix(origin, "://"+strings.ToLower(r.Host)) {
+		return tok, nil
+	}
+	if allowed, err := ParseAllowedOrigins(tok.Origin); err != nil || !allowed.Allows(origin) {
+		return tok, errTokenOrigin
+	}
+	return tok, nil
+}
+
+// frameAncestors returns the frame-ancestors sources of the token's origin
+func (tok EmbedToken) frameAncestors() []string {
+	origins, err := ParseAllowedOrigins(tok.Origin)
+	if err != nil {
+		return []string{"'none'"}
+	}
+	sources, _ := origins.FrameAncestors()
+	if len(sources) == 0 {
+		return []string{"'none'"}
+	}
+	return sources
+}
+
+// writeTokenError refuses a request for a token that doesn't allow it
+func writeTokenError(w http.ResponseWriter, err error) {
+	message := "A valid embed token is required"
+	switch err {
+	case errTokenExpired:
+		message = "The embed token has expired"
+	case errTokenUsername, errTokenShelf, errTokenOrigin:
+		message = "The embed token doesn't allow this " + strings.TrimPrefix(err.Error(), "wrong_")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"error":   "invalid_token",
+		"message": message,
+	}); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// Middleware requires a valid embed token, in the token query parameter,
+// on requests for a shelf, or with shelf "" for the shelf in the {shelf}
+// path value. A nil EmbedTokens requires none.
+func (t *EmbedTokens) Middleware(shelf string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if t == nil {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Preflights carry no credentials
+			if r.Method == http.MethodOptions {
+				next(w, r)
+				return
+			}
+
+			shelf := shelf
+			if shelf == "" {
+				shelf = r.PathValue("shelf")
+				if _, ok := shelves[shelf]; !ok {
+					// Unknown shelves are refused by the handler
+					next(w, r)
+					return
+				}
+			}
+			// Preview images are named after the username with .png
+			username, _ := splitFormat(strings.TrimSuffix(r.PathValue("username"), ".png"))
+			if _, err := t.authorize(r, shelf, username); err != nil {
+				metrics.EmbedTokenChecksTotal.WithLabelValues(shelf, err.Error()).Inc()
+				writeTokenError(w, err)
+				return
+			}
+			metrics.EmbedTokenChecksTotal.WithLabelValues(shelf, "valid").Inc()
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+// BlobItem is a cached binary payload such as a resized cover image
+type BlobItem struct {
+	Data        []byte
+	ContentType string
+	ExpiresAt   time.Time
+}
+
+// BlobCache is an in-memory cache for binary payloads keyed by string.
+// It is bounded by the total size of its payloads, so neither a flood of
+// distinct keys nor a few large images can grow it without limit.
+type BlobCache struct {
+	mu       sync.RWMutex
+	items    map[string]*BlobItem
+	ttl      time.Duration
+	maxBytes int64
+	bytes    int64
+}
+
+// NewBlobCache creates a cache holding at most maxBytes of payloads.
+// Payloads larger than maxBytes are not cached.
+func NewBlobCache(ttl time.Duration, maxBytes int64) *BlobCache {
+	cache := &BlobCache{
+		items:    make(map[string]*BlobItem),
+		ttl:      ttl,
+		maxBytes: maxBytes,
+	}
+
+	go cache.cleanup()
+	return cache
+}
+
+func (c *BlobCache) Get(key string) (*BlobItem, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, exists := c.items[key]
+	if !exists {
+		return nil, false
+	}
+
+	if time.Now().After(item.ExpiresAt) {
+		return nil, false
+	}
+
+	return item, true
+}
+
+func (c *BlobCache) Set(key string, data []byte, contentType string) {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deleteLocked(key)
+	for len(c.items) > 0 && c.bytes+size > c.maxBytes {
+		c.evictOneLocked()
+	}
+
+	c.items[key] = &BlobItem{
+		Data:        data,
+		ContentType: contentType,
+		ExpiresAt:   time.Now().Add(c.ttl),
+	}
+	c.bytes += size
+
+	c.updateMetricsLocked()
+}
+
+// deleteLocked removes key, if cached. Callers must hold c.mu.
+func (c *BlobCache) deleteLocked(key string) {
+	if item, exists := c.items[key]; exists {
+		c.bytes -= int64(len(item.Data))
+		delete(c.items, key)
+	}
+}
+
+// updateMetricsLocked reports the size of the cache. Callers must hold c.mu.
+func (c *BlobCache) updateMetricsLocked() {
+	metrics.BlobCacheSize.Set(float64(len(c.items)))
+	metrics.BlobCacheBytes.Set(float64(c.bytes))
+}
+
+// evictOneLocked removes the entry closest to expiry. Callers must hold c.mu.
+func (c *BlobCache) evictOneLocked() {
+	var oldestKey string
+	var oldest time.Time
+	for key, item := range c.items {
+		if oldestKey == "" || item.ExpiresAt.Before(oldest) {
+			oldestKey = key
+			oldest = item.ExpiresAt
+		}
+	}
+	if oldestKey != "" {
+		c.deleteLocked(oldestKey)
+		metrics.CacheEvictionsTotal.Inc()
+	}
+}
+
+func (c *BlobCache) cleanup() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+
+		now := time.Now()
+		evicted := 0
+		for key, item := range c.items {
+			if now.After(item.ExpiresAt) {
+				c.deleteLocked(key)
+				evicted++
+			}
+		}
+		if evicted > 0 {
+			metrics.CacheEvictionsTotal.Add(float64(evicted))
+		}
+		c.updateMetricsLocked()
+		c.mu.Unlock()
+	}
+}
@@ -58,6 +58,23 @@ func (c *MemoryCache) Set(key string, data *hardcover.UserBooksResponse) {
 	metrics.CacheSize.Set(float64(len(c.items)))
 }
 
+// ExpiresAt returns when the entry for key expires
+func (c *MemoryCache) ExpiresAt(key string) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	item, exists := c.items[key]
+	if !exists || time.Now().After(item.ExpiresAt) {
+		return time.Time{}, false
+	}
+	return item.ExpiresAt, true
+}
+
+// TTL returns the lifetime of cached entries
+func (c *MemoryCache) TTL() time.Duration {
+	return c.ttl
+}
+
 func (c *MemoryCache) cleanup() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
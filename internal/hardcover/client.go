@@ -16,6 +16,10 @@ import (
 const (
 	HardcoverAPIURL = "https://api.hardcover.app/v1/graphql"
 	UserAgent       = "hardcover-book-embed/1.0"
+
+	// PlaceholderCoverPath is where the embed server renders a cover for a
+	// book ID without one. It is relative; the API makes it absolute.
+	PlaceholderCoverPath = "/img/placeholder/%d.svg"
 )
 
 // Client is the interface for interacting with the Hardcover API
@@ -96,11 +100,18 @@ func (c *client) makeHardcoverRequest(operation, username, query string) (*UserB
 	// Track API request duration
 	start := time.Now()
 	resp, err := c.httpClient.Do(req)
-	duration := time.Since(start).Seconds()
-	metrics.HardcoverAPIRequestDuration.WithLabelValues(operation, username).Observe(duration)
+	duration := time.Since(start)
+	label := metrics.Usernames.Label(username)
+	metrics.HardcoverAPIRequestDuration.WithLabelValues(operation, label).Observe(duration.Seconds())
+
+	status := "error"
+	if resp != nil {
+		status = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	metrics.HardcoverAPIRequestsTotal.WithLabelValues(operation, status, label).Inc()
+	metrics.Usernames.RecordHardcoverRequest(username, status, duration)
 
 	if err != nil {
-		metrics.HardcoverAPIRequestsTotal.WithLabelValues(operation, "error", username).Inc()
 		return nil, fmt.Errorf("failed to execute request: %w", err)
 	}
 	defer func() {
@@ -111,12 +122,9 @@ func (c *client) makeHardcoverRequest(operation, username, query string) (*UserB
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		metrics.HardcoverAPIRequestsTotal.WithLabelValues(operation, fmt.Sprintf("%d", resp.StatusCode), username).Inc()
 		return nil, fmt.Errorf("API request failed with status %d", resp.StatusCode)
 	}
 
-	metrics.HardcoverAPIRequestsTotal.WithLabelValues(operation, "200", username).Inc()
-
 	var graphqlResp UserBooksAPIResponse
 	if err := json.NewDecoder(resp.Body).Decode(&graphqlResp); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %w", err)
@@ -126,14 +134,13 @@ func (c *client) makeHardcoverRequest(operation, username, query string) (*UserB
 		return nil, fmt.Errorf("GraphQL errors: %v", graphqlResp.Errors)
 	}
 
-	// Process books and add fallback images
+	// Process books and add placeholder covers
 	books := graphqlResp.Data.UserBooks
 	for i := range books {
 		if books[i].Book.Image == nil {
-			// Generate a fallback image based on book ID
-			coverNum := (books[i].Book.ID % 9) + 1
 			books[i].Book.Image = &Image{
-				URL: fmt.Sprintf("https://assets.hardcover.app/static/covers/cover%d.webp", coverNum),
+				URL:           fmt.Sprintf(PlaceholderCoverPath, books[i].Book.ID),
+				IsPlaceholder: true,
 			}
 		}
 	}
@@ -172,6 +179,16 @@ func (c *client) GetUserCurrentlyReadingBooksByUsername(username string) (*UserB
 					url
 				}
 				slug
+				default_physical_edition {
+					isbn_13
+					isbn_10
+				}
+				contributions {
+					author {
+						name
+						slug
+					}
+				}
 			}
 		}
 	}`, escapeGraphQLString(username))
@@ -196,6 +213,16 @@ func (c *client) GetUserLastReadBooksByUsername(username string) (*UserBooksResp
 					url
 				}
 				slug
+				default_physical_edition {
+					isbn_13
+					isbn_10
+				}
+				contributions {
+					author {
+						name
+						slug
+					}
+				}
 			}
 		}
 	}`, escapeGraphQLString(username))
@@ -224,6 +251,10 @@ func (c *client) GetUserReviewsByUsername(username string) (*UserBooksResponse,
 					url
 				}
 				slug
+				default_physical_edition {
+					isbn_13
+					isbn_10
+				}
 				contributions {
 					author {
 						name
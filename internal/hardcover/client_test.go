@@ -163,12 +163,11 @@ func TestClientParsesCurrentlyReadingAPIResponseCorrectly(t *testing.T) {
 				t.Errorf("book %d: expected image URL, got nil", i)
 			}
 		} else {
-			// Should have fallback image
+			// Should have a placeholder cover
 			if book.Image == nil || book.Image.URL == "" {
-				t.Errorf("book %d: expected fallback image, got nil", i)
-			} else if book.Image.URL != "https://assets.hardcover.app/static/covers/cover1.webp" {
-				// ID 1896516 % 9 + 1 = 1
-				t.Errorf("book %d: expected fallback image cover1.webp, got %s", i, book.Image.URL)
+				t.Errorf("book %d: expected placeholder image, got nil", i)
+			} else if book.Image.URL != "/img/placeholder/1896516.svg" || !book.Image.IsPlaceholder {
+				t.Errorf("book %d: expected placeholder cover, got %+v", i, *book.Image)
 			}
 		}
 
@@ -44,6 +44,7 @@ func (m *MockClient) GetUserCurrentlyReadingBooksByUsername(username string) (*U
 	updatedAt4, _ := time.Parse(time.RFC3339, "2025-07-01T09:57:47.96016Z")
 	updatedAt5, _ := time.Parse(time.RFC3339, "2025-05-28T12:46:25.915366Z")
 	responseUpdatedAt, _ := time.Parse(time.RFC3339, "2025-07-11T09:12:20.384103+02:00")
+	isbn := "9780007197903"
 
 	return &UserBooksResponse{
 		Books: []UserBook{
@@ -55,6 +56,7 @@ func (m *MockClient) GetUserCurrentlyReadingBooksByUsername(username string) (*U
 					Image: &Image{
 						URL: "https://assets.hardcover.app/edition/13396527/7281320-L.jpg",
 					},
+					DefaultPhysicalEdition: &Edition{ISBN13: &isbn},
 				},
 				UpdatedAt: updatedAt1,
 			},
@@ -97,7 +99,8 @@ func (m *MockClient) GetUserCurrentlyReadingBooksByUsername(username string) (*U
 					Title: "Irani Cafe",
 					Slug:  "irani-cafe",
 					Image: &Image{
-						URL: "https://assets.hardcover.app/static/covers/cover1.webp",
+						URL:           "/img/placeholder/1896516.svg",
+						IsPlaceholder: true,
 					},
 				},
 				UpdatedAt: updatedAt5,
@@ -43,6 +43,14 @@ func (d *Date) UnmarshalJSON(b []byte) error {
 
 type Image struct {
 	URL string `json:"url"`
+	// IsPlaceholder is set when the book has no cover and URL points at a
+	// generated placeholder instead
+	IsPlaceholder bool `json:"is_placeholder"`
+	// BlurHash and DominantColor describe the cover for painting a
+	// placeholder while it loads. They are computed in the background and
+	// missing until the cover has been analyzed.
+	BlurHash      string `json:"blurhash,omitempty"`
+	DominantColor string `json:"dominant_color,omitempty"`
 }
 
 type Author struct {
@@ -56,20 +64,73 @@ type Contribution struct {
 }
 
 type Book struct {
-	ID            int            `json:"id"`
-	Title         string         `json:"title"`
-	Slug          string         `json:"slug"`
-	Image         *Image         `json:"image,omitempty"`
-	Contributions []Contribution `json:"contributions,omitempty"`
+	ID                     int            `json:"id"`
+	Title                  string         `json:"title"`
+	Slug                   string         `json:"slug"`
+	Image                  *Image         `json:"image,omitempty"`
+	Contributions          []Contribution `json:"contributions,omitempty"`
+	DefaultPhysicalEdition *Edition       `json:"default_physical_edition,omitempty"`
+}
+
+// Edition is a published edition of a book
+type Edition struct {
+	ISBN13 *string `json:"isbn_13,omitempty"`
+	ISBN10 *string `json:"isbn_10,omitempty"`
+}
+
+// ISBN returns the ISBN-13 of the book's default physical edition, or its
+// ISBN-10 when it has no ISBN-13
+func (b Book) ISBN() string {
+	edition := b.DefaultPhysicalEdition
+	switch {
+	case edition == nil:
+		return ""
+	case edition.ISBN13 != nil && *edition.ISBN13 != "":
+		return *edition.ISBN13
+	case edition.ISBN10 != nil:
+		return *edition.ISBN10
+	}
+	return ""
 }
 
 type Contributor struct {
 	Name string `json:"name"`
 }
 
+// SlateMark is a formatting mark on a text leaf, such as "bold" or "italic"
+type SlateMark struct {
+	Type   string `json:"type"`
+	Object string `json:"object,omitempty"`
+}
+
+// SlateLeaf is a run of text sharing the same marks, used by older Slate documents
+type SlateLeaf struct {
+	Text  string      `json:"text"`
+	Marks []SlateMark `json:"marks,omitempty"`
+}
+
+// SlateText is a child node of a block. Most are text leaves, but inline nodes
+// (links) and nested blocks (list items) also appear here, carrying a Type,
+// Data and their own Children.
 type SlateText struct {
 	Text   string `json:"text"`
 	Object string `json:"object"`
+
+	// Marks may be given as mark objects, as boolean flags on the leaf, or on
+	// Leaves depending on the Slate version that produced the document
+	Marks         []SlateMark `json:"marks,omitempty"`
+	Leaves        []SlateLeaf `json:"leaves,omitempty"`
+	Bold          bool        `json:"bold,omitempty"`
+	Italic        bool        `json:"italic,omitempty"`
+	Underline     bool        `json:"underline,omitempty"`
+	Strikethrough bool        `json:"strikethrough,omitempty"`
+	Code          bool        `json:"code,omitempty"`
+	Spoiler       bool        `json:"spoiler,omitempty"`
+
+	Type     string                 `json:"type,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+	URL      string                 `json:"url,omitempty"`
+	Children []SlateText            `json:"children,omitempty"`
 }
 
 type SlateBlock struct {
@@ -102,6 +163,37 @@ type UserBook struct {
 	ReviewObject      interface{}  `json:"review_object,omitempty"`
 	ReviewSlate       *ReviewSlate `json:"review_slate,omitempty"`
 	URL               string       `json:"url"`
+
+	// Review is the review rendered server-side. It is not part of the
+	// Hardcover API response and is filled in before caching.
+	Review *RenderedReview `json:"review,omitempty"`
+	// Excerpt is a shortened review, present when requested with excerpt_length
+	Excerpt *ReviewExcerpt `json:"excerpt,omitempty"`
+	// Links are the outbound links for the book from the configured link
+	// templates, keyed by name. They always include "hardcover", and
+	// "review" for reviewed books.
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// ReviewExcerpt is the start of a review cut at a sentence or word boundary
+type ReviewExcerpt struct {
+	Text      string `json:"text"`
+	Truncated bool   `json:"truncated"`
+	// URL is the full review on Hardcover
+	URL string `json:"url"`
+}
+
+// RenderedReview is a review normalized into allow-listed HTML, Markdown and
+// plain text
+type RenderedReview struct {
+	HTML      string `json:"html"`
+	Markdown  string `json:"markdown"`
+	Text      string `json:"text"`
+	WordCount int    `json:"word_count"`
+
+	// Spoiler is the complete review when spoilers are hidden, to be shown in
+	// place of this teaser once the reader asks for it
+	Spoiler *RenderedReview `json:"spoiler,omitempty"`
 }
 
 type UserBooksAPIResponse struct {
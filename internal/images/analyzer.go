@@ -0,0 +1,150 @@
+package images
+
+import (
+	"context"
+	"image"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+)
+
+const (
+	// analyzeTimeout bounds fetching and analyzing one cover
+	analyzeTimeout = 15 * time.Second
+	// maxAnalyses caps how many results are kept in memory
+	maxAnalyses = 5000
+)
+
+// analyzeJob asks for the cover at url to be analyzed. img is set when the
+// caller has already decoded it.
+type analyzeJob struct {
+	url string
+	img image.Image
+}
+
+// Analyzer computes cover analyses in the background, so API responses
+// never wait for covers to be downloaded. Results are cached by image URL;
+// until one is ready, Lookup reports a miss and the cover is queued.
+type Analyzer struct {
+	fetcher *Fetcher
+	jobs    chan analyzeJob
+
+	mu      sync.RWMutex
+	results map[string]Analysis
+	pending map[string]bool
+}
+
+// NewAnalyzer starts an analyzer with the given number of workers. At most
+// queueSize covers wait for analysis; further requests are dropped and
+// retried the next time the cover is looked up.
+func NewAnalyzer(fetcher *Fetcher, workers, queueSize int) *Analyzer {
+	a := &Analyzer{
+		fetcher: fetcher,
+		jobs:    make(chan analyzeJob, queueSize),
+		results: make(map[string]Analysis),
+		pending: make(map[string]bool),
+	}
+
+	for range workers {
+		go a.worker()
+	}
+	return a
+}
+
+// Lookup returns the analysis of the cover at url, queueing the cover for
+// analysis when there is none yet. A nil Analyzer never has results.
+func (a *Analyzer) Lookup(url string) (Analysis, bool) {
+	if a == nil {
+		return Analysis{}, false
+	}
+
+	a.mu.RLock()
+	analysis, ok := a.results[url]
+	a.mu.RUnlock()
+
+	if !ok && IsAllowedURL(url) {
+		a.enqueue(analyzeJob{url: url})
+	}
+	return analysis, ok
+}
+
+// Observe queues an already decoded cover for analysis, sparing a download
+func (a *Analyzer) Observe(url string, img image.Image) {
+	if a == nil {
+		return
+	}
+
+	a.mu.RLock()
+	_, ok := a.results[url]
+	a.mu.RUnlock()
+
+	if !ok {
+		a.enqueue(analyzeJob{url: url, img: img})
+	}
+}
+
+func (a *Analyzer) enqueue(job analyzeJob) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.pending[job.url] {
+		return
+	}
+
+	select {
+	case a.jobs <- job:
+		a.pending[job.url] = true
+	default:
+		metrics.CoverAnalysesTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (a *Analyzer) worker() {
+	for job := range a.jobs {
+		a.analyze(job)
+	}
+}
+
+func (a *Analyzer) analyze(job analyzeJob) {
+	defer func() {
+		a.mu.Lock()
+		delete(a.pending, job.url)
+		a.mu.Unlock()
+	}()
+
+	img := job.img
+	if img == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), analyzeTimeout)
+		defer cancel()
+
+		var err error
+		if img, err = a.fetcher.Decode(ctx, job.url); err != nil {
+			metrics.CoverAnalysesTotal.WithLabelValues("error").Inc()
+			log.Printf("Error fetching cover for analysis: %v", err)
+			return
+		}
+	}
+
+	analysis, err := Analyze(img)
+	if err != nil {
+		metrics.CoverAnalysesTotal.WithLabelValues("error").Inc()
+		log.Printf("Error analyzing cover %s: %v", job.url, err)
+		return
+	}
+	metrics.CoverAnalysesTotal.WithLabelValues("ok").Inc()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.results) >= maxAnalyses {
+		// Results are cheap to recompute, so drop an arbitrary one
+		for url := range a.results {
+			delete(a.results, url)
+			break
+		}
+	}
+	analysis.AnalyzedAt = time.Now()
+	a.results[job.url] = analysis
+}
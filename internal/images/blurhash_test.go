@@ -0,0 +1,68 @@
+package images
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	// A mostly red cover with a blue band
+	img := image.NewRGBA(image.Rect(0, 0, 60, 90))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 60, 20), image.NewUniform(color.RGBA{0, 0, 0xff, 0xff}), image.Point{}, draw.Src)
+
+	analysis, err := Analyze(img)
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if analysis.DominantColor != "#ff0000" {
+		t.Errorf("expected dominant color #ff0000, got %s", analysis.DominantColor)
+	}
+
+	// Size flag, maximum AC value, DC value and two characters per AC component
+	wantLength := 1 + 1 + 4 + 2*(blurHashXComponents*blurHashYComponents-1)
+	if len(analysis.BlurHash) != wantLength {
+		t.Errorf("expected a %d character BlurHash, got %q", wantLength, analysis.BlurHash)
+	}
+	if !strings.HasPrefix(analysis.BlurHash, "T") {
+		t.Errorf("expected the size flag for 3x4 components, got %q", analysis.BlurHash)
+	}
+	for _, r := range analysis.BlurHash {
+		if !strings.ContainsRune(base83Chars, r) {
+			t.Errorf("unexpected character %q in BlurHash %q", r, analysis.BlurHash)
+		}
+	}
+
+	again, _ := Analyze(img)
+	if again != analysis {
+		t.Errorf("expected analysis to be deterministic, got %+v and %+v", analysis, again)
+	}
+
+	if _, err := Analyze(image.NewRGBA(image.Rect(0, 0, 0, 0))); err == nil {
+		t.Error("expected an error for an empty image")
+	}
+}
+
+func TestEncodeBase83(t *testing.T) {
+	tests := []struct {
+		value  int
+		length int
+		want   string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		// Solid red as a DC value
+		{0xff0000, 4, "TI:j"},
+	}
+
+	for _, tt := range tests {
+		if got := encodeBase83(tt.value, tt.length); got != tt.want {
+			t.Errorf("encodeBase83(%d, %d) = %q, want %q", tt.value, tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/cache"
+	"github.com/gouthamve/hardcover-book-embed/internal/metrics"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register WebP decoder, used by Hardcover's stock covers
+)
+
+const (
+	// MaxImageBytes caps the size of an upstream image we are willing to download
+	MaxImageBytes = 10 << 20
+	// MaxImagePixels caps the dimensions of an image we are willing to
+	// decode. A small file can declare huge dimensions, and decoding
+	// allocates memory for every pixel.
+	MaxImagePixels = 25_000_000
+
+	userAgent = "hardcover-book-embed/1.0"
+)
+
+// ErrHostNotAllowed is returned for image URLs outside Hardcover's asset hosts
+var ErrHostNotAllowed = errors.New("image host not allowed")
+
+// ErrImageTooLarge is returned for images with more than MaxImagePixels
+var ErrImageTooLarge = errors.New("image dimensions too large")
+
+// allowedHosts lists the hosts we will fetch cover images from
+var allowedHosts = map[string]bool{
+	"assets.hardcover.app": true,
+	"hardcover.app":        true,
+}
+
+// HTTPClient interface allows for mocking HTTP requests
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Fetcher downloads cover images from Hardcover and derives thumbnails from them
+type Fetcher struct {
+	httpClient HTTPClient
+	cache      *cache.BlobCache
+}
+
+// NewFetcher creates a new cover image fetcher backed by the given cache
+func NewFetcher(blobCache *cache.BlobCache) *Fetcher {
+	return &Fetcher{
+		httpClient: &http.Client{
+			Timeout:       10 * time.Second,
+			CheckRedirect: checkRedirect,
+		},
+		cache: blobCache,
+	}
+}
+
+// checkRedirect only follows redirects to Hardcover's asset hosts, so an
+// allowed URL can't send the fetcher to any other host
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !IsAllowedURL(req.URL.String()) {
+		return ErrHostNotAllowed
+	}
+	return nil
+}
+
+// NewFetcherWithHTTPClient creates a new cover image fetcher with a custom HTTP client
+func NewFetcherWithHTTPClient(blobCache *cache.BlobCache, httpClient HTTPClient) *Fetcher {
+	return &Fetcher{
+		httpClient: httpClient,
+		cache:      blobCache,
+	}
+}
+
+// IsAllowedURL reports whether rawURL points at one of Hardcover's asset hosts
+func IsAllowedURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "https" && u.User == nil && allowedHosts[strings.ToLower(u.Hostname())] && u.Port() == ""
+}
+
+// Fetch returns the raw bytes and content type of the image at rawURL
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, string, error) {
+	if !IsAllowedURL(rawURL) {
+		return nil, "", ErrHostNotAllowed
+	}
+
+	cacheKey := "image_" + rawURL
+	if cached, found := f.cache.Get(cacheKey); found {
+		return cached.Data, cached.ContentType, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		metrics.CoverFetchesTotal.WithLabelValues("error").Inc()
+		return nil, "", fmt.Errorf("failed to fetch image: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			// Log but don't fail on close error
+			fmt.Printf("Error closing response body: %v\n", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		metrics.CoverFetchesTotal.WithLabelValues(fmt.Sprintf("%d", resp.StatusCode)).Inc()
+		return nil, "", fmt.Errorf("image request failed with status %d", resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "image/") {
+		metrics.CoverFetchesTotal.WithLabelValues("invalid").Inc()
+		return nil, "", fmt.Errorf("unexpected content type %q", contentType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxImageBytes+1))
+	if err != nil {
+		metrics.CoverFetchesTotal.WithLabelValues("error").Inc()
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(data) > MaxImageBytes {
+		metrics.CoverFetchesTotal.WithLabelValues("too_large").Inc()
+		return nil, "", fmt.Errorf("image exceeds %d bytes", MaxImageBytes)
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	metrics.CoverFetchesTotal.WithLabelValues("200").Inc()
+	f.cache.Set(cacheKey, data, contentType)
+	return data, contentType, nil
+}
+
+// Decode fetches the image at rawURL and decodes it
+func (f *Fetcher) Decode(ctx context.Context, rawURL string) (image.Image, error) {
+	data, _, err := f.Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// decode decodes data, after checking from its header that its dimensions
+// are within MaxImagePixels
+func decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > MaxImagePixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, config.Width, config.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// Thumbnail returns a JPEG of the image at rawURL scaled to the given width,
+// preserving aspect ratio. Images narrower than width are not upscaled.
+func (f *Fetcher) Thumbnail(ctx context.Context, rawURL string, width int) ([]byte, error) {
+	cacheKey := fmt.Sprintf("thumbnail_%d_%s", width, rawURL)
+	if cached, found := f.cache.Get(cacheKey); found {
+		return cached.Data, nil
+	}
+
+	src, err := f.Decode(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	data, contentType, err := Encode(Resize(src, width), FormatJPEG)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	f.cache.Set(cacheKey, data, contentType)
+	return data, nil
+}
+
+// Output formats supported by Encode
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+// Encode encodes img as JPEG or PNG, returning the data and its content type
+func Encode(img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch format {
+	case FormatJPEG:
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	case FormatPNG:
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/png", nil
+	}
+	return nil, "", fmt.Errorf("unsupported image format %q", format)
+}
+
+// Resize scales src to the given width preserving aspect ratio. Images
+// already narrower than width are returned unchanged.
+func Resize(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if width <= 0 || bounds.Dx() <= width {
+		return src
+	}
+
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
@@ -0,0 +1,83 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/cache"
+)
+
+// pngWithSize returns a valid 1x1 PNG whose header declares width x height
+func pngWithSize(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("failed to encode PNG: %v", err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8-byte signature: length, type, then width
+	// and height, and ends with a CRC of its type and data
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestDecodeLimitsPixels(t *testing.T) {
+	if _, err := decode(pngWithSize(t, 1, 1)); err != nil {
+		t.Fatalf("expected a small image to decode, got %v", err)
+	}
+
+	_, err := decode(pngWithSize(t, 100000, 100000))
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("expected ErrImageTooLarge, got %v", err)
+	}
+}
+
+func TestFetchDoesNotFollowRedirectsOffAssetHosts(t *testing.T) {
+	var internalRequests int
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalRequests++
+	}))
+	defer internal.Close()
+
+	// The asset host redirects to a host outside the allow-list
+	client := &http.Client{
+		CheckRedirect: checkRedirect,
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Host != "assets.hardcover.app" {
+				return http.DefaultTransport.RoundTrip(req)
+			}
+			return &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{"Location": []string{internal.URL + "/secret"}},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		}),
+	}
+	fetcher := NewFetcherWithHTTPClient(cache.NewBlobCache(time.Minute, 1<<20), client)
+
+	_, _, err := fetcher.Fetch(context.Background(), "https://assets.hardcover.app/cover.jpg")
+	if !errors.Is(err, ErrHostNotAllowed) {
+		t.Errorf("expected ErrHostNotAllowed, got %v", err)
+	}
+	if internalRequests != 0 {
+		t.Errorf("expected the redirect not to be followed, got %d requests", internalRequests)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,209 @@
+// Package links expands outbound link templates, such as a bookshop page or
+// a library catalog search, for the books we serve.
+package links
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// HardcoverLink names the link to the book on Hardcover, which every book has
+	HardcoverLink = "hardcover"
+	// ReviewLink names the link to a user's review on Hardcover
+	ReviewLink = "review"
+)
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+	linkNamePattern    = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+)
+
+// Book holds the values templates can refer to
+type Book struct {
+	Slug         string
+	Title        string
+	Author       string
+	ISBN         string
+	HardcoverURL string
+}
+
+func (b Book) value(placeholder string) (string, bool) {
+	switch placeholder {
+	case "slug":
+		return b.Slug, true
+	case "title":
+		return b.Title, true
+	case "author":
+		return b.Author, true
+	case "isbn":
+		return b.ISBN, true
+	case "hardcover_url":
+		return b.HardcoverURL, true
+	}
+	return "", false
+}
+
+// sampleBook is expanded to check that templates produce valid URLs
+var sampleBook = Book{
+	Slug:         "the-hobbit",
+	Title:        "The Hobbit",
+	Author:       "J.R.R. Tolkien",
+	ISBN:         "9780547928227",
+	HardcoverURL: "https://hardcover.app/books/the-hobbit",
+}
+
+// Template is a URL with placeholders such as {isbn}
+type Template struct {
+	raw string
+}
+
+// ParseTemplate checks that raw only uses known placeholders and expands to
+// an absolute http or https URL
+func ParseTemplate(raw string) (*Template, error) {
+	for _, match := range placeholderPattern.FindAllStringSubmatch(raw, -1) {
+		if _, ok := sampleBook.value(match[1]); !ok {
+			return nil, fmt.Errorf("unknown placeholder %s", match[0])
+		}
+	}
+
+	t := &Template{raw: raw}
+	expanded, _ := t.Expand(sampleBook)
+	u, err := url.Parse(expanded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("must expand to an absolute http or https URL")
+	}
+	return t, nil
+}
+
+// Expand fills in the placeholders from book. Values are percent-encoded so
+// they are safe in a path or a query, except a placeholder that starts the
+// template, which is inserted as-is. It reports false when a placeholder has
+// no value for this book, such as {isbn} for a book without one.
+func (t *Template) Expand(book Book) (string, bool) {
+	var b strings.Builder
+	complete := true
+	last := 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(t.raw, -1) {
+		value, _ := book.value(t.raw[loc[2]:loc[3]])
+		if value == "" {
+			complete = false
+		}
+		if loc[0] != 0 {
+			value = strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+		}
+		b.WriteString(t.raw[last:loc[0]])
+		b.WriteString(value)
+		last = loc[1]
+	}
+	b.WriteString(t.raw[last:])
+	return b.String(), complete
+}
+
+// Config holds the link templates for every username, and per-username
+// templates that add to or override them
+type Config struct {
+	templates map[string]*Template
+	users     map[string]map[string]*Template
+}
+
+// configFile is the JSON layout of a link template file. A username's
+// template set to "" removes the global template of that name.
+type configFile struct {
+	Templates map[string]string            `json:"templates"`
+	Users     map[string]map[string]string `json:"users"`
+}
+
+// Load reads a JSON link template file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read link templates: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses link templates in the JSON layout of a template file
+func Parse(data []byte) (*Config, error) {
+	var file configFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse link templates: %w", err)
+	}
+
+	templates, err := parseTemplates(file.Templates, false)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{
+		templates: templates,
+		users:     make(map[string]map[string]*Template, len(file.Users)),
+	}
+	for username, raw := range file.Users {
+		userTemplates, err := parseTemplates(raw, true)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", username, err)
+		}
+		c.users[strings.ToLower(username)] = userTemplates
+	}
+	return c, nil
+}
+
+// parseTemplates parses named templates. With allowRemoval, empty templates
+// are kept as nil entries that remove a global template.
+func parseTemplates(raw map[string]string, allowRemoval bool) (map[string]*Template, error) {
+	templates := make(map[string]*Template, len(raw))
+	for name, value := range raw {
+		if !linkNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid link name %q: use up to 32 lowercase letters, digits, - or _", name)
+		}
+		if name == HardcoverLink || name == ReviewLink {
+			return nil, fmt.Errorf("link name %q is reserved", name)
+		}
+		if value == "" && allowRemoval {
+			templates[name] = nil
+			continue
+		}
+		t, err := ParseTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("link %s: %w", name, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// Expand returns the links for a book served for username, keyed by link
+// name. It always contains the Hardcover link; a nil Config has no others.
+func (c *Config) Expand(username string, book Book) map[string]string {
+	links := map[string]string{HardcoverLink: book.HardcoverURL}
+	if c == nil {
+		return links
+	}
+
+	userTemplates := c.users[strings.ToLower(username)]
+	add := func(name string, t *Template) {
+		if t == nil {
+			return
+		}
+		if link, ok := t.Expand(book); ok {
+			links[name] = link
+		}
+	}
+	for name, t := range c.templates {
+		if _, overridden := userTemplates[name]; !overridden {
+			add(name, t)
+		}
+	}
+	for name, t := range userTemplates {
+		add(name, t)
+	}
+	return links
+}
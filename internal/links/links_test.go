@@ -0,0 +1,149 @@
+package links
+
+import (
+	"strings"
+	"testing"
+)
+
+var hobbit = Book{
+	Slug:         "the-hobbit",
+	Title:        "The Hobbit & Me",
+	Author:       "J.R.R. Tolkien",
+	ISBN:         "9780547928227",
+	HardcoverURL: "https://hardcover.app/books/the-hobbit",
+}
+
+func TestTemplateExpand(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		book     Book
+		want     string
+		complete bool
+	}{
+		{
+			name:     "values are percent-encoded",
+			template: "https://library.example/search?q={title}%20{author}",
+			book:     hobbit,
+			want:     "https://library.example/search?q=The%20Hobbit%20%26%20Me%20J.R.R.%20Tolkien",
+			complete: true,
+		},
+		{
+			name:     "path placeholders",
+			template: "https://bookshop.org/a/12345/{isbn}",
+			book:     hobbit,
+			want:     "https://bookshop.org/a/12345/9780547928227",
+			complete: true,
+		},
+		{
+			name:     "a leading placeholder is inserted as-is",
+			template: "{hardcover_url}?ref=blog&back={hardcover_url}",
+			book:     hobbit,
+			want:     "https://hardcover.app/books/the-hobbit?ref=blog&back=https%3A%2F%2Fhardcover.app%2Fbooks%2Fthe-hobbit",
+			complete: true,
+		},
+		{
+			name:     "missing values are reported",
+			template: "https://bookshop.org/a/12345/{isbn}",
+			book:     Book{Slug: "no-isbn"},
+			want:     "https://bookshop.org/a/12345/",
+			complete: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParseTemplate failed: %v", err)
+			}
+			got, complete := tmpl.Expand(tt.book)
+			if got != tt.want || complete != tt.complete {
+				t.Errorf("Expand() = %q, %v, want %q, %v", got, complete, tt.want, tt.complete)
+			}
+		})
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, template := range []string{
+		"https://example.com/{publisher}",
+		"/books/{slug}",
+		"javascript:alert({title})",
+		"{title}",
+	} {
+		if _, err := ParseTemplate(template); err == nil {
+			t.Errorf("expected an error for %q", template)
+		}
+	}
+}
+
+func TestConfigExpand(t *testing.T) {
+	config, err := Parse([]byte(`{
+		"templates": {
+			"bookshop": "https://bookshop.org/a/12345/{isbn}",
+			"library": "https://library.example/search?q={title}"
+		},
+		"users": {
+			"Alice": {
+				"bookshop": "https://bookshop.org/a/999/{isbn}",
+				"library": "",
+				"blog": "https://alice.example/reviews/{slug}"
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	got := config.Expand("bob", hobbit)
+	if len(got) != 3 || got["bookshop"] != "https://bookshop.org/a/12345/9780547928227" || got[HardcoverLink] != hobbit.HardcoverURL {
+		t.Errorf("unexpected global links: %v", got)
+	}
+
+	got = config.Expand("alice", hobbit)
+	want := map[string]string{
+		HardcoverLink: hobbit.HardcoverURL,
+		"bookshop":    "https://bookshop.org/a/999/9780547928227",
+		"blog":        "https://alice.example/reviews/the-hobbit",
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected links %v, got %v", want, got)
+	}
+	for name, link := range want {
+		if got[name] != link {
+			t.Errorf("link %s: expected %q, got %q", name, link, got[name])
+		}
+	}
+
+	// Links whose placeholders have no value are left out
+	if got := config.Expand("bob", Book{Title: "Untitled", HardcoverURL: hobbit.HardcoverURL}); len(got) != 2 {
+		t.Errorf("expected the bookshop link to be left out, got %v", got)
+	}
+
+	var none *Config
+	if got := none.Expand("bob", hobbit); len(got) != 1 {
+		t.Errorf("expected only the Hardcover link without templates, got %v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{`{"templates": {"Bad Name": "https://example.com"}}`, "invalid link name"},
+		{`{"templates": {"hardcover": "https://example.com"}}`, "reserved"},
+		{`{"users": {"alice": {"review": "https://example.com"}}}`, "reserved"},
+		{`{"templates": {"shop": ""}}`, "link shop"},
+		{`{"users": {"alice": {"shop": "ftp://example.com/{isbn}"}}}`, "user alice"},
+		{`{"templates": []}`, "failed to parse"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.config))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%s): expected error containing %q, got %v", tt.config, tt.want, err)
+		}
+	}
+}
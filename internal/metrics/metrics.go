@@ -35,7 +35,7 @@ var (
 	CacheHitsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hardcoverembed_cache_hits_total",
-			Help: "Total number of cache hits",
+			Help: "Total number of cache hits. Usernames without their own label are \"other\"",
 		},
 		[]string{"endpoint", "username"},
 	)
@@ -43,7 +43,7 @@ var (
 	CacheMissesTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hardcoverembed_cache_misses_total",
-			Help: "Total number of cache misses",
+			Help: "Total number of cache misses. Usernames without their own label are \"other\"",
 		},
 		[]string{"endpoint", "username"},
 	)
@@ -62,11 +62,32 @@ var (
 		},
 	)
 
+	BlobCacheSize = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hardcoverembed_blob_cache_size",
+			Help: "Current number of binary payloads (images) in cache",
+		},
+	)
+
+	BlobCacheBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hardcoverembed_blob_cache_bytes",
+			Help: "Current total size in bytes of the binary payloads in cache",
+		},
+	)
+
+	DiskCacheFiles = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hardcoverembed_disk_cache_files",
+			Help: "Number of unexpired files in the on-disk image cache, updated on cleanup",
+		},
+	)
+
 	// Hardcover API Metrics
 	HardcoverAPIRequestsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hardcoverembed_hardcover_api_requests_total",
-			Help: "Total number of Hardcover API requests",
+			Help: "Total number of Hardcover API requests. Usernames without their own label are \"other\"",
 		},
 		[]string{"endpoint", "status", "username"},
 	)
@@ -74,7 +95,7 @@ var (
 	HardcoverAPIRequestDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "hardcoverembed_hardcover_api_request_duration_seconds",
-			Help:    "Hardcover API request latency in seconds",
+			Help:    "Hardcover API request latency in seconds. Usernames without their own label are \"other\"",
 			Buckets: prometheus.DefBuckets,
 		},
 		[]string{"endpoint", "username"},
@@ -90,6 +111,124 @@ var (
 		[]string{"endpoint"},
 	)
 
+	// Cover Image Metrics
+	CoverFetchesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_cover_fetches_total",
+			Help: "Total number of cover image fetches from Hardcover asset hosts",
+		},
+		[]string{"status"},
+	)
+
+	ImageProxyRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_image_proxy_requests_total",
+			Help: "Total number of cover proxy requests by cache result",
+		},
+		[]string{"result"},
+	)
+
+	CoverAnalysesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_cover_analyses_total",
+			Help: "Total number of background cover analyses (BlurHash and dominant color) by result",
+		},
+		[]string{"result"},
+	)
+
+	// Click Tracking Metrics
+	ClicksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_clicks_total",
+			Help: "Total number of clicks on books in embeds, by shelf and referring origin",
+		},
+		[]string{"shelf", "origin"},
+	)
+
+	EmbedImpressionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_embed_impressions_total",
+			Help: "Total number of embed loads by shelf and embedding origin",
+		},
+		[]string{"shelf", "origin"},
+	)
+
+	// Review Sanitizer Metrics
+	ReviewHTMLSanitizedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_review_html_sanitized_total",
+			Help: "Total number of upstream review HTML documents sanitized, by whether content was removed",
+		},
+		[]string{"result"},
+	)
+
+	ReviewHTMLRemovalsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_review_html_removals_total",
+			Help: "Total number of elements, attributes and URLs removed from upstream review HTML",
+		},
+		[]string{"kind"},
+	)
+
+	OriginDenialsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_origin_denials_total",
+			Help: "Total number of API requests denied because the requesting origin is not bound to the username",
+		},
+		[]string{"shelf", "username", "origin"},
+	)
+
+	EmbedTokenChecksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_embed_token_checks_total",
+			Help: "Total number of embed token checks, by shelf and result",
+		},
+		[]string{"shelf", "result"},
+	)
+
+	// Inbound Rate Limit Metrics
+	RateLimitedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_rate_limited_requests_total",
+			Help: "Total number of requests refused with 429, by endpoint and the limit exceeded",
+		},
+		[]string{"endpoint", "limit"},
+	)
+
+	RateLimitBuckets = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hardcoverembed_rate_limit_buckets",
+			Help: "Current number of inbound rate limit buckets, by limit",
+		},
+		[]string{"limit"},
+	)
+
+	// Content Security Policy Metrics
+	CSPViolationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_csp_violations_total",
+			Help: "Total number of Content-Security-Policy violations reported by browsers, by directive and blocked origin",
+		},
+		[]string{"directive", "origin"},
+	)
+
+	// Compression Metrics
+	CompressionInputBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_compression_input_bytes_total",
+			Help: "Total bytes of compressed responses before compression",
+		},
+		[]string{"handler", "encoding"},
+	)
+
+	CompressionOutputBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hardcoverembed_compression_output_bytes_total",
+			Help: "Total bytes of compressed responses after compression",
+		},
+		[]string{"handler", "encoding"},
+	)
+
 	// Static File Metrics
 	StaticFileRequestsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -0,0 +1,235 @@
+package metrics
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// OtherUsername is the label value for usernames without their own label
+	OtherUsername = "other"
+
+	// maxTrackedUsernames caps the per-username debug detail
+	maxTrackedUsernames = 10000
+
+	// usernameDecayInterval is how often request scores are halved, so the
+	// top usernames follow recent traffic and idle usernames are forgotten
+	usernameDecayInterval = time.Hour
+)
+
+// usernameVecs are the metrics labelled by username. When a username loses
+// its label its series are deleted, so churn in the top usernames doesn't
+// grow cardinality.
+var usernameVecs = []interface {
+	DeletePartialMatch(prometheus.Labels) int
+}{
+	CacheHitsTotal,
+	CacheMissesTotal,
+	HardcoverAPIRequestsTotal,
+	HardcoverAPIRequestDuration,
+	OriginDenialsTotal,
+}
+
+// Usernames decides which usernames get their own label value on the
+// username-labelled metrics, and keeps per-username detail for the debug
+// endpoint. By default no username is labelled.
+var Usernames = NewUsernameTracker(nil, 0)
+
+// UsernameStats is the per-username detail served by the debug endpoint
+type UsernameStats struct {
+	Username          string           `json:"username"`
+	Requests          int64            `json:"requests"`
+	CacheHits         int64            `json:"cache_hits"`
+	CacheMisses       int64            `json:"cache_misses"`
+	HardcoverRequests map[string]int64 `json:"hardcover_requests"`
+	HardcoverSeconds  float64          `json:"hardcover_seconds"`
+	HasUsernameLabel  bool             `json:"has_username_label"`
+	LastRequestAt     time.Time        `json:"last_request_at"`
+
+	// score ranks the username for the top usernames. It counts requests
+	// like Requests, but is halved every usernameDecayInterval.
+	score int64
+}
+
+// UsernameTracker bounds the username label to an allow-list plus the topN
+// most requested usernames. Every other username is labelled "other".
+//
+// Request counts decay, so usernames that stop being requested drop out of
+// the top usernames and, once idle, out of the debug detail, making room for
+// new ones.
+type UsernameTracker struct {
+	mu    sync.Mutex
+	allow map[string]bool
+	topN  int
+	// top holds the usernames currently among the topN most requested
+	top       map[string]bool
+	stats     map[string]*UsernameStats
+	lastDecay time.Time
+}
+
+// NewUsernameTracker creates a tracker labelling the allowed usernames and
+// the topN most requested ones
+func NewUsernameTracker(allow []string, topN int) *UsernameTracker {
+	t := &UsernameTracker{
+		allow:     make(map[string]bool, len(allow)),
+		topN:      topN,
+		top:       make(map[string]bool),
+		stats:     make(map[string]*UsernameStats),
+		lastDecay: time.Now(),
+	}
+	for _, username := range allow {
+		if username = strings.ToLower(strings.TrimSpace(username)); username != "" {
+			t.allow[username] = true
+		}
+	}
+	return t
+}
+
+// Label returns the username label value to use for username
+func (t *UsernameTracker) Label(username string) string {
+	username = strings.ToLower(username)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.allow[username] || t.top[username] {
+		return username
+	}
+	return OtherUsername
+}
+
+// RecordCache records a cache lookup, made once per request for a username.
+// Requests decide the topN usernames.
+func (t *UsernameTracker) RecordCache(username string, hit bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastDecay) >= usernameDecayInterval {
+		t.decay()
+		t.lastDecay = now
+	}
+
+	stats := t.userStats(strings.ToLower(username))
+	stats.Requests++
+	stats.score++
+	stats.LastRequestAt = now
+	if hit {
+		stats.CacheHits++
+	} else {
+		stats.CacheMisses++
+	}
+	t.rank(stats)
+}
+
+// RecordHardcoverRequest records a Hardcover API request made for username
+func (t *UsernameTracker) RecordHardcoverRequest(username, status string, duration time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.userStats(strings.ToLower(username))
+	stats.HardcoverRequests[status]++
+	stats.HardcoverSeconds += duration.Seconds()
+}
+
+// userStats returns the detail for username. When too many usernames are
+// tracked, scores decay until the least requested ones are dropped.
+func (t *UsernameTracker) userStats(username string) *UsernameStats {
+	stats, ok := t.stats[username]
+	if !ok {
+		for len(t.stats) >= maxTrackedUsernames {
+			t.decay()
+		}
+		stats = &UsernameStats{Username: username, HardcoverRequests: make(map[string]int64)}
+		t.stats[username] = stats
+	}
+	return stats
+}
+
+// rank moves stats into the top usernames when it outranks the least
+// requested of them
+func (t *UsernameTracker) rank(stats *UsernameStats) {
+	if t.topN <= 0 || t.top[stats.Username] {
+		return
+	}
+	if len(t.top) < t.topN {
+		t.top[stats.Username] = true
+		return
+	}
+
+	lowest := ""
+	for username := range t.top {
+		if lowest == "" || t.stats[username].score < t.stats[lowest].score {
+			lowest = username
+		}
+	}
+	if stats.score > t.stats[lowest].score {
+		t.demote(lowest)
+		t.top[stats.Username] = true
+	}
+}
+
+// decay halves every score and drops the usernames whose score reaches zero
+func (t *UsernameTracker) decay() {
+	for username, stats := range t.stats {
+		stats.score /= 2
+		if stats.score == 0 {
+			delete(t.stats, username)
+			if t.top[username] {
+				t.demote(username)
+			}
+		}
+	}
+}
+
+// demote removes username from the top usernames and deletes its series,
+// unless it is allowed its own label anyway
+func (t *UsernameTracker) demote(username string) {
+	delete(t.top, username)
+	if t.allow[username] {
+		return
+	}
+	for _, vec := range usernameVecs {
+		vec.DeletePartialMatch(prometheus.Labels{"username": username})
+	}
+}
+
+// Snapshot returns the per-username detail, most requested first
+func (t *UsernameTracker) Snapshot() []UsernameStats {
+	t.mu.Lock()
+	snapshot := make([]UsernameStats, 0, len(t.stats))
+	for username, stats := range t.stats {
+		s := *stats
+		s.HardcoverRequests = make(map[string]int64, len(stats.HardcoverRequests))
+		for status, n := range stats.HardcoverRequests {
+			s.HardcoverRequests[status] = n
+		}
+		s.HasUsernameLabel = t.allow[username] || t.top[username]
+		snapshot = append(snapshot, s)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Requests != snapshot[j].Requests {
+			return snapshot[i].Requests > snapshot[j].Requests
+		}
+		return snapshot[i].Username < snapshot[j].Username
+	})
+	return snapshot
+}
+
+// HandleDebug serves the per-username detail as JSON. It is meant for the
+// metrics port, away from the public API.
+func (t *UsernameTracker) HandleDebug(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Snapshot()); err != nil {
+		log.Printf("Error encoding username stats: %v", err)
+	}
+}
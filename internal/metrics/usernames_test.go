@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsernameTrackerLabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    []string
+		topN     int
+		requests []string
+		want     map[string]string
+	}{
+		{
+			name:     "no usernames labelled by default",
+			requests: []string{"alice", "alice", "bob"},
+			want:     map[string]string{"alice": OtherUsername, "bob": OtherUsername},
+		},
+		{
+			name:  "allow-list",
+			allow: []string{" Alice ", ""},
+			want:  map[string]string{"alice": "alice", "ALICE": "alice", "bob": OtherUsername},
+		},
+		{
+			name:     "top N",
+			topN:     1,
+			requests: []string{"alice", "bob", "bob"},
+			want:     map[string]string{"alice": OtherUsername, "bob": "bob", "carol": OtherUsername},
+		},
+		{
+			name:     "top N keeps ties",
+			topN:     1,
+			requests: []string{"alice", "bob"},
+			want:     map[string]string{"alice": "alice", "bob": OtherUsername},
+		},
+		{
+			name:     "allow-list and top N",
+			allow:    []string{"carol"},
+			topN:     1,
+			requests: []string{"alice", "bob", "bob", "bob"},
+			want:     map[string]string{"alice": OtherUsername, "bob": "bob", "carol": "carol"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewUsernameTracker(tt.allow, tt.topN)
+			for _, username := range tt.requests {
+				tracker.RecordCache(username, false)
+			}
+			for username, want := range tt.want {
+				if got := tracker.Label(username); got != want {
+					t.Errorf("Label(%q) = %q, want %q", username, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUsernameTrackerSnapshot(t *testing.T) {
+	tracker := NewUsernameTracker([]string{"bob"}, 0)
+	tracker.RecordCache("Alice", false)
+	tracker.RecordHardcoverRequest("alice", "200", 2*time.Second)
+	tracker.RecordCache("alice", true)
+	tracker.RecordCache("bob", true)
+
+	snapshot := tracker.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Snapshot() returned %d usernames, want 2", len(snapshot))
+	}
+
+	alice := snapshot[0]
+	if alice.Username != "alice" || alice.Requests != 2 || alice.CacheHits != 1 || alice.CacheMisses != 1 {
+		t.Errorf("Snapshot()[0] = %+v, want alice with 2 requests, 1 hit and 1 miss", alice)
+	}
+	if alice.HardcoverRequests["200"] != 1 || alice.HardcoverSeconds != 2 {
+		t.Errorf("alice Hardcover requests = %v in %vs, want one 200 in 2s", alice.HardcoverRequests, alice.HardcoverSeconds)
+	}
+	if alice.HasUsernameLabel {
+		t.Error("alice should not have a username label")
+	}
+	if bob := snapshot[1]; bob.Username != "bob" || !bob.HasUsernameLabel {
+		t.Errorf("Snapshot()[1] = %+v, want labelled bob", bob)
+	}
+
+	// The snapshot is a copy
+	snapshot[0].HardcoverRequests["200"] = 10
+	if got := tracker.Snapshot()[0].HardcoverRequests["200"]; got != 1 {
+		t.Errorf("Snapshot() shares state with the tracker: got %d Hardcover requests", got)
+	}
+}
+
+func TestUsernameTrackerHandleDebug(t *testing.T) {
+	tracker := NewUsernameTracker(nil, 0)
+	tracker.RecordCache("alice", true)
+
+	rr := httptest.NewRecorder()
+	tracker.HandleDebug(rr, httptest.NewRequest(http.MethodGet, "/debug/usernames", nil))
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var stats []UsernameStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Username != "alice" || stats[0].CacheHits != 1 {
+		t.Errorf("HandleDebug() = %+v, want alice with 1 cache hit", stats)
+	}
+}
+
+func TestUsernameTrackerDeletesDemotedSeries(t *testing.T) {
+	tracker := NewUsernameTracker(nil, 1)
+	tracker.RecordCache("alice", false)
+	CacheMissesTotal.WithLabelValues("test", tracker.Label("alice")).Inc()
+
+	// bob outranks alice, whose series go with her label
+	tracker.RecordCache("bob", false)
+	tracker.RecordCache("bob", false)
+	if got := tracker.Label("alice"); got != OtherUsername {
+		t.Fatalf("Label(alice) = %q, want %q", got, OtherUsername)
+	}
+	if CacheMissesTotal.DeleteLabelValues("test", "alice") {
+		t.Error("expected alice's series to be deleted when she left the top usernames")
+	}
+}
+
+func TestUsernameTrackerDecay(t *testing.T) {
+	tracker := NewUsernameTracker(nil, 1)
+	for range 4 {
+		tracker.RecordCache("alice", false)
+	}
+	tracker.RecordCache("bob", false)
+
+	// bob's single request decays away, alice keeps half her score
+	tracker.decay()
+	if got := tracker.Label("alice"); got != "alice" {
+		t.Errorf("Label(alice) = %q, want alice", got)
+	}
+	if snapshot := tracker.Snapshot(); len(snapshot) != 1 || snapshot[0].Username != "alice" {
+		t.Errorf("Snapshot() = %+v, want only alice", snapshot)
+	}
+
+	// Once alice is idle long enough, she loses her label
+	tracker.decay()
+	tracker.decay()
+	if got := tracker.Label("alice"); got != OtherUsername {
+		t.Errorf("Label(alice) = %q, want %q", got, OtherUsername)
+	}
+}
+
+func TestUsernameTrackerEvictsWhenFull(t *testing.T) {
+	tracker := NewUsernameTracker(nil, 1)
+	for i := range maxTrackedUsernames {
+		tracker.RecordCache(fmt.Sprintf("user%d", i), false)
+	}
+
+	// New usernames can still be tracked and reach the top
+	for range 3 {
+		tracker.RecordCache("carol", false)
+	}
+	if got := tracker.Label("carol"); got != "carol" {
+		t.Errorf("Label(carol) = %q, want carol", got)
+	}
+	if n := len(tracker.Snapshot()); n > maxTrackedUsernames {
+		t.Errorf("tracking %d usernames, want at most %d", n, maxTrackedUsernames)
+	}
+}
@@ -0,0 +1,187 @@
+// Package ogimage renders Open Graph preview images for shelves and reviews
+// using only image/draw and the bundled Go fonts.
+package ogimage
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// Width and Height are the recommended Open Graph image dimensions
+	Width  = 1200
+	Height = 630
+
+	// MaxCovers is the number of covers drawn on a card
+	MaxCovers = 5
+
+	margin   = 64
+	coverGap = 23
+	coverW   = (Width - 2*margin - (MaxCovers-1)*coverGap) / MaxCovers
+	coverH   = coverW * 3 / 2
+	coverTop = 250
+)
+
+var (
+	background = color.RGBA{0x1f, 0x29, 0x37, 0xff}
+	foreground = color.RGBA{0xf9, 0xfa, 0xfb, 0xff}
+	muted      = color.RGBA{0x9c, 0xa3, 0xaf, 0xff}
+	accent     = color.RGBA{0x63, 0x66, 0xf1, 0xff}
+	coverFill  = color.RGBA{0x37, 0x41, 0x51, 0xff}
+)
+
+// Card describes the content of a preview image
+type Card struct {
+	Heading  string
+	Username string
+	Titles   []string
+	// Covers holds decoded cover images indexed like Titles. Nil entries
+	// are drawn as blank placeholders.
+	Covers []image.Image
+}
+
+type faces struct {
+	heading  font.Face
+	username font.Face
+	caption  font.Face
+}
+
+var (
+	parseFontsOnce sync.Once
+	regularFont    *opentype.Font
+	boldFont       *opentype.Font
+	parseFontsErr  error
+)
+
+// newFaces creates the faces for a single render. Fonts are parsed once per
+// process, but faces are not safe for concurrent use so each render gets its own.
+func newFaces() (faces, error) {
+	parseFontsOnce.Do(func() {
+		regularFont, parseFontsErr = opentype.Parse(goregular.TTF)
+		if parseFontsErr != nil {
+			return
+		}
+		boldFont, parseFontsErr = opentype.Parse(gobold.TTF)
+	})
+	if parseFontsErr != nil {
+		return faces{}, fmt.Errorf("failed to parse bundled font: %w", parseFontsErr)
+	}
+
+	var f faces
+	var err error
+	if f.heading, err = newFace(regularFont, 36); err != nil {
+		return faces{}, err
+	}
+	if f.username, err = newFace(boldFont, 64); err != nil {
+		return faces{}, err
+	}
+	if f.caption, err = newFace(regularFont, 20); err != nil {
+		return faces{}, err
+	}
+	return f, nil
+}
+
+func newFace(f *opentype.Font, size float64) (font.Face, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create font face: %w", err)
+	}
+	return face, nil
+}
+
+// Render draws card as a Width x Height PNG
+func Render(card Card) ([]byte, error) {
+	f, err := newFaces()
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(0, 0, Width, 12), image.NewUniform(accent), image.Point{}, draw.Src)
+
+	drawText(dst, f.heading, muted, margin, 110, card.Heading, Width-2*margin)
+	drawText(dst, f.username, foreground, margin, 190, "@"+card.Username, Width-2*margin)
+
+	for i := 0; i < len(card.Titles) && i < MaxCovers; i++ {
+		x := margin + i*(coverW+coverGap)
+		rect := image.Rect(x, coverTop, x+coverW, coverTop+coverH)
+
+		var cover image.Image
+		if i < len(card.Covers) {
+			cover = card.Covers[i]
+		}
+		drawCover(dst, rect, cover)
+		drawText(dst, f.caption, foreground, x, coverTop+coverH+32, card.Titles[i], coverW)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// drawCover scales src to fill rect, cropping whichever dimension overflows
+func drawCover(dst draw.Image, rect image.Rectangle, src image.Image) {
+	if src == nil {
+		draw.Draw(dst, rect, image.NewUniform(coverFill), image.Point{}, draw.Src)
+		return
+	}
+
+	sb := src.Bounds()
+	crop := sb
+	// Compare aspect ratios: src wider than rect means trimming the sides
+	if sb.Dx()*rect.Dy() > sb.Dy()*rect.Dx() {
+		w := sb.Dy() * rect.Dx() / rect.Dy()
+		crop.Min.X = sb.Min.X + (sb.Dx()-w)/2
+		crop.Max.X = crop.Min.X + w
+	} else {
+		h := sb.Dx() * rect.Dy() / rect.Dx()
+		crop.Min.Y = sb.Min.Y + (sb.Dy()-h)/2
+		crop.Max.Y = crop.Min.Y + h
+	}
+
+	draw.CatmullRom.Scale(dst, rect, src, crop, draw.Src, nil)
+}
+
+// drawText draws s with its baseline at (x, y), truncated with an ellipsis
+// to fit within maxWidth pixels
+func drawText(dst draw.Image, face font.Face, c color.Color, x, y int, s string, maxWidth int) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(fitText(face, s, maxWidth))
+}
+
+// fitText shortens s rune by rune until it fits within maxWidth pixels
+func fitText(face font.Face, s string, maxWidth int) string {
+	limit := fixed.I(maxWidth)
+	if font.MeasureString(face, s) <= limit {
+		return s
+	}
+
+	runes := []rune(s)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		candidate := string(runes) + "…"
+		if font.MeasureString(face, candidate) <= limit {
+			return candidate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,263 @@
+// Package placeholder draws stand-in covers for books without one, showing
+// the title and author on a background color derived from the book ID.
+package placeholder
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Covers are laid out on a 200x300 canvas and scaled for raster output
+const (
+	baseWidth  = 200
+	baseHeight = 300
+
+	padding        = 24
+	titleTop       = 70
+	titleSize      = 20
+	titleLeading   = 24
+	titleMaxLines  = 6
+	authorBaseline = 264
+	authorSize     = 13
+
+	// Character budgets for SVG lines, whose fonts we cannot measure
+	titleLineRunes  = 15
+	authorLineRunes = 24
+)
+
+var foreground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+
+// Cover describes a placeholder cover
+type Cover struct {
+	BookID int
+	Title  string
+	Author string
+}
+
+// Color returns the background color for a book. Hues are spread by the
+// golden angle so neighbouring IDs get clearly different colors.
+func Color(bookID int) color.RGBA {
+	hue := math.Mod(float64(bookID)*137.508, 360)
+	if hue < 0 {
+		hue += 360
+	}
+	return hslToRGB(hue, 0.45, 0.32)
+}
+
+func hslToRGB(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return color.RGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 0xff,
+	}
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// SVG renders the cover as a 200x300 SVG document
+func SVG(c Cover) []byte {
+	runeFit := func(limit int) func(string) bool {
+		return func(s string) bool { return len([]rune(s)) <= limit }
+	}
+	title := wrapLines(c.Title, titleMaxLines, runeFit(titleLineRunes))
+	author := wrapLines(c.Author, 1, runeFit(authorLineRunes))
+
+	label := c.Title
+	if c.Author != "" {
+		label += " by " + c.Author
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img" aria-label="%s">`,
+		baseWidth, baseHeight, baseWidth, baseHeight, html.EscapeString(label))
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="%s"/>`, baseWidth, baseHeight, hexColor(Color(c.BookID)))
+	fmt.Fprintf(&b, `<rect x="12" y="12" width="%d" height="%d" fill="none" stroke="#ffffff" stroke-opacity="0.35" stroke-width="2"/>`,
+		baseWidth-24, baseHeight-24)
+
+	if len(title) > 0 {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="Georgia, 'Times New Roman', serif" font-size="%d" font-weight="bold" fill="#ffffff">`,
+			padding, titleTop, titleSize)
+		for i, line := range title {
+			dy := 0
+			if i > 0 {
+				dy = titleLeading
+			}
+			fmt.Fprintf(&b, `<tspan x="%d" dy="%d">%s</tspan>`, padding, dy, html.EscapeString(line))
+		}
+		b.WriteString(`</text>`)
+	}
+
+	if len(author) > 0 {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="-apple-system, BlinkMacSystemFont, 'Segoe UI', sans-serif" font-size="%d" fill="#ffffff" fill-opacity="0.85">%s</text>`,
+			padding, authorBaseline, authorSize, html.EscapeString(author[0]))
+	}
+
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+var (
+	parseFontsOnce sync.Once
+	regularFont    *opentype.Font
+	boldFont       *opentype.Font
+	parseFontsErr  error
+)
+
+func newFace(f *opentype.Font, size float64) (font.Face, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create font face: %w", err)
+	}
+	return face, nil
+}
+
+// Image draws the cover at the given width, with a 2:3 aspect ratio
+func Image(c Cover, width int) (image.Image, error) {
+	parseFontsOnce.Do(func() {
+		regularFont, parseFontsErr = opentype.Parse(goregular.TTF)
+		if parseFontsErr != nil {
+			return
+		}
+		boldFont, parseFontsErr = opentype.Parse(gobold.TTF)
+	})
+	if parseFontsErr != nil {
+		return nil, fmt.Errorf("failed to parse bundled font: %w", parseFontsErr)
+	}
+
+	scale := float64(width) / baseWidth
+	px := func(v int) int { return int(math.Round(float64(v) * scale)) }
+
+	// Faces are not safe for concurrent use, so each render gets its own
+	titleFace, err := newFace(boldFont, titleSize*scale)
+	if err != nil {
+		return nil, err
+	}
+	authorFace, err := newFace(regularFont, authorSize*scale)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, px(baseHeight)))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(Color(c.BookID)), image.Point{}, draw.Src)
+
+	// Inset frame, drawn as four translucent bars
+	frame := image.NewUniform(color.RGBA{0x59, 0x59, 0x59, 0x59})
+	inset, stroke := px(11), max(px(2), 1)
+	outer := image.Rect(inset, inset, width-inset, px(baseHeight)-inset)
+	for _, r := range []image.Rectangle{
+		{outer.Min, image.Pt(outer.Max.X, outer.Min.Y+stroke)},
+		{image.Pt(outer.Min.X, outer.Max.Y-stroke), outer.Max},
+		{image.Pt(outer.Min.X, outer.Min.Y+stroke), image.Pt(outer.Min.X+stroke, outer.Max.Y-stroke)},
+		{image.Pt(outer.Max.X-stroke, outer.Min.Y+stroke), image.Pt(outer.Max.X, outer.Max.Y-stroke)},
+	} {
+		draw.Draw(dst, r, frame, image.Point{}, draw.Over)
+	}
+
+	maxWidth := fixed.I(width - 2*px(padding))
+	measureFit := func(face font.Face) func(string) bool {
+		return func(s string) bool { return font.MeasureString(face, s) <= maxWidth }
+	}
+
+	d := &font.Drawer{Dst: dst, Src: image.NewUniform(foreground), Face: titleFace}
+	for i, line := range wrapLines(c.Title, titleMaxLines, measureFit(titleFace)) {
+		d.Dot = fixed.P(px(padding), px(titleTop+i*titleLeading))
+		d.DrawString(line)
+	}
+
+	if author := wrapLines(c.Author, 1, measureFit(authorFace)); len(author) > 0 {
+		d.Face = authorFace
+		d.Dot = fixed.P(px(padding), px(authorBaseline))
+		d.DrawString(author[0])
+	}
+
+	return dst, nil
+}
+
+// wrapLines breaks s into at most maxLines lines between words. Lines that
+// still do not fit, including the last when text is left over, end in an
+// ellipsis.
+func wrapLines(s string, maxLines int, fits func(string) bool) []string {
+	words := strings.Fields(s)
+	var lines []string
+	line := ""
+	for i, word := range words {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if fits(candidate) {
+			line = candidate
+			continue
+		}
+
+		if len(lines) == maxLines-1 {
+			// Last line: take everything left and let ellipsize cut it
+			line = strings.TrimSpace(line + " " + strings.Join(words[i:], " "))
+			break
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	for i, l := range lines {
+		lines[i] = ellipsize(l, fits)
+	}
+	return lines
+}
+
+// ellipsize shortens s rune by rune until it fits
+func ellipsize(s string, fits func(string) bool) string {
+	if fits(s) {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		candidate := strings.TrimRight(string(runes), " ") + "…"
+		if fits(candidate) {
+			return candidate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package placeholder
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestWrapLines(t *testing.T) {
+	fits := func(s string) bool { return len([]rune(s)) <= 10 }
+
+	tests := []struct {
+		name     string
+		input    string
+		maxLines int
+		want     []string
+	}{
+		{
+			name:     "short text stays on one line",
+			input:    "Dune",
+			maxLines: 3,
+			want:     []string{"Dune"},
+		},
+		{
+			name:     "words wrap between lines",
+			input:    "The Left Hand of Darkness",
+			maxLines: 3,
+			want:     []string{"The Left", "Hand of", "Darkness"},
+		},
+		{
+			name:     "leftover text is ellipsized on the last line",
+			input:    "The Left Hand of Darkness",
+			maxLines: 2,
+			want:     []string{"The Left", "Hand of D…"},
+		},
+		{
+			name:     "long words are ellipsized",
+			input:    "Supercalifragilistic",
+			maxLines: 2,
+			want:     []string{"Supercali…"},
+		},
+		{
+			name:     "empty text has no lines",
+			input:    "  ",
+			maxLines: 2,
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wrapLines(tt.input, tt.maxLines, fits)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("wrapLines(%q, %d) = %q, want %q", tt.input, tt.maxLines, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColor(t *testing.T) {
+	if Color(42) != Color(42) {
+		t.Error("expected the same color for the same book")
+	}
+	if Color(42) == Color(43) {
+		t.Error("expected neighbouring books to get different colors")
+	}
+}
+
+func TestSVG(t *testing.T) {
+	svg := SVG(Cover{BookID: 7, Title: `Tom & Jerry <3`, Author: "A. Author"})
+
+	if err := xml.Unmarshal(svg, new(struct{})); err != nil {
+		t.Fatalf("expected well-formed SVG, got %v: %s", err, svg)
+	}
+	for _, want := range []string{"Tom &amp; Jerry &lt;3", "A. Author", hexColor(Color(7))} {
+		if !strings.Contains(string(svg), want) {
+			t.Errorf("expected SVG to contain %q: %s", want, svg)
+		}
+	}
+}
+
+func TestImage(t *testing.T) {
+	img, err := Image(Cover{BookID: 7, Title: "A Long Book Title That Wraps", Author: "A. Author"}, 120)
+	if err != nil {
+		t.Fatalf("Image failed: %v", err)
+	}
+	if got := img.Bounds().Dx(); got != 120 {
+		t.Errorf("expected width 120, got %d", got)
+	}
+	if got := img.Bounds().Dy(); got != 180 {
+		t.Errorf("expected height 180, got %d", got)
+	}
+}
@@ -0,0 +1,43 @@
+package review
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Excerpt shortens text to at most limit characters, not counting a trailing
+// ellipsis. It cuts after the last sentence that ends in the second half of
+// the limit, or otherwise between words, and collapses whitespace. truncated
+// reports whether anything was cut.
+func Excerpt(text string, limit int) (excerpt string, truncated bool) {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= limit {
+		return string(runes), false
+	}
+
+	for i := limit - 1; i >= limit/2; i-- {
+		if strings.ContainsRune(".!?…", runes[i]) && unicode.IsSpace(runes[i+1]) {
+			return string(runes[:i+1]), true
+		}
+	}
+
+	end := limit
+	if !unicode.IsSpace(runes[end]) {
+		for end > 0 && !unicode.IsSpace(runes[end-1]) {
+			end--
+		}
+		if end == 0 {
+			// A single word longer than the limit: cut it, but never
+			// between a character and its combining marks
+			end = limit
+			for end > 0 && unicode.Is(unicode.Mn, runes[end]) {
+				end--
+			}
+		}
+	}
+
+	excerpt = strings.TrimRightFunc(string(runes[:end]), func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(",;:-–—", r)
+	})
+	return excerpt + "…", true
+}
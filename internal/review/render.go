@@ -0,0 +1,358 @@
+package review
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Only the tags written here can appear in rendered HTML: p, h3, blockquote,
+// ul, ol, li, div (spoilers), a, strong, em, u, s, code, span and br. Text is
+// always escaped and links are limited to http(s) and mailto.
+
+func renderHTML(blocks []*node) string {
+	var b strings.Builder
+	for _, block := range blocks {
+		writeHTMLBlock(&b, block)
+	}
+	return b.String()
+}
+
+func writeHTMLBlock(b *strings.Builder, n *node) {
+	if isInline(n) {
+		b.WriteString("<p>")
+		writeHTMLInline(b, n)
+		b.WriteString("</p>")
+		return
+	}
+
+	switch n.kind {
+	case kindHeading:
+		b.WriteString("<h3>")
+		writeHTMLFlow(b, n.children, false)
+		b.WriteString("</h3>")
+	case kindQuote:
+		b.WriteString("<blockquote>")
+		writeHTMLFlow(b, n.children, true)
+		b.WriteString("</blockquote>")
+	case kindSpoiler:
+		b.WriteString(`<div class="review-spoiler">`)
+		writeHTMLFlow(b, n.children, true)
+		b.WriteString("</div>")
+	case kindList:
+		tag := "ul"
+		if n.ordered {
+			tag = "ol"
+		}
+		b.WriteString("<" + tag + ">")
+		for _, item := range n.children {
+			writeHTMLBlock(b, item)
+		}
+		b.WriteString("</" + tag + ">")
+	case kindListItem:
+		b.WriteString("<li>")
+		writeHTMLFlow(b, n.children, false)
+		b.WriteString("</li>")
+	default:
+		if allInline(n.children) {
+			b.WriteString("<p>")
+			writeHTMLFlow(b, n.children, false)
+			b.WriteString("</p>")
+		} else {
+			writeHTMLFlow(b, n.children, true)
+		}
+	}
+}
+
+// writeHTMLFlow writes mixed inline and block children. When wrap is set,
+// runs of inline content are wrapped in paragraphs.
+func writeHTMLFlow(b *strings.Builder, children []*node, wrap bool) {
+	inRun := false
+	for _, child := range children {
+		if isInline(child) {
+			if wrap && !inRun {
+				b.WriteString("<p>")
+			}
+			inRun = true
+			writeHTMLInline(b, child)
+			continue
+		}
+		if wrap && inRun {
+			b.WriteString("</p>")
+		}
+		inRun = false
+		writeHTMLBlock(b, child)
+	}
+	if wrap && inRun {
+		b.WriteString("</p>")
+	}
+}
+
+func writeHTMLInline(b *strings.Builder, n *node) {
+	switch n.kind {
+	case kindBreak:
+		b.WriteString("<br>")
+	case kindLink:
+		fmt.Fprintf(b, `<a href="%s" rel="nofollow noopener" target="_blank">`, html.EscapeString(n.href))
+		for _, child := range n.children {
+			writeHTMLInline(b, child)
+		}
+		b.WriteString("</a>")
+	case kindText:
+		text := strings.ReplaceAll(html.EscapeString(n.text), "\n", "<br>")
+		if n.marks.code {
+			text = "<code>" + text + "</code>"
+		}
+		if n.marks.bold {
+			text = "<strong>" + text + "</strong>"
+		}
+		if n.marks.italic {
+			text = "<em>" + text + "</em>"
+		}
+		if n.marks.underline {
+			text = "<u>" + text + "</u>"
+		}
+		if n.marks.strike {
+			text = "<s>" + text + "</s>"
+		}
+		if n.marks.spoiler {
+			text = `<span class="review-spoiler">` + text + "</span>"
+		}
+		b.WriteString(text)
+	default:
+		// Block nested where inline content was expected: keep its text
+		for _, child := range n.children {
+			writeHTMLInline(b, child)
+		}
+	}
+}
+
+func allInline(nodes []*node) bool {
+	for _, n := range nodes {
+		if !isInline(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func renderMarkdown(blocks []*node) string {
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if md := markdownBlock(block); md != "" {
+			parts = append(parts, md)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func markdownBlock(n *node) string {
+	if isInline(n) {
+		return markdownInline(n)
+	}
+
+	switch n.kind {
+	case kindHeading:
+		return "### " + markdownFlow(n.children)
+	case kindQuote:
+		return prefixLines(markdownFlow(n.children), "> ")
+	case kindSpoiler:
+		return prefixLines("**Spoiler**\n\n"+markdownFlow(n.children), "> ")
+	case kindList:
+		items := make([]string, 0, len(n.children))
+		for i, item := range n.children {
+			marker := "- "
+			if n.ordered {
+				marker = fmt.Sprintf("%d. ", i+1)
+			}
+			content := prefixLines(markdownFlow(item.children), strings.Repeat(" ", len(marker)))
+			items = append(items, marker+strings.TrimLeft(content, " "))
+		}
+		return strings.Join(items, "\n")
+	default:
+		return markdownFlow(n.children)
+	}
+}
+
+// markdownFlow renders mixed children, separating blocks with blank lines
+func markdownFlow(children []*node) string {
+	var parts []string
+	var run strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(run.String()); s != "" {
+			parts = append(parts, s)
+		}
+		run.Reset()
+	}
+
+	for _, child := range children {
+		if isInline(child) {
+			run.WriteString(markdownInline(child))
+			continue
+		}
+		flush()
+		if md := markdownBlock(child); md != "" {
+			parts = append(parts, md)
+		}
+	}
+	flush()
+
+	return strings.Join(parts, "\n\n")
+}
+
+func markdownInline(n *node) string {
+	switch n.kind {
+	case kindBreak:
+		return "  \n"
+	case kindLink:
+		var text strings.Builder
+		for _, child := range n.children {
+			text.WriteString(markdownInline(child))
+		}
+		return fmt.Sprintf("[%s](%s)", text.String(), markdownURLEscaper.Replace(n.href))
+	case kindText:
+		if n.marks.code && !strings.Contains(n.text, "`") {
+			return wrapMarkdown(n.text, "`")
+		}
+		text := strings.ReplaceAll(MarkdownEscape(n.text), "\n", "  \n")
+		if n.marks.bold {
+			text = wrapMarkdown(text, "**")
+		}
+		if n.marks.italic {
+			text = wrapMarkdown(text, "*")
+		}
+		if n.marks.strike {
+			text = wrapMarkdown(text, "~~")
+		}
+		return text
+	default:
+		var text strings.Builder
+		for _, child := range n.children {
+			text.WriteString(markdownInline(child))
+		}
+		return text.String()
+	}
+}
+
+// wrapMarkdown surrounds text with delim, keeping leading and trailing
+// whitespace outside the delimiters where Markdown requires it
+func wrapMarkdown(text, delim string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + delim + trimmed + delim + text[start+len(trimmed):]
+}
+
+func prefixLines(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = strings.TrimRight(prefix, " ")
+		} else {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownEscaper escapes characters that would otherwise start Markdown
+// formatting, links, strikethrough or inline HTML
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	`*`, `\*`,
+	`_`, `\_`,
+	`[`, `\[`,
+	`]`, `\]`,
+	`<`, `\<`,
+	`>`, `\>`,
+	`~`, `\~`,
+)
+
+// MarkdownEscape escapes s for use as Markdown text, so it renders as
+// written
+func MarkdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// markdownURLEscaper keeps link destinations from terminating early
+var markdownURLEscaper = strings.NewReplacer(
+	" ", "%20",
+	"(", "%28",
+	")", "%29",
+	"<", "%3C",
+	">", "%3E",
+)
+
+func renderText(blocks []*node) string {
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if text := textBlock(block); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func textBlock(n *node) string {
+	if isInline(n) {
+		return textInline(n)
+	}
+
+	switch n.kind {
+	case kindList:
+		items := make([]string, 0, len(n.children))
+		for i, item := range n.children {
+			marker := "- "
+			if n.ordered {
+				marker = fmt.Sprintf("%d. ", i+1)
+			}
+			items = append(items, marker+textFlow(item.children))
+		}
+		return strings.Join(items, "\n")
+	default:
+		return textFlow(n.children)
+	}
+}
+
+func textFlow(children []*node) string {
+	var parts []string
+	var run strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(run.String()); s != "" {
+			parts = append(parts, s)
+		}
+		run.Reset()
+	}
+
+	for _, child := range children {
+		if isInline(child) {
+			run.WriteString(textInline(child))
+			continue
+		}
+		flush()
+		if text := textBlock(child); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	flush()
+
+	return strings.Join(parts, "\n\n")
+}
+
+func textInline(n *node) string {
+	switch n.kind {
+	case kindBreak:
+		return "\n"
+	case kindText:
+		return n.text
+	default:
+		var text strings.Builder
+		for _, child := range n.children {
+			text.WriteString(textInline(child))
+		}
+		return text.String()
+	}
+}
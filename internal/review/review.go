@@ -0,0 +1,116 @@
+// Package review renders Hardcover reviews into allow-listed HTML, Markdown
+// and plain text from their Slate documents or raw text.
+package review
+
+import (
+	"strings"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+)
+
+// kind is the type of a normalized review node
+type kind int
+
+const (
+	kindParagraph kind = iota
+	kindHeading
+	kindQuote
+	kindList
+	kindListItem
+	kindSpoiler
+	kindLink
+	kindText
+	kindBreak
+)
+
+// marks is the formatting applied to a text node
+type marks struct {
+	bold, italic, underline, strike, code, spoiler bool
+}
+
+// node is a review document element after normalization. Block nodes hold
+// children; text nodes hold text and marks.
+type node struct {
+	kind     kind
+	ordered  bool // for lists
+	href     string
+	text     string
+	marks    marks
+	children []*node
+}
+
+// Render renders a user book's review, preferring its Slate document and
+// falling back to the raw review text. It returns nil when there is no review.
+func Render(book hardcover.UserBook) *hardcover.RenderedReview {
+	blocks := bookBlocks(book)
+	if len(blocks) == 0 {
+		return nil
+	}
+	return render(blocks)
+}
+
+// bookBlocks normalizes a user book's review, preferring its Slate document
+func bookBlocks(book hardcover.UserBook) []*node {
+	var blocks []*node
+	if book.ReviewSlate != nil {
+		blocks = fromSlate(book.ReviewSlate.Document)
+	}
+	if len(blocks) == 0 && book.ReviewRaw != nil {
+		blocks = fromRaw(*book.ReviewRaw)
+	}
+	return blocks
+}
+
+// RenderSlate renders a Slate document
+func RenderSlate(doc hardcover.SlateDocument) *hardcover.RenderedReview {
+	return render(fromSlate(doc))
+}
+
+// RenderRaw renders plain review text, treating each line as a paragraph
+func RenderRaw(raw string) *hardcover.RenderedReview {
+	return render(fromRaw(raw))
+}
+
+func render(blocks []*node) *hardcover.RenderedReview {
+	return &hardcover.RenderedReview{
+		HTML:      renderHTML(blocks),
+		Markdown:  renderMarkdown(blocks),
+		Text:      renderText(blocks),
+		WordCount: wordCount(blocks),
+	}
+}
+
+// wordCount counts whitespace separated words across all text nodes
+func wordCount(blocks []*node) int {
+	var b strings.Builder
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n.kind == kindText {
+			b.WriteString(n.text)
+			return
+		}
+		for _, child := range n.children {
+			walk(child)
+		}
+		// Separate blocks so words at block boundaries aren't joined
+		b.WriteString(" ")
+	}
+	for _, block := range blocks {
+		walk(block)
+	}
+	return len(strings.Fields(b.String()))
+}
+
+// fromRaw splits raw review text into paragraphs on line breaks
+func fromRaw(raw string) []*node {
+	var blocks []*node
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			blocks = append(blocks, &node{
+				kind:     kindParagraph,
+				children: []*node{{kind: kindText, text: line}},
+			})
+		}
+	}
+	return blocks
+}
@@ -0,0 +1,222 @@
+package review
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+)
+
+func parseSlate(t *testing.T, doc string) hardcover.SlateDocument {
+	t.Helper()
+	var slate hardcover.ReviewSlate
+	if err := json.Unmarshal([]byte(doc), &slate); err != nil {
+		t.Fatalf("Failed to parse Slate document: %v", err)
+	}
+	return slate.Document
+}
+
+func TestRenderSlate(t *testing.T) {
+	doc := parseSlate(t, `{
+  "document": {
+    "object": "document",
+    "children": [
+      {
+        "type": "paragraph",
+        "object": "block",
+        "children": [
+          {"text": "A "},
+          {"text": "great", "bold": true},
+          {"text": " read, see "},
+          {"type": "link", "data": {"href": "https://example.com/a?b=1&c=2"}, "children": [{"text": "this"}]},
+          {"text": " and "},
+          {"type": "link", "data": {"href": "javascript:alert(1)"}, "children": [{"text": "that"}]},
+          {"text": "."}
+        ]
+      },
+      {
+        "type": "bulleted-list",
+        "object": "block",
+        "children": [
+          {"type": "list-item", "children": [{"text": "one", "marks": [{"type": "italic"}]}]},
+          {"type": "list-item", "children": [{"text": "<two>"}]}
+        ]
+      },
+      {
+        "type": "spoiler",
+        "object": "block",
+        "children": [{"text": "The butler did it"}]
+      },
+      {
+        "type": "paragraph",
+        "object": "block",
+        "children": [{"text": "   "}]
+      }
+    ]
+  }
+}`)
+
+	rendered := RenderSlate(doc)
+
+	wantHTML := `<p>A <strong>great</strong> read, see <a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener" target="_blank">this</a> and that.</p>` +
+		`<ul><li><em>one</em></li><li>&lt;two&gt;</li></ul>` +
+		`<div class="review-spoiler"><p>The butler did it</p></div>`
+	if rendered.HTML != wantHTML {
+		t.Errorf("Unexpected HTML:\ngot:  %s\nwant: %s", rendered.HTML, wantHTML)
+	}
+
+	wantMarkdown := "A **great** read, see [this](https://example.com/a?b=1&c=2) and that.\n\n" +
+		"- *one*\n- \\<two\\>\n\n" +
+		"> **Spoiler**\n>\n> The butler did it"
+	if rendered.Markdown != wantMarkdown {
+		t.Errorf("Unexpected Markdown:\ngot:  %q\nwant: %q", rendered.Markdown, wantMarkdown)
+	}
+
+	wantText := "A great read, see this and that.\n\n- one\n- <two>\n\nThe butler did it"
+	if rendered.Text != wantText {
+		t.Errorf("Unexpected text:\ngot:  %q\nwant: %q", rendered.Text, wantText)
+	}
+
+	if rendered.WordCount != 13 {
+		t.Errorf("Expected 13 words, got %d", rendered.WordCount)
+	}
+}
+
+func TestRenderOrderedListAndQuote(t *testing.T) {
+	doc := parseSlate(t, `{
+  "document": {
+    "children": [
+      {"type": "numbered-list", "children": [
+        {"type": "list-item", "children": [{"text": "first"}]},
+        {"text": "second"}
+      ]},
+      {"type": "block-quote", "children": [{"text": "Quoted"}, {"type": "break"}, {"text": "line"}]}
+    ]
+  }
+}`)
+
+	rendered := RenderSlate(doc)
+
+	if want := "<ol><li>first</li><li>second</li></ol><blockquote><p>Quoted<br>line</p></blockquote>"; rendered.HTML != want {
+		t.Errorf("Unexpected HTML:\ngot:  %s\nwant: %s", rendered.HTML, want)
+	}
+	if want := "1. first\n2. second\n\n> Quoted  \n> line"; rendered.Markdown != want {
+		t.Errorf("Unexpected Markdown:\ngot:  %q\nwant: %q", rendered.Markdown, want)
+	}
+}
+
+func TestSafeHref(t *testing.T) {
+	tests := []struct {
+		href string
+		want string
+	}{
+		{"https://example.com/x", "https://example.com/x"},
+		{"http://example.com", "http://example.com"},
+		{"mailto:me@example.com", "mailto:me@example.com"},
+		{"/books/dune", "https://hardcover.app/books/dune"},
+		{"javascript:alert(1)", ""},
+		{"JaVaScRiPt:alert(1)", ""},
+		{"data:text/html,<script>", ""},
+		{"//evil.example.com", ""},
+		{"https:///nohost", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := safeHref(tt.href); got != tt.want {
+			t.Errorf("safeHref(%q) = %q, want %q", tt.href, got, tt.want)
+		}
+	}
+}
+
+func TestRenderFallsBackToRaw(t *testing.T) {
+	raw := "First line\n\nSecond *line*"
+	book := hardcover.UserBook{
+		ReviewRaw:   &raw,
+		ReviewSlate: &hardcover.ReviewSlate{},
+	}
+
+	rendered := Render(book)
+	if rendered == nil {
+		t.Fatal("Expected a rendered review")
+	}
+	if want := "<p>First line</p><p>Second *line*</p>"; rendered.HTML != want {
+		t.Errorf("Unexpected HTML: %s", rendered.HTML)
+	}
+	if want := "First line\n\nSecond \\*line\\*"; rendered.Markdown != want {
+		t.Errorf("Unexpected Markdown: %q", rendered.Markdown)
+	}
+	if rendered.WordCount != 4 {
+		t.Errorf("Expected 4 words, got %d", rendered.WordCount)
+	}
+
+	if Render(hardcover.UserBook{}) != nil {
+		t.Error("Expected nil for a book without a review")
+	}
+}
+
+func TestRenderEscapesText(t *testing.T) {
+	rendered := RenderRaw(`<script>alert("x")</script>`)
+	if strings.Contains(rendered.HTML, "<script>") {
+		t.Errorf("Expected text to be escaped, got %s", rendered.HTML)
+	}
+}
+
+func TestRenderTeaser(t *testing.T) {
+	doc := parseSlate(t, `{
+  "document": {
+    "children": [
+      {"type": "paragraph", "children": [{"text": "Great book. "}, {"text": "Bruce dies.", "spoiler": true}]},
+      {"type": "spoiler", "children": [{"text": "The twist is the butler."}]},
+      {"type": "paragraph", "children": [{"text": "Recommended."}]}
+    ]
+  }
+}`)
+	book := hardcover.UserBook{ReviewSlate: &hardcover.ReviewSlate{Document: doc}}
+
+	teaser, found := RenderTeaser(book)
+	if !found {
+		t.Fatal("Expected spoilers to be found")
+	}
+	if teaser == nil || teaser.Text != "Great book.\n\nRecommended." {
+		t.Errorf("Unexpected teaser: %+v", teaser)
+	}
+	if full := Render(book); !strings.Contains(full.Text, "butler") {
+		t.Errorf("Expected the full rendering to keep spoilers, got %q", full.Text)
+	}
+
+	raw := "No spoilers here"
+	teaser, found = RenderTeaser(hardcover.UserBook{ReviewRaw: &raw})
+	if found || teaser == nil || teaser.Text != raw {
+		t.Errorf("Expected review without spoilers to be unchanged, got %+v, %v", teaser, found)
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		limit     int
+		want      string
+		truncated bool
+	}{
+		{name: "short text is unchanged", text: "A short review.", limit: 50, want: "A short review."},
+		{name: "whitespace is collapsed", text: "One\n\ntwo   three", limit: 50, want: "One two three"},
+		{name: "cuts at a sentence", text: "It was great. I loved every page of it.", limit: 24, want: "It was great.", truncated: true},
+		{name: "cuts between words", text: "An extraordinarily well written book", limit: 20, want: "An extraordinarily…", truncated: true},
+		{name: "drops trailing punctuation", text: "First, second, third fourth", limit: 14, want: "First, second…", truncated: true},
+		{name: "counts characters not bytes", text: "Ça été très émouvant à lire", limit: 13, want: "Ça été très…", truncated: true},
+		{name: "long word is cut", text: "Supercalifragilistic", limit: 5, want: "Super…", truncated: true},
+		{name: "keeps combining marks", text: "cafés", limit: 4, want: "caf…", truncated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, truncated := Excerpt(tt.text, tt.limit)
+			if got != tt.want || truncated != tt.truncated {
+				t.Errorf("Excerpt(%q, %d) = %q, %v; want %q, %v", tt.text, tt.limit, got, truncated, tt.want, tt.truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package review
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// allowedTags maps the tags kept by Sanitize to the attributes they may carry.
+// Other tags are removed but their text is kept.
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil, "div": {"class"}, "span": {"class"},
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"strong": nil, "b": nil, "em": nil, "i": nil, "u": nil, "s": nil,
+	"del": nil, "ins": nil, "strike": nil, "sub": nil, "sup": nil,
+	"code": nil, "pre": nil, "blockquote": nil,
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"details": nil, "summary": nil,
+	"a": {"href", "title"},
+}
+
+// droppedTags are removed together with everything inside them
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "noscript": true, "noembed": true,
+	"noframes": true, "template": true, "textarea": true, "select": true,
+	"title": true, "xmp": true, "plaintext": true, "svg": true, "math": true,
+}
+
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+// allowedClasses are the class names kept on div and span
+var allowedClasses = map[string]bool{"review-spoiler": true}
+
+// SanitizeStats counts what Sanitize removed
+type SanitizeStats struct {
+	Elements   int
+	Attributes int
+	URLs       int
+}
+
+// Modified reports whether anything was removed
+func (s SanitizeStats) Modified() bool {
+	return s.Elements+s.Attributes+s.URLs > 0
+}
+
+// Sanitize reduces untrusted HTML to an allow-list of formatting tags. Scripts,
+// event handlers, styles and non-http(s) URLs are removed, text is re-escaped,
+// unclosed tags are closed, and links get rel="nofollow noopener".
+func Sanitize(s string) (string, SanitizeStats) {
+	var (
+		b     strings.Builder
+		stats SanitizeStats
+		open  []string // allowed tags written and not yet closed
+		skip  string   // dropped tag whose content is being skipped
+		depth int      // nesting of skip within itself
+	)
+
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			for i := len(open) - 1; i >= 0; i-- {
+				b.WriteString("</" + open[i] + ">")
+			}
+			return b.String(), stats
+
+		case html.TextToken:
+			if skip == "" {
+				b.WriteString(html.EscapeString(string(z.Text())))
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			name := tok.Data
+			if skip != "" {
+				if name == skip && tt == html.StartTagToken {
+					depth++
+				}
+				continue
+			}
+			if droppedTags[name] {
+				stats.Elements++
+				if tt == html.StartTagToken {
+					skip, depth = name, 1
+				}
+				continue
+			}
+			attrs, ok := allowedTags[name]
+			if !ok {
+				stats.Elements++
+				continue
+			}
+
+			tag, keep := sanitizeTag(name, attrs, tok.Attr, &stats)
+			if !keep {
+				continue
+			}
+			b.WriteString(tag)
+			if !voidTags[name] && tt == html.StartTagToken {
+				open = append(open, name)
+			}
+
+		case html.EndTagToken:
+			name := z.Token().Data
+			if skip != "" {
+				if name == skip {
+					if depth--; depth == 0 {
+						skip = ""
+					}
+				}
+				continue
+			}
+			// Close everything opened since the matching start tag
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != name {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+
+		case html.CommentToken, html.DoctypeToken:
+			stats.Elements++
+		}
+	}
+}
+
+// sanitizeTag writes a start tag with only its allowed attributes. Links
+// without a safe href are unwrapped, so keep is false for them.
+func sanitizeTag(name string, allowed []string, attrs []html.Attribute, stats *SanitizeStats) (tag string, keep bool) {
+	var b strings.Builder
+	b.WriteString("<" + name)
+
+	href := ""
+	for _, attr := range attrs {
+		key := strings.ToLower(attr.Key)
+		if attr.Namespace != "" || !slices.Contains(allowed, key) {
+			// rel and target on links are replaced rather than removed
+			if name != "a" || (key != "rel" && key != "target") {
+				stats.Attributes++
+			}
+			continue
+		}
+
+		value := attr.Val
+		switch key {
+		case "href":
+			if href = safeHref(value); href == "" {
+				stats.URLs++
+			}
+			continue
+		case "class":
+			if value = allowedClassNames(value); value == "" {
+				stats.Attributes++
+				continue
+			}
+		case "start":
+			if _, err := strconv.Atoi(value); err != nil {
+				stats.Attributes++
+				continue
+			}
+		}
+		b.WriteString(" " + key + `="` + html.EscapeString(value) + `"`)
+	}
+
+	if name == "a" {
+		if href == "" {
+			return "", false
+		}
+		b.WriteString(` href="` + html.EscapeString(href) + `" rel="nofollow noopener" target="_blank"`)
+	}
+
+	b.WriteString(">")
+	return b.String(), true
+}
+
+// allowedClassNames filters a class attribute down to allowedClasses
+func allowedClassNames(value string) string {
+	var kept []string
+	for _, class := range strings.Fields(value) {
+		if allowedClasses[class] {
+			kept = append(kept, class)
+		}
+	}
+	return strings.Join(kept, " ")
+}
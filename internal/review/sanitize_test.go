@@ -0,0 +1,84 @@
+package review
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+		stats SanitizeStats
+	}{
+		{
+			name:  "allowed formatting is kept",
+			input: `<p>A <strong>great</strong> <em>read</em><br/></p>`,
+			want:  `<p>A <strong>great</strong> <em>read</em><br></p>`,
+		},
+		{
+			name:  "scripts are removed with their content",
+			input: `<p>Hi</p><script>alert("x")</script><style>p{}</style>`,
+			want:  `<p>Hi</p>`,
+			stats: SanitizeStats{Elements: 2},
+		},
+		{
+			name:  "event handlers and styles are removed",
+			input: `<p onclick="steal()" style="color:red">Hi</p>`,
+			want:  `<p>Hi</p>`,
+			stats: SanitizeStats{Attributes: 2},
+		},
+		{
+			name:  "javascript links are unwrapped",
+			input: `<a href="javascript:alert(1)">click</a>`,
+			want:  `click`,
+			stats: SanitizeStats{URLs: 1},
+		},
+		{
+			name:  "links get rel and target",
+			input: `<a href="https://example.com" rel="opener" target="_self" title="Ex">x</a>`,
+			want:  `<a title="Ex" href="https://example.com" rel="nofollow noopener" target="_blank">x</a>`,
+		},
+		{
+			name:  "unknown tags keep their text",
+			input: `<font color="red">red</font><img src=x onerror=alert(1)>`,
+			want:  `red`,
+			stats: SanitizeStats{Elements: 2},
+		},
+		{
+			name:  "text is escaped and tags closed",
+			input: `<blockquote><p>1 &lt; 2 & <b>bold`,
+			want:  `<blockquote><p>1 &lt; 2 &amp; <b>bold</b></p></blockquote>`,
+		},
+		{
+			name:  "mismatched end tags close inner tags",
+			input: `<ul><li><em>one</ul><p>after</p>`,
+			want:  `<ul><li><em>one</em></li></ul><p>after</p>`,
+		},
+		{
+			name:  "comments are removed",
+			input: `<p>a<!-- <script>x</script> -->b</p>`,
+			want:  `<p>ab</p>`,
+			stats: SanitizeStats{Elements: 1},
+		},
+		{
+			name:  "only spoiler classes are kept",
+			input: `<span class="review-spoiler evil">s</span><div class="evil">d</div>`,
+			want:  `<span class="review-spoiler">s</span><div>d</div>`,
+			stats: SanitizeStats{Attributes: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stats := Sanitize(tt.input)
+			if got != tt.want {
+				t.Errorf("Sanitize(%q)\ngot:  %s\nwant: %s", tt.input, got, tt.want)
+			}
+			if stats != tt.stats {
+				t.Errorf("Expected stats %+v, got %+v", tt.stats, stats)
+			}
+			if stats.Modified() != (tt.stats != SanitizeStats{}) {
+				t.Errorf("Unexpected Modified() = %v", stats.Modified())
+			}
+		})
+	}
+}
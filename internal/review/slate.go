@@ -0,0 +1,217 @@
+package review
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+)
+
+// blockKinds maps Slate block and inline types to node kinds. Hardcover's
+// editor has used several naming schemes over time, so aliases are accepted.
+var blockKinds = map[string]kind{
+	"paragraph":      kindParagraph,
+	"p":              kindParagraph,
+	"heading":        kindHeading,
+	"heading-one":    kindHeading,
+	"heading-two":    kindHeading,
+	"heading-three":  kindHeading,
+	"heading-four":   kindHeading,
+	"h1":             kindHeading,
+	"h2":             kindHeading,
+	"h3":             kindHeading,
+	"h4":             kindHeading,
+	"block-quote":    kindQuote,
+	"blockquote":     kindQuote,
+	"quote":          kindQuote,
+	"bulleted-list":  kindList,
+	"unordered-list": kindList,
+	"ul_list":        kindList,
+	"ul":             kindList,
+	"numbered-list":  kindList,
+	"ordered-list":   kindList,
+	"ol_list":        kindList,
+	"ol":             kindList,
+	"list-item":      kindListItem,
+	"list_item":      kindListItem,
+	"li":             kindListItem,
+	"spoiler":        kindSpoiler,
+	"spoiler-block":  kindSpoiler,
+	"link":           kindLink,
+	"a":              kindLink,
+	"break":          kindBreak,
+	"line-break":     kindBreak,
+}
+
+// orderedLists are the list types rendered with numbers
+var orderedLists = map[string]bool{
+	"numbered-list": true,
+	"ordered-list":  true,
+	"ol_list":       true,
+	"ol":            true,
+}
+
+// fromSlate normalizes a Slate document into review nodes, dropping empty
+// blocks
+func fromSlate(doc hardcover.SlateDocument) []*node {
+	var blocks []*node
+	for _, block := range doc.Children {
+		n := newBlock(block.Type, block.Data, "")
+		n.children = convertChildren(block.Children)
+		if n = normalize(n); n != nil && hasText(n) {
+			blocks = append(blocks, n)
+		}
+	}
+	return blocks
+}
+
+// newBlock creates a node for a Slate block or inline type. Unknown types
+// become paragraphs so their text is still shown.
+func newBlock(typ string, data map[string]interface{}, directURL string) *node {
+	k, ok := blockKinds[strings.ToLower(typ)]
+	if !ok {
+		k = kindParagraph
+	}
+
+	n := &node{kind: k, ordered: orderedLists[strings.ToLower(typ)]}
+	if k == kindLink {
+		href := directURL
+		for _, key := range []string{"href", "url"} {
+			if v, ok := data[key].(string); ok && href == "" {
+				href = v
+			}
+		}
+		n.href = safeHref(href)
+	}
+	return n
+}
+
+// convertChildren converts the children of a Slate node. Each child is a text
+// leaf, an inline node or a nested block.
+func convertChildren(children []hardcover.SlateText) []*node {
+	var nodes []*node
+	for _, child := range children {
+		if child.Type == "" && len(child.Children) == 0 {
+			nodes = append(nodes, textNodes(child)...)
+			continue
+		}
+
+		n := newBlock(child.Type, child.Data, child.URL)
+		n.children = convertChildren(child.Children)
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// textNodes converts a Slate text leaf, which may be split into leaves
+func textNodes(leaf hardcover.SlateText) []*node {
+	base := marks{
+		bold:      leaf.Bold,
+		italic:    leaf.Italic,
+		underline: leaf.Underline,
+		strike:    leaf.Strikethrough,
+		code:      leaf.Code,
+		spoiler:   leaf.Spoiler,
+	}
+	applyMarks(&base, leaf.Marks)
+
+	if len(leaf.Leaves) == 0 {
+		return []*node{{kind: kindText, text: leaf.Text, marks: base}}
+	}
+
+	nodes := make([]*node, 0, len(leaf.Leaves))
+	for _, l := range leaf.Leaves {
+		m := base
+		applyMarks(&m, l.Marks)
+		nodes = append(nodes, &node{kind: kindText, text: l.Text, marks: m})
+	}
+	return nodes
+}
+
+func applyMarks(m *marks, slateMarks []hardcover.SlateMark) {
+	for _, mark := range slateMarks {
+		switch strings.ToLower(mark.Type) {
+		case "bold", "strong":
+			m.bold = true
+		case "italic", "em", "emphasis":
+			m.italic = true
+		case "underline", "underlined", "u":
+			m.underline = true
+		case "strikethrough", "strike", "del":
+			m.strike = true
+		case "code":
+			m.code = true
+		case "spoiler":
+			m.spoiler = true
+		}
+	}
+}
+
+// normalize fixes up structure the renderers rely on: list children are
+// always list items, and links without a safe target are unwrapped.
+func normalize(n *node) *node {
+	var children []*node
+	for _, child := range n.children {
+		child = normalize(child)
+		if child == nil {
+			continue
+		}
+		if child.kind == kindLink && child.href == "" {
+			children = append(children, child.children...)
+			continue
+		}
+		if n.kind == kindList && child.kind != kindListItem {
+			child = &node{kind: kindListItem, children: []*node{child}}
+		}
+		children = append(children, child)
+	}
+	n.children = children
+	return n
+}
+
+// hasText reports whether n contains any non-whitespace text
+func hasText(n *node) bool {
+	if n.kind == kindText {
+		return strings.TrimSpace(n.text) != ""
+	}
+	for _, child := range n.children {
+		if hasText(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInline reports whether n is rendered inside a block rather than as one
+func isInline(n *node) bool {
+	return n.kind == kindText || n.kind == kindLink || n.kind == kindBreak
+}
+
+// safeHref returns href if it is an http(s) or mailto URL. Relative links
+// are resolved against hardcover.app. Anything else, including javascript:
+// URLs, yields "".
+func safeHref(href string) string {
+	href = strings.TrimSpace(href)
+	if href == "" {
+		return ""
+	}
+
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/") {
+		u = (&url.URL{Scheme: "https", Host: "hardcover.app"}).ResolveReference(u)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return ""
+		}
+		return u.String()
+	case "mailto":
+		return u.String()
+	}
+	return ""
+}
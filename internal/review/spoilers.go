@@ -0,0 +1,42 @@
+package review
+
+import "github.com/gouthamve/hardcover-book-embed/internal/hardcover"
+
+// RenderTeaser renders a user book's review with its spoiler blocks and
+// spoiler-marked text removed. found reports whether the review marked any
+// content as a spoiler. teaser is nil when nothing is left once spoilers are
+// removed.
+func RenderTeaser(book hardcover.UserBook) (teaser *hardcover.RenderedReview, found bool) {
+	blocks, found := withoutSpoilers(bookBlocks(book))
+	if len(blocks) == 0 {
+		return nil, found
+	}
+	return render(blocks), found
+}
+
+// withoutSpoilers returns copies of nodes with spoiler content removed,
+// dropping blocks left without any text
+func withoutSpoilers(nodes []*node) ([]*node, bool) {
+	var kept []*node
+	found := false
+	for _, n := range nodes {
+		if n.kind == kindSpoiler || (n.kind == kindText && n.marks.spoiler) {
+			found = true
+			continue
+		}
+
+		children, childFound := withoutSpoilers(n.children)
+		found = found || childFound
+		if !childFound {
+			kept = append(kept, n)
+			continue
+		}
+
+		clone := *n
+		clone.children = children
+		if hasText(&clone) {
+			kept = append(kept, &clone)
+		}
+	}
+	return kept, found
+}
@@ -1,6 +1,8 @@
 (function() {
     // Hardcover Review Widget
     const WIDGET_VERSION = '1.0.0';
+    // Pages with a nonce-based CSP pass their nonce on to our styles
+    const STYLE_NONCE = document.currentScript ? document.currentScript.nonce : '';
     
     // HTML escape function to prevent XSS
     function escapeHtml(unsafe) {
@@ -13,6 +15,108 @@
             .replace(/'/g, "&#039;");
     }
     
+    // Decode a BlurHash (https://blurha.sh) into a small PNG data URL
+    const BASE83 = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+    function decode83(str) {
+        let value = 0;
+        for (const c of str) {
+            const digit = BASE83.indexOf(c);
+            if (digit < 0) return NaN;
+            value = value * 83 + digit;
+        }
+        return value;
+    }
+
+    function srgbToLinear(value) {
+        const v = value / 255;
+        return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+    }
+
+    function linearToSrgb(value) {
+        const v = Math.max(0, Math.min(1, value));
+        return v <= 0.0031308
+            ? Math.trunc(v * 12.92 * 255 + 0.5)
+            : Math.trunc((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255 + 0.5);
+    }
+
+    function signPow(value, exp) {
+        return Math.sign(value) * Math.pow(Math.abs(value), exp);
+    }
+
+    function blurHashToDataURL(hash, width, height) {
+        if (typeof hash !== 'string' || hash.length < 6) return null;
+        const size = decode83(hash[0]);
+        const nx = (size % 9) + 1;
+        const ny = Math.floor(size / 9) + 1;
+        if (isNaN(size) || hash.length !== 4 + 2 * nx * ny) return null;
+
+        const maxValue = (decode83(hash[1]) + 1) / 166;
+        const dc = decode83(hash.substring(2, 6));
+        const colors = [[srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]];
+        for (let i = 1; i < nx * ny; i++) {
+            const v = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+            colors.push([
+                signPow((Math.floor(v / 361) - 9) / 9, 2) * maxValue,
+                signPow(((Math.floor(v / 19) % 19) - 9) / 9, 2) * maxValue,
+                signPow(((v % 19) - 9) / 9, 2) * maxValue
+            ]);
+        }
+
+        const canvas = document.createElement('canvas');
+        canvas.width = width;
+        canvas.height = height;
+        const ctx = canvas.getContext('2d');
+        if (!ctx) return null;
+        const pixels = ctx.createImageData(width, height);
+        for (let y = 0; y < height; y++) {
+            for (let x = 0; x < width; x++) {
+                let r = 0, g = 0, b = 0;
+                for (let j = 0; j < ny; j++) {
+                    for (let i = 0; i < nx; i++) {
+                        const basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+                        const color = colors[i + j * nx];
+                        r += color[0] * basis;
+                        g += color[1] * basis;
+                        b += color[2] * basis;
+                    }
+                }
+                const offset = 4 * (x + y * width);
+                pixels.data[offset] = linearToSrgb(r);
+                pixels.data[offset + 1] = linearToSrgb(g);
+                pixels.data[offset + 2] = linearToSrgb(b);
+                pixels.data[offset + 3] = 255;
+            }
+        }
+        ctx.putImageData(pixels, 0, 0);
+        return canvas.toDataURL();
+    }
+
+    // Pick a book's outbound link by name, as computed by the server's link templates
+    function bookLink(links, target) {
+        const link = target && links ? links[target] : null;
+        return typeof link === 'string' && /^https?:\/\//i.test(link) ? link : null;
+    }
+
+    // Paint a cover's dominant color and blurred preview while the image loads
+    function paintCoverPlaceholder(element, image) {
+        if (!element || !image) return;
+        if (/^#[0-9a-f]{6}$/i.test(image.dominant_color || '')) {
+            element.style.backgroundColor = image.dominant_color;
+        }
+        if (image.blurhash) {
+            try {
+                const url = blurHashToDataURL(image.blurhash, 8, 12);
+                if (url) {
+                    element.style.backgroundImage = `url("${url}")`;
+                    element.style.backgroundSize = 'cover';
+                }
+            } catch (e) {
+                // The dominant color is enough of a placeholder
+            }
+        }
+    }
+    
     // Escape HTML and convert newlines to <br> tags
     function escapeHtmlWithBreaks(unsafe) {
         if (unsafe === null || unsafe === undefined) return '';
@@ -26,7 +130,12 @@
         maxWidth: '800px',
         showPoweredBy: true,
         maxReviewLength: 300,
-        showDate: false
+        showDate: false,
+        spoilers: 'show',
+        proxyImages: true,
+        linkTarget: null,
+        trackClicks: false,
+        token: null
     };
 
     // Widget styles
@@ -200,6 +309,21 @@
             margin-bottom: 0.5rem;
         }
 
+        .hrw-spoiler-blur {
+            filter: blur(5px);
+            cursor: pointer;
+            user-select: none;
+        }
+
+        .hrw-spoiler-reveal {
+            background: none;
+            border: none;
+            padding: 0;
+            color: #2563eb;
+            font-size: 0.875rem;
+            cursor: pointer;
+        }
+
         .hrw-read-more {
             color: #2563eb;
             text-decoration: none;
@@ -330,7 +454,23 @@
             this.showLoading();
             
             try {
-                const endpoint = `/api/books/reviews/${this.config.username}`;
+                const params = new URLSearchParams();
+                // Load covers through the embed server so visitors never contact Hardcover directly
+                if (this.config.proxyImages) {
+                    params.set('images', 'proxy');
+                }
+                if (this.config.spoilers && this.config.spoilers !== 'show') {
+                    params.set('spoilers', this.config.spoilers);
+                }
+                if (this.config.maxReviewLength) {
+                    // The API accepts excerpt lengths between 20 and 5000 characters, rounded down to a few fixed sizes
+                    params.set('excerpt_length', Math.min(Math.max(this.config.maxReviewLength, 20), 5000));
+                }
+                if (this.config.token) {
+                    params.set('token', this.config.token);
+                }
+                const query = params.toString();
+                const endpoint = `/api/books/reviews/${this.config.username}${query ? `?${query}` : ''}`;
                 const response = await fetch(`${this.config.apiUrl}${endpoint}`);
                 
                 if (!response.ok) {
@@ -434,6 +574,22 @@
             }
             
             this.element.innerHTML = html;
+
+            this.element.querySelectorAll('.hrw-review-item').forEach((item, i) => {
+                item.querySelectorAll('.hrw-book-cover').forEach(cover => paintCoverPlaceholder(cover, reviews[i].book.image));
+            });
+
+            this.element.querySelectorAll('.hrw-spoiler-blur').forEach(el => {
+                el.addEventListener('click', () => el.classList.remove('hrw-spoiler-blur'), { once: true });
+            });
+            this.element.querySelectorAll('.hrw-spoiler-reveal').forEach(button => {
+                button.addEventListener('click', () => {
+                    const text = button.parentElement.querySelector('.hrw-review-text');
+                    text.innerHTML = escapeHtmlWithBreaks(button.dataset.spoiler);
+                    text.hidden = false;
+                    button.remove();
+                });
+            });
         }
 
         extractTextFromSlate(reviewSlate) {
@@ -467,16 +623,34 @@
             return `<div class="hrw-authors">by ${authors}</div>`;
         }
 
+        reviewHref(review, target) {
+            const link = bookLink(review.links, target);
+            if (this.config.trackClicks) {
+                // Count the click on the embed server, which redirects to the same link
+                const params = new URLSearchParams();
+                params.set('link', link ? target : 'review');
+                if (this.config.token) params.set('token', this.config.token);
+                return `${this.config.apiUrl}/r/reviews/${encodeURIComponent(this.config.username)}/${review.book.id}?${params}`;
+            }
+            return link || `https://hardcover.app/books/${encodeURIComponent(review.book.slug)}/reviews/@${encodeURIComponent(this.config.username)}`;
+        }
+
         renderReview(review) {
             const cover = review.book.image && review.book.image.url
                 ? `<img src="${escapeHtml(review.book.image.url)}" alt="${escapeHtml(review.book.title)} cover" loading="lazy">`
                 : '';
             
-            const reviewUrl = `https://hardcover.app/books/${escapeHtml(review.book.slug)}/reviews/@${escapeHtml(this.config.username)}`;
+            const reviewUrl = escapeHtml(this.reviewHref(review, 'review'));
+            // Titles link to the review on Hardcover unless another link is picked
+            const titleUrl = escapeHtml(this.reviewHref(review, this.config.linkTarget));
             const slateText = this.extractTextFromSlate(review.review_slate);
-            const reviewText = slateText || review.review_raw || '';
-            const truncatedText = this.truncateText(reviewText, this.config.maxReviewLength);
-            const needsReadMore = reviewText.length > this.config.maxReviewLength;
+            const hiddenSpoiler = review.review && review.review.spoiler ? review.review.spoiler.text : '';
+            // Reviews with an excerpt come without their full text
+            const reviewText = (review.excerpt && review.excerpt.text) || (review.review && review.review.text) || slateText || review.review_raw || '';
+            const blur = this.config.spoilers === 'blur' && review.review_has_spoilers;
+            // Prefer the server's excerpt, which cuts at word boundaries
+            const truncatedText = review.excerpt ? review.excerpt.text : this.truncateText(reviewText, this.config.maxReviewLength);
+            const needsReadMore = review.excerpt ? review.excerpt.truncated : reviewText.length > this.config.maxReviewLength;
 
             return `
                 <li class="hrw-review-item">
@@ -489,7 +663,7 @@
                                 ${cover}
                             </div>
                             <div class="hrw-book-info">
-                                <a href="${reviewUrl}" target="_blank" rel="noopener" class="hrw-book-title">${escapeHtml(review.book.title)}</a>
+                                <a href="${titleUrl}" target="_blank" rel="noopener" class="hrw-book-title">${escapeHtml(review.book.title)}</a>
                                 ${this.renderAuthors(review.book.contributions)}
                                 <div class="hrw-review-meta">
                                     ${review.rating ? `
@@ -504,8 +678,9 @@
                             </div>
                         </div>
                         ${review.review_has_spoilers ? '<span class="hrw-spoiler-warning">Contains spoilers</span>' : ''}
-                        ${reviewText ? `
-                            <p class="hrw-review-text">${escapeHtmlWithBreaks(truncatedText)}</p>
+                        ${reviewText || hiddenSpoiler ? `
+                            <p class="hrw-review-text${blur ? ' hrw-spoiler-blur' : ''}"${reviewText ? '' : ' hidden'}>${escapeHtmlWithBreaks(truncatedText)}</p>
+                            ${hiddenSpoiler ? `<button type="button" class="hrw-spoiler-reveal" data-spoiler="${escapeHtml(hiddenSpoiler)}">Show spoilers</button>` : ''}
                             ${needsReadMore ? `<a href="${reviewUrl}" target="_blank" rel="noopener" class="hrw-read-more">Read full review →</a>` : ''}
                         ` : ''}
                     </div>
@@ -520,6 +695,7 @@
         
         const styleSheet = document.createElement('style');
         styleSheet.id = 'hardcover-review-widget-styles';
+        if (STYLE_NONCE) styleSheet.nonce = STYLE_NONCE;
         styleSheet.textContent = styles;
         document.head.appendChild(styleSheet);
     }
@@ -545,6 +721,15 @@
             if (element.dataset.showDate !== undefined) {
                 config.showDate = element.dataset.showDate !== 'false';
             }
+            if (element.dataset.spoilers) config.spoilers = element.dataset.spoilers;
+            if (element.dataset.token) config.token = element.dataset.token;
+            if (element.dataset.proxyImages !== undefined) {
+                config.proxyImages = element.dataset.proxyImages !== 'false';
+            }
+            if (element.dataset.linkTarget) config.linkTarget = element.dataset.linkTarget;
+            if (element.dataset.trackClicks !== undefined) {
+                config.trackClicks = element.dataset.trackClicks !== 'false';
+            }
             
             new HardcoverReviewWidget(element, config);
         });
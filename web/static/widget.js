@@ -1,6 +1,8 @@
 (function() {
     // Hardcover Book Widget
     const WIDGET_VERSION = '1.0.0';
+    // Pages with a nonce-based CSP pass their nonce on to our styles
+    const STYLE_NONCE = document.currentScript ? document.currentScript.nonce : '';
     
     // HTML escape function to prevent XSS
     function escapeHtml(unsafe) {
@@ -13,6 +15,108 @@
             .replace(/'/g, "&#039;");
     }
     
+    // Decode a BlurHash (https://blurha.sh) into a small PNG data URL
+    const BASE83 = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+    function decode83(str) {
+        let value = 0;
+        for (const c of str) {
+            const digit = BASE83.indexOf(c);
+            if (digit < 0) return NaN;
+            value = value * 83 + digit;
+        }
+        return value;
+    }
+
+    function srgbToLinear(value) {
+        const v = value / 255;
+        return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+    }
+
+    function linearToSrgb(value) {
+        const v = Math.max(0, Math.min(1, value));
+        return v <= 0.0031308
+            ? Math.trunc(v * 12.92 * 255 + 0.5)
+            : Math.trunc((1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255 + 0.5);
+    }
+
+    function signPow(value, exp) {
+        return Math.sign(value) * Math.pow(Math.abs(value), exp);
+    }
+
+    function blurHashToDataURL(hash, width, height) {
+        if (typeof hash !== 'string' || hash.length < 6) return null;
+        const size = decode83(hash[0]);
+        const nx = (size % 9) + 1;
+        const ny = Math.floor(size / 9) + 1;
+        if (isNaN(size) || hash.length !== 4 + 2 * nx * ny) return null;
+
+        const maxValue = (decode83(hash[1]) + 1) / 166;
+        const dc = decode83(hash.substring(2, 6));
+        const colors = [[srgbToLinear(dc >> 16), srgbToLinear((dc >> 8) & 255), srgbToLinear(dc & 255)]];
+        for (let i = 1; i < nx * ny; i++) {
+            const v = decode83(hash.substring(4 + i * 2, 6 + i * 2));
+            colors.push([
+                signPow((Math.floor(v / 361) - 9) / 9, 2) * maxValue,
+                signPow(((Math.floor(v / 19) % 19) - 9) / 9, 2) * maxValue,
+                signPow(((v % 19) - 9) / 9, 2) * maxValue
+            ]);
+        }
+
+        const canvas = document.createElement('canvas');
+        canvas.width = width;
+        canvas.height = height;
+        const ctx = canvas.getContext('2d');
+        if (!ctx) return null;
+        const pixels = ctx.createImageData(width, height);
+        for (let y = 0; y < height; y++) {
+            for (let x = 0; x < width; x++) {
+                let r = 0, g = 0, b = 0;
+                for (let j = 0; j < ny; j++) {
+                    for (let i = 0; i < nx; i++) {
+                        const basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+                        const color = colors[i + j * nx];
+                        r += color[0] * basis;
+                        g += color[1] * basis;
+                        b += color[2] * basis;
+                    }
+                }
+                const offset = 4 * (x + y * width);
+                pixels.data[offset] = linearToSrgb(r);
+                pixels.data[offset + 1] = linearToSrgb(g);
+                pixels.data[offset + 2] = linearToSrgb(b);
+                pixels.data[offset + 3] = 255;
+            }
+        }
+        ctx.putImageData(pixels, 0, 0);
+        return canvas.toDataURL();
+    }
+
+    // Pick a book's outbound link by name, as computed by the server's link templates
+    function bookLink(links, target) {
+        const link = target && links ? links[target] : null;
+        return typeof link === 'string' && /^https?:\/\//i.test(link) ? link : null;
+    }
+
+    // Paint a cover's dominant color and blurred preview while the image loads
+    function paintCoverPlaceholder(element, image) {
+        if (!element || !image) return;
+        if (/^#[0-9a-f]{6}$/i.test(image.dominant_color || '')) {
+            element.style.backgroundColor = image.dominant_color;
+        }
+        if (image.blurhash) {
+            try {
+                const url = blurHashToDataURL(image.blurhash, 8, 12);
+                if (url) {
+                    element.style.backgroundImage = `url("${url}")`;
+                    element.style.backgroundSize = 'cover';
+                }
+            } catch (e) {
+                // The dominant color is enough of a placeholder
+            }
+        }
+    }
+    
     // Default configuration
     const defaultConfig = {
         apiUrl: 'http://localhost:8080',
@@ -22,7 +126,11 @@
         columns: 'auto-fill',
         minColumnWidth: '120px',
         gap: '1rem',
-        showPoweredBy: true
+        showPoweredBy: true,
+        proxyImages: true,
+        linkTarget: 'hardcover',
+        trackClicks: false,
+        token: null
     };
 
     // Widget styles
@@ -198,7 +306,16 @@
                     ? `/api/books/last-read/${this.config.username}`
                     : `/api/books/currently-reading/${this.config.username}`;
                 
-                const response = await fetch(`${this.config.apiUrl}${endpoint}`);
+                const params = new URLSearchParams();
+                // Load covers through the embed server so visitors never contact Hardcover directly
+                if (this.config.proxyImages) {
+                    params.set('images', 'proxy');
+                }
+                if (this.config.token) {
+                    params.set('token', this.config.token);
+                }
+                const query = params.toString() ? `?${params}` : '';
+                const response = await fetch(`${this.config.apiUrl}${endpoint}${query}`);
                 
                 if (!response.ok) {
                     throw new Error(`HTTP ${response.status}`);
@@ -261,6 +378,22 @@
             }
             
             this.element.innerHTML = html;
+
+            const covers = this.element.querySelectorAll('.hw-book-cover');
+            books.forEach((book, i) => paintCoverPlaceholder(covers[i], book.book.image));
+        }
+
+        bookHref(book) {
+            const link = bookLink(book.links, this.config.linkTarget);
+            if (this.config.trackClicks) {
+                // Count the click on the embed server, which redirects to the same link
+                const params = new URLSearchParams();
+                if (link) params.set('link', this.config.linkTarget);
+                if (this.config.token) params.set('token', this.config.token);
+                const query = params.toString() ? `?${params}` : '';
+                return `${this.config.apiUrl}/r/${this.config.bookType}/${encodeURIComponent(this.config.username)}/${book.book.id}${query}`;
+            }
+            return link || `https://hardcover.app/books/${encodeURIComponent(book.book.slug)}`;
         }
 
         renderBook(book) {
@@ -268,7 +401,7 @@
                 ? `<img src="${escapeHtml(book.book.image.url)}" alt="${escapeHtml(book.book.title)} cover" loading="lazy">`
                 : '';
             
-            const bookUrl = `https://hardcover.app/books/${escapeHtml(book.book.slug)}`;
+            const bookUrl = escapeHtml(this.bookHref(book));
 
             return `
                 <li class="hw-book-item">
@@ -289,6 +422,7 @@
         
         const styleSheet = document.createElement('style');
         styleSheet.id = 'hardcover-widget-styles';
+        if (STYLE_NONCE) styleSheet.nonce = STYLE_NONCE;
         styleSheet.textContent = styles;
         document.head.appendChild(styleSheet);
     }
@@ -314,6 +448,14 @@
             if (element.dataset.showPoweredBy !== undefined) {
                 config.showPoweredBy = element.dataset.showPoweredBy !== 'false';
             }
+            if (element.dataset.proxyImages !== undefined) {
+                config.proxyImages = element.dataset.proxyImages !== 'false';
+            }
+            if (element.dataset.token) config.token = element.dataset.token;
+            if (element.dataset.linkTarget) config.linkTarget = element.dataset.linkTarget;
+            if (element.dataset.trackClicks !== undefined) {
+                config.trackClicks = element.dataset.trackClicks !== 'false';
+            }
             
             new HardcoverWidget(element, config);
         });
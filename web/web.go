@@ -0,0 +1,10 @@
+// Package web holds the pages and scripts served by the server, built into
+// the binary
+package web
+
+import "embed"
+
+// Files holds the static files under static/ and the test pages
+//
+//go:embed static test-widget.html test-reviews.html
+var Files embed.FS
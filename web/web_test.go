@@ -0,0 +1,21 @@
+package web
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestFiles(t *testing.T) {
+	for _, name := range []string{
+		"static/widget.js",
+		"static/review-widget.js",
+		"static/embed.html",
+		"static/reviews-embed.html",
+		"test-widget.html",
+		"test-reviews.html",
+	} {
+		if _, err := fs.Stat(Files, name); err != nil {
+			t.Errorf("expected %s to be embedded: %v", name, err)
+		}
+	}
+}